@@ -1,67 +1,249 @@
 package btree
 
-import "bytes"
+import (
+	"bytes"
+	"sort"
+	"unsafe"
+)
+
+// DefaultDegree is the minimum degree used by New. Every node but the root
+// holds between DefaultDegree-1 and 2*DefaultDegree-1 keys.
+const DefaultDegree = 32
 
 type WalkerFunc func(key []byte, value int64)
 
-type Tree struct {
+// RangeFunc is called for each key of a bounded walk. Returning false stops
+// the walk.
+type RangeFunc func(key []byte, value int64) bool
+
+type item struct {
 	key   []byte
 	value int64
-	left  *Tree
-	right *Tree
+}
+
+type node struct {
+	items    []item
+	children []*node
+	cow      *copyOnWriteContext
+	// count is the number of items in the subtree rooted at the node
+	count int
+}
+
+type toRemove int
+
+const (
+	removeItem toRemove = iota
+	removeMax
+)
+
+type Tree struct {
+	degree   int
+	root     *node
+	cow      *copyOnWriteContext
+	length   int
+	keyBytes int64
 }
 
 func New() *Tree {
+	return NewWithDegree(DefaultDegree)
+}
+
+func NewWithDegree(degree int) *Tree {
+	if degree < 2 {
+		panic("btree: degree must be at least 2")
+	}
+
 	return &Tree{
-		left:  &Tree{},
-		right: &Tree{},
+		degree: degree,
+		cow:    &copyOnWriteContext{},
 	}
 }
 
+func (tree *Tree) maxItems() int {
+	return 2*tree.degree - 1
+}
+
+func (tree *Tree) minItems() int {
+	return tree.degree - 1
+}
+
+// Insert adds key to the tree. Inserting a key that is already present keeps
+// the previous entries: the new one is ordered after them.
 func (tree *Tree) Insert(key []byte, value int64) {
-	if tree.key == nil {
-		tree.key = key
-		tree.value = value
-		tree.right = New()
-		tree.left = New()
-	} else {
-		if bytes.Compare(key, tree.key) <= 0 {
-			tree.left.Insert(key, value)
+	tree.length++
+	tree.keyBytes += int64(len(key))
+
+	if tree.root == nil {
+		tree.root = tree.cow.newNode()
+		tree.root.items = append(tree.root.items, item{key, value})
+		tree.root.count = 1
+		return
+	}
+
+	tree.root = tree.root.mutableFor(tree.cow)
+	if len(tree.root.items) >= tree.maxItems() {
+		middle, right := tree.root.split(tree.maxItems() / 2)
+		left := tree.root
+		tree.root = tree.cow.newNode()
+		tree.root.items = append(tree.root.items, middle)
+		tree.root.children = append(tree.root.children, left, right)
+		tree.root.count = left.count + 1 + right.count
+	}
+
+	tree.root.insert(item{key, value}, tree.maxItems())
+}
+
+// Replace sets the value of key, inserting it when it is not in the tree yet.
+// It reports whether an existing entry was overwritten and its old value.
+func (tree *Tree) Replace(key []byte, value int64) (bool, int64) {
+	if tree.find(key) == nil {
+		tree.Insert(key, value)
+		return false, 0
+	}
+
+	it := tree.findMutable(key)
+	old := it.value
+	it.value = value
+	return true, old
+}
+
+// Delete removes the entry Search would return for key, and reports whether
+// there was one and its value.
+func (tree *Tree) Delete(key []byte) (bool, int64) {
+	if tree.root == nil {
+		return false, 0
+	}
+
+	tree.root = tree.root.mutableFor(tree.cow)
+	it, ok := tree.root.remove(key, tree.minItems(), removeItem)
+	if ok {
+		tree.length--
+		tree.keyBytes -= int64(len(it.key))
+	}
+
+	if len(tree.root.items) == 0 {
+		if tree.root.isLeaf() {
+			tree.root = nil
 		} else {
-			tree.right.Insert(key, value)
+			tree.root = tree.root.children[0]
 		}
 	}
+
+	return ok, it.value
+}
+
+// Len returns the number of entries in the tree.
+func (tree *Tree) Len() int {
+	return tree.length
 }
 
+var (
+	itemSize    = int64(unsafe.Sizeof(item{}))
+	nodeSize    = int64(unsafe.Sizeof(node{}))
+	pointerSize = int64(unsafe.Sizeof(&node{}))
+)
+
+// MemoryUsage returns a lower bound of the bytes held by the tree: keys,
+// entries and nodes. Nodes are assumed to be full and their slices to have no
+// spare capacity, so the actual usage is higher.
+func (tree *Tree) MemoryUsage() int64 {
+	if tree.length == 0 {
+		return 0
+	}
+
+	maxItems := int64(tree.maxItems())
+	nodes := (int64(tree.length) + maxItems - 1) / maxItems
+	// Every node but the root is pointed to by its parent
+	return tree.keyBytes + int64(tree.length)*itemSize + nodes*nodeSize + (nodes-1)*pointerSize
+}
+
+// Search returns the value of the first inserted entry matching key.
 func (tree *Tree) Search(key []byte) (bool, int64) {
-	if bytes.Compare(tree.key, key) == 0 {
-		return true, tree.value
-	} else {
-		if tree.left != nil && bytes.Compare(key, tree.key) < 0 {
-			return tree.left.Search(key)
-		} else if tree.right != nil && bytes.Compare(key, tree.key) > 0 {
-			return tree.right.Search(key)
+	it := tree.find(key)
+	if it == nil {
+		return false, 0
+	}
+	return true, it.value
+}
+
+// SearchLast returns the value of the last inserted entry matching key.
+func (tree *Tree) SearchLast(key []byte) (bool, int64) {
+	ok, found, value := tree.Floor(key)
+	if !ok || bytes.Compare(found, key) != 0 {
+		return false, 0
+	}
+	return true, value
+}
+
+// SearchAll returns the values of every entry matching key, in insert order.
+func (tree *Tree) SearchAll(key []byte) []int64 {
+	var values []int64
+
+	c := tree.Cursor()
+	for ok := c.Seek(key); ok && bytes.Compare(c.Key(), key) == 0; ok = c.Next() {
+		values = append(values, c.Value())
+	}
+
+	return values
+}
+
+func (tree *Tree) find(key []byte) *item {
+	var found *item
+
+	for n := tree.root; n != nil; {
+		i := n.lowerBound(key)
+		if i < len(n.items) && bytes.Compare(n.items[i].key, key) == 0 {
+			// Keep descending: older duplicates live in the left subtree.
+			found = &n.items[i]
 		}
+
+		if n.isLeaf() {
+			break
+		}
+		n = n.children[i]
 	}
-	return false, 0
+
+	return found
 }
 
-func (tree *Tree) IsLeaf() bool {
-	return tree.key == nil
+// findMutable is find for an entry about to be modified: nodes shared with a
+// clone are copied on the way down.
+func (tree *Tree) findMutable(key []byte) *item {
+	var found *item
+
+	tree.root = tree.root.mutableFor(tree.cow)
+	for n := tree.root; ; {
+		i := n.lowerBound(key)
+		if i < len(n.items) && bytes.Compare(n.items[i].key, key) == 0 {
+			found = &n.items[i]
+		}
+
+		if n.isLeaf() {
+			break
+		}
+		n = n.mutableChild(i)
+	}
+
+	return found
 }
 
 func (tree *Tree) Walk(fn WalkerFunc) {
-	if !tree.left.IsLeaf() {
-		tree.left.Walk(fn)
+	if tree.root != nil {
+		tree.root.walk(fn)
 	}
+}
 
-	if !tree.IsLeaf() {
-		fn(tree.key, tree.value)
+// WalkRange calls fn in key order for every key in [from, to). A nil from
+// starts at the smallest key and a nil to runs to the greatest one.
+func (tree *Tree) WalkRange(from, to []byte, fn RangeFunc) {
+	if tree.root != nil {
+		tree.root.walkRange(from, to, fn)
 	}
+}
 
-	if !tree.right.IsLeaf() {
-		tree.right.Walk(fn)
-	}
+// WalkPrefix calls fn in key order for every key starting with prefix.
+func (tree *Tree) WalkPrefix(prefix []byte, fn RangeFunc) {
+	tree.WalkRange(prefix, prefixEnd(prefix), fn)
 }
 
 func (tree *Tree) Keys() [][]byte {
@@ -71,3 +253,251 @@ func (tree *Tree) Keys() [][]byte {
 	})
 	return keys
 }
+
+// prefixEnd returns the smallest key greater than every key starting with
+// prefix, or nil if there is none.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+func (n *node) isLeaf() bool {
+	return len(n.children) == 0
+}
+
+// lowerBound returns the index of the first item whose key is >= key.
+func (n *node) lowerBound(key []byte) int {
+	return sort.Search(len(n.items), func(i int) bool {
+		return bytes.Compare(n.items[i].key, key) >= 0
+	})
+}
+
+// upperBound returns the index of the first item whose key is > key.
+func (n *node) upperBound(key []byte) int {
+	return sort.Search(len(n.items), func(i int) bool {
+		return bytes.Compare(n.items[i].key, key) > 0
+	})
+}
+
+func (n *node) insert(it item, maxItems int) {
+	i := n.upperBound(it.key)
+	n.count++
+
+	if n.isLeaf() {
+		n.insertItemAt(i, it)
+		return
+	}
+
+	if len(n.children[i].items) >= maxItems {
+		middle, right := n.mutableChild(i).split(maxItems / 2)
+		n.insertItemAt(i, middle)
+		n.insertChildAt(i+1, right)
+		if bytes.Compare(it.key, middle.key) >= 0 {
+			i++
+		}
+	}
+
+	n.mutableChild(i).insert(it, maxItems)
+}
+
+// split moves every item after index i, and the matching children, into a new
+// node. The item at index i is returned so the caller can push it up.
+func (n *node) split(i int) (item, *node) {
+	middle := n.items[i]
+
+	next := n.cow.newNode()
+	next.items = append(next.items, n.items[i+1:]...)
+	for j := i; j < len(n.items); j++ {
+		n.items[j] = item{}
+	}
+	n.items = n.items[:i]
+
+	if !n.isLeaf() {
+		next.children = append(next.children, n.children[i+1:]...)
+		for j := i + 1; j < len(n.children); j++ {
+			n.children[j] = nil
+		}
+		n.children = n.children[:i+1]
+	}
+
+	next.count = len(next.items)
+	for _, child := range next.children {
+		next.count += child.count
+	}
+	n.count -= next.count + 1
+
+	return middle, next
+}
+
+func (n *node) insertItemAt(i int, it item) {
+	n.items = append(n.items, item{})
+	copy(n.items[i+1:], n.items[i:])
+	n.items[i] = it
+}
+
+func (n *node) insertChildAt(i int, child *node) {
+	n.children = append(n.children, nil)
+	copy(n.children[i+1:], n.children[i:])
+	n.children[i] = child
+}
+
+func (n *node) walk(fn WalkerFunc) {
+	for i, it := range n.items {
+		if !n.isLeaf() {
+			n.children[i].walk(fn)
+		}
+		fn(it.key, it.value)
+	}
+
+	if !n.isLeaf() {
+		n.children[len(n.children)-1].walk(fn)
+	}
+}
+
+// walkRange returns false once the walk is over, either because fn asked to
+// stop or because a key reached the upper bound.
+func (n *node) walkRange(from, to []byte, fn RangeFunc) bool {
+	i := 0
+	if from != nil {
+		i = n.lowerBound(from)
+	}
+
+	for ; i < len(n.items); i++ {
+		if !n.isLeaf() && !n.children[i].walkRange(from, to, fn) {
+			return false
+		}
+		if to != nil && bytes.Compare(n.items[i].key, to) >= 0 {
+			return false
+		}
+		if !fn(n.items[i].key, n.items[i].value) {
+			return false
+		}
+	}
+
+	if !n.isLeaf() {
+		return n.children[len(n.children)-1].walkRange(from, to, fn)
+	}
+	return true
+}
+
+// remove deletes an item from the subtree rooted at n. Children are grown
+// before descending into them so that none ends up with fewer than minItems.
+func (n *node) remove(key []byte, minItems int, typ toRemove) (item, bool) {
+	var i int
+	var found bool
+
+	switch typ {
+	case removeMax:
+		if n.isLeaf() {
+			n.count--
+			return n.removeItemAt(len(n.items) - 1), true
+		}
+		i = len(n.items)
+	case removeItem:
+		i = n.lowerBound(key)
+		found = i < len(n.items) && bytes.Compare(n.items[i].key, key) == 0
+		if n.isLeaf() {
+			if found {
+				n.count--
+				return n.removeItemAt(i), true
+			}
+			return item{}, false
+		}
+		// An older duplicate in the left subtree takes precedence.
+		if found && bytes.Compare(n.children[i].max().key, key) == 0 {
+			found = false
+		}
+	}
+
+	if len(n.children[i].items) <= minItems {
+		return n.growChildAndRemove(i, key, minItems, typ)
+	}
+
+	child := n.mutableChild(i)
+	if found {
+		out := n.items[i]
+		n.items[i], _ = child.remove(nil, minItems, removeMax)
+		n.count--
+		return out, true
+	}
+
+	out, ok := child.remove(key, minItems, typ)
+	if ok {
+		n.count--
+	}
+	return out, ok
+}
+
+// growChildAndRemove gives child i an extra item, stealing one from a sibling
+// or merging it with one, then retries the removal.
+func (n *node) growChildAndRemove(i int, key []byte, minItems int, typ toRemove) (item, bool) {
+	if i > 0 && len(n.children[i-1].items) > minItems {
+		child, left := n.mutableChild(i), n.mutableChild(i-1)
+		stolen := left.removeItemAt(len(left.items) - 1)
+		child.insertItemAt(0, n.items[i-1])
+		n.items[i-1] = stolen
+		moved := 1
+		if !left.isLeaf() {
+			grandchild := left.removeChildAt(len(left.children) - 1)
+			child.insertChildAt(0, grandchild)
+			moved += grandchild.count
+		}
+		left.count -= moved
+		child.count += moved
+	} else if i < len(n.items) && len(n.children[i+1].items) > minItems {
+		child, right := n.mutableChild(i), n.mutableChild(i+1)
+		stolen := right.removeItemAt(0)
+		child.items = append(child.items, n.items[i])
+		n.items[i] = stolen
+		moved := 1
+		if !right.isLeaf() {
+			grandchild := right.removeChildAt(0)
+			child.children = append(child.children, grandchild)
+			moved += grandchild.count
+		}
+		right.count -= moved
+		child.count += moved
+	} else {
+		if i >= len(n.items) {
+			i--
+		}
+		child := n.mutableChild(i)
+		middle := n.removeItemAt(i)
+		right := n.removeChildAt(i + 1)
+		child.items = append(child.items, middle)
+		child.items = append(child.items, right.items...)
+		child.children = append(child.children, right.children...)
+		child.count += 1 + right.count
+	}
+
+	return n.remove(key, minItems, typ)
+}
+
+func (n *node) max() item {
+	for !n.isLeaf() {
+		n = n.children[len(n.children)-1]
+	}
+	return n.items[len(n.items)-1]
+}
+
+func (n *node) removeItemAt(i int) item {
+	it := n.items[i]
+	copy(n.items[i:], n.items[i+1:])
+	n.items[len(n.items)-1] = item{}
+	n.items = n.items[:len(n.items)-1]
+	return it
+}
+
+func (n *node) removeChildAt(i int) *node {
+	child := n.children[i]
+	copy(n.children[i:], n.children[i+1:])
+	n.children[len(n.children)-1] = nil
+	n.children = n.children[:len(n.children)-1]
+	return child
+}
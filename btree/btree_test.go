@@ -1,6 +1,13 @@
 package btree
 
-import "testing"
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+)
 
 func TestBtree(t *testing.T) {
 	tree := New()
@@ -44,3 +51,369 @@ func TestBtree(t *testing.T) {
 		t.Errorf("Expected to find value %v for key %s but found %v", 1, "baz", value)
 	}
 }
+
+func TestBtreeSortedInsert(t *testing.T) {
+	for _, degree := range []int{2, 3, DefaultDegree} {
+		tree := NewWithDegree(degree)
+
+		count := 10000
+		for i := 0; i < count; i++ {
+			tree.Insert([]byte(fmt.Sprintf("key%08d", i)), int64(i))
+		}
+
+		for i := 0; i < count; i++ {
+			key := []byte(fmt.Sprintf("key%08d", i))
+			ok, value := tree.Search(key)
+			if !ok || value != int64(i) {
+				t.Errorf("Expected to find value %v for key %s but found %v", i, key, value)
+			}
+		}
+
+		var previous []byte
+		walked := 0
+		tree.Walk(func(key []byte, _ int64) {
+			if previous != nil && bytes.Compare(previous, key) > 0 {
+				t.Errorf("Expected keys to be walked in order but %s came after %s", key, previous)
+			}
+			previous = key
+			walked++
+		})
+		if walked != count {
+			t.Errorf("Expected to walk %d keys but walked %d", count, walked)
+		}
+
+		// a degree d tree holding n keys is at most log_d((n+1)/2) + 1 levels deep
+		maxHeight := int(math.Log(float64(count+1)/2)/math.Log(float64(degree))) + 1
+		if height := Height(tree); height > maxHeight {
+			t.Errorf("Expected tree of degree %d to be at most %d levels deep but it is %d", degree, maxHeight, height)
+		}
+	}
+}
+
+func TestBtreeDuplicateKeys(t *testing.T) {
+	tree := NewWithDegree(2)
+
+	for i := 0; i < 20; i++ {
+		tree.Insert([]byte("dup"), int64(i))
+		tree.Insert([]byte(fmt.Sprintf("key%02d", i)), int64(100+i))
+	}
+
+	ok, value := tree.Search([]byte("dup"))
+	if !ok || value != 0 {
+		t.Errorf("Expected to find the first inserted value %v for key %s but found %v", 0, "dup", value)
+	}
+
+	var values []int64
+	tree.Walk(func(key []byte, value int64) {
+		if string(key) == "dup" {
+			values = append(values, value)
+		}
+	})
+	for i, value := range values {
+		if value != int64(i) {
+			t.Errorf("Expected duplicates to be walked in insert order but got %v", values)
+			break
+		}
+	}
+	if len(values) != 20 {
+		t.Errorf("Expected to walk %d duplicates but walked %d", 20, len(values))
+	}
+
+	ok, _ = tree.Search([]byte("missing"))
+	if ok {
+		t.Errorf("Expected to NOT find key %s", "missing")
+	}
+
+	ok, value = tree.SearchLast([]byte("dup"))
+	if !ok || value != 19 {
+		t.Errorf("Expected to find the last inserted value %v for key %s but found %v", 19, "dup", value)
+	}
+
+	all := tree.SearchAll([]byte("dup"))
+	if !reflect.DeepEqual(all, values) {
+		t.Errorf("Expected to find every value for key %s in insert order.\nExpected: %v\nGot:      %v", "dup", values, all)
+	}
+
+	ok, _ = tree.SearchLast([]byte("key"))
+	if ok || tree.SearchAll([]byte("key")) != nil {
+		t.Errorf("Expected to NOT find key %s", "key")
+	}
+}
+
+func TestBtreeReplace(t *testing.T) {
+	tree := NewWithDegree(2)
+
+	for i := 0; i < 100; i++ {
+		replaced, _ := tree.Replace([]byte(fmt.Sprintf("key%02d", i)), int64(i))
+		if replaced {
+			t.Errorf("Expected inserting new key %d to not replace anything", i)
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key%02d", i))
+		replaced, old := tree.Replace(key, int64(1000+i))
+		if !replaced || old != int64(i) {
+			t.Errorf("Expected rewriting key %s to replace value %v but got %v, %v", key, i, replaced, old)
+		}
+	}
+
+	if count := len(tree.Keys()); count != 100 {
+		t.Errorf("Expected replaced keys to be stored once.\nExpected: %v\nGot:      %v", 100, count)
+	}
+
+	ok, value := tree.Search([]byte("key42"))
+	if !ok || value != 1042 {
+		t.Errorf("Expected to find value %v for key %s but found %v", 1042, "key42", value)
+	}
+}
+
+func TestBtreeDelete(t *testing.T) {
+	for _, degree := range []int{2, 3, 5} {
+		tree := NewWithDegree(degree)
+		expected := make(map[string]int64)
+
+		random := rand.New(rand.NewSource(int64(degree)))
+		for i := 0; i < 2000; i++ {
+			key := fmt.Sprintf("key%04d", random.Intn(500))
+
+			if random.Intn(3) == 0 {
+				ok, value := tree.Delete([]byte(key))
+				old, exists := expected[key]
+				if ok != exists || value != old {
+					t.Fatalf("Expected deleting %s to return %v, %v but got %v, %v", key, exists, old, ok, value)
+				}
+				delete(expected, key)
+			} else {
+				tree.Replace([]byte(key), int64(i))
+				expected[key] = int64(i)
+			}
+
+			if err := Check(tree); err != nil {
+				t.Fatalf("Tree of degree %d is invalid after %d operations: %v", degree, i, err)
+			}
+		}
+
+		actual := make(map[string]int64)
+		tree.Walk(func(key []byte, value int64) {
+			actual[string(key)] = value
+		})
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("Expected tree of degree %d to contain %v but got %v", degree, expected, actual)
+		}
+
+		for key := range expected {
+			tree.Delete([]byte(key))
+		}
+		if tree.root != nil {
+			t.Errorf("Expected tree to be empty after deleting every key")
+		}
+	}
+}
+
+func TestBtreeDeleteDuplicates(t *testing.T) {
+	tree := NewWithDegree(2)
+
+	for i := 0; i < 30; i++ {
+		tree.Insert([]byte("dup"), int64(i))
+		tree.Insert([]byte(fmt.Sprintf("key%02d", i)), int64(i))
+	}
+
+	for i := 0; i < 30; i++ {
+		ok, value := tree.Delete([]byte("dup"))
+		if !ok || value != int64(i) {
+			t.Errorf("Expected Delete to remove duplicates oldest first.\nExpected: %v\nGot:      %v", i, value)
+		}
+		if err := Check(tree); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ok, _ := tree.Delete([]byte("dup"))
+	if ok {
+		t.Errorf("Expected every duplicate to be deleted")
+	}
+}
+
+func TestBtreeWalkRange(t *testing.T) {
+	tree := NewWithDegree(2)
+	for i := 0; i < 100; i++ {
+		tree.Insert([]byte(fmt.Sprintf("key%02d", i)), int64(i))
+	}
+
+	tt := []struct {
+		From     []byte
+		To       []byte
+		Limit    int
+		Expected []int64
+	}{
+		{[]byte("key10"), []byte("key14"), 0, []int64{10, 11, 12, 13}},
+		{[]byte("key095"), []byte("key12"), 0, []int64{10, 11}},
+		{nil, []byte("key03"), 0, []int64{0, 1, 2}},
+		{[]byte("key97"), nil, 0, []int64{97, 98, 99}},
+		{[]byte("key50"), nil, 2, []int64{50, 51}},
+		{[]byte("key20"), []byte("key20"), 0, nil},
+		{[]byte("zzz"), nil, 0, nil},
+	}
+
+	for _, example := range tt {
+		var values []int64
+		tree.WalkRange(example.From, example.To, func(key []byte, value int64) bool {
+			values = append(values, value)
+			return example.Limit == 0 || len(values) < example.Limit
+		})
+
+		if !reflect.DeepEqual(values, example.Expected) {
+			t.Errorf("Expected walking [%s, %s) to yield %v but got %v", example.From, example.To, example.Expected, values)
+		}
+	}
+}
+
+func TestBtreeWalkPrefix(t *testing.T) {
+	tree := NewWithDegree(2)
+	keys := []string{"tenant1/a", "tenant42/b", "tenant42/a", "tenant420/c", "tenant43/a", "tenant4", "\xff\xff", "\xff\xffa"}
+	for i, key := range keys {
+		tree.Insert([]byte(key), int64(i))
+	}
+
+	tt := []struct {
+		Prefix   string
+		Expected []string
+	}{
+		{"tenant42/", []string{"tenant42/a", "tenant42/b"}},
+		{"tenant42", []string{"tenant42/a", "tenant42/b", "tenant420/c"}},
+		{"tenant5", nil},
+		{"\xff", []string{"\xff\xff", "\xff\xffa"}},
+	}
+
+	for _, example := range tt {
+		var actual []string
+		tree.WalkPrefix([]byte(example.Prefix), func(key []byte, _ int64) bool {
+			actual = append(actual, string(key))
+			return true
+		})
+
+		if !reflect.DeepEqual(actual, example.Expected) {
+			t.Errorf("Expected prefix %q to yield %q but got %q", example.Prefix, example.Expected, actual)
+		}
+	}
+}
+
+func TestBtreeLenAndMemoryUsage(t *testing.T) {
+	tree := NewWithDegree(3)
+	if tree.Len() != 0 || tree.MemoryUsage() != 0 {
+		t.Errorf("Expected an empty tree to have no entries nor memory usage")
+	}
+
+	for i := 0; i < 100; i++ {
+		tree.Insert([]byte(fmt.Sprintf("key%02d", i)), int64(i))
+	}
+	tree.Insert([]byte("key00"), 42)
+	tree.Replace([]byte("key01"), 42)
+	tree.Delete([]byte("key02"))
+	tree.Delete([]byte("missing"))
+
+	if tree.Len() != 100 {
+		t.Errorf("Expected tree length to be updated on every change.\nExpected: %v\nGot:      %v", 100, tree.Len())
+	}
+	if tree.Len() != len(tree.Keys()) {
+		t.Errorf("Expected tree length to match the walked keys.\nExpected: %v\nGot:      %v", len(tree.Keys()), tree.Len())
+	}
+
+	usage := tree.MemoryUsage()
+	if usage < 100*5 {
+		t.Errorf("Expected memory usage to account at least for the keys but got %d bytes", usage)
+	}
+
+	// A lower bound of what the nodes actually hold
+	var held int64
+	var count func(n *node)
+	count = func(n *node) {
+		held += nodeSize + int64(cap(n.items))*itemSize + int64(cap(n.children))*pointerSize
+		for _, it := range n.items {
+			held += int64(len(it.key))
+		}
+		for _, child := range n.children {
+			count(child)
+		}
+	}
+	count(tree.root)
+	if usage > held {
+		t.Errorf("Expected memory usage to be a lower bound.\nExpected: <= %v\nGot:      %v", held, usage)
+	}
+
+	tree.Insert([]byte("a-much-longer-key-than-the-others"), 0)
+	if tree.MemoryUsage() <= usage {
+		t.Errorf("Expected memory usage to grow with inserted keys")
+	}
+
+	clone := tree.Clone()
+	clone.Delete([]byte("key03"))
+	if clone.Len() != tree.Len()-1 {
+		t.Errorf("Expected clone length to be tracked separately")
+	}
+}
+
+// Check verifies the B-tree invariants: sorted keys, node occupancy, subtree
+// counts and leaves all at the same depth.
+func Check(tree *Tree) error {
+	if tree.root == nil {
+		return nil
+	}
+
+	leafDepth := -1
+	var previous []byte
+	var check func(n *node, depth int, root bool) error
+	check = func(n *node, depth int, root bool) error {
+		if len(n.items) > tree.maxItems() || (!root && len(n.items) < tree.minItems()) {
+			return fmt.Errorf("node at depth %d holds %d items", depth, len(n.items))
+		}
+		if n.isLeaf() {
+			if leafDepth == -1 {
+				leafDepth = depth
+			} else if leafDepth != depth {
+				return fmt.Errorf("leaves at depth %d and %d", leafDepth, depth)
+			}
+		} else if len(n.children) != len(n.items)+1 {
+			return fmt.Errorf("node with %d items has %d children", len(n.items), len(n.children))
+		}
+
+		count := len(n.items)
+		for _, child := range n.children {
+			count += child.count
+		}
+		if count != n.count {
+			return fmt.Errorf("node at depth %d counts %d items in its subtree instead of %d", depth, n.count, count)
+		}
+
+		for i, it := range n.items {
+			if !n.isLeaf() {
+				if err := check(n.children[i], depth+1, false); err != nil {
+					return err
+				}
+			}
+			if previous != nil && bytes.Compare(previous, it.key) > 0 {
+				return fmt.Errorf("key %s stored after %s", it.key, previous)
+			}
+			previous = it.key
+		}
+
+		if !n.isLeaf() {
+			return check(n.children[len(n.children)-1], depth+1, false)
+		}
+		return nil
+	}
+
+	return check(tree.root, 0, true)
+}
+
+func Height(tree *Tree) int {
+	height := 0
+	for n := tree.root; n != nil; height++ {
+		if n.isLeaf() {
+			return height + 1
+		}
+		n = n.children[0]
+	}
+	return height
+}
@@ -0,0 +1,101 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+	"io"
+)
+
+// EntryIterator returns the entries to build a tree from, one per call. It
+// returns io.EOF once exhausted.
+type EntryIterator func() (key []byte, value int64, err error)
+
+var ErrNotSorted = errors.New("btree: entries are not sorted")
+
+// BuildFromSorted creates a tree from entries sorted in key order, in O(n).
+// Keys are not copied: they must not be modified afterwards.
+func BuildFromSorted(next EntryIterator) (*Tree, error) {
+	return BuildFromSortedWithDegree(DefaultDegree, next)
+}
+
+func BuildFromSortedWithDegree(degree int, next EntryIterator) (*Tree, error) {
+	tree := NewWithDegree(degree)
+	return tree, tree.build(next)
+}
+
+func (tree *Tree) build(next EntryIterator) error {
+	var items []item
+	for {
+		key, value, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if len(items) > 0 && bytes.Compare(items[len(items)-1].key, key) > 0 {
+			return ErrNotSorted
+		}
+
+		items = append(items, item{key, value})
+		tree.keyBytes += int64(len(key))
+	}
+
+	tree.length = len(items)
+	if len(items) == 0 {
+		return nil
+	}
+
+	// Find the smallest height able to hold every item
+	height, capacity := 1, tree.maxItems()
+	for capacity < len(items) {
+		height++
+		capacity = (capacity+1)*(tree.maxItems()+1) - 1
+	}
+
+	tree.root = tree.buildNode(items, height, capacity)
+	return nil
+}
+
+// buildNode creates a subtree of the given height holding items. capacity is
+// the number of items a full subtree of that height holds.
+func (tree *Tree) buildNode(items []item, height, capacity int) *node {
+	n := tree.cow.newNode()
+	n.count = len(items)
+
+	if height == 1 {
+		n.items = append(n.items, items...)
+		return n
+	}
+
+	// Use as few children as possible, then spread items evenly across them:
+	// it keeps every child at least half full.
+	childCapacity := (capacity+1)/(tree.maxItems()+1) - 1
+	children := (len(items) + 1 + childCapacity) / (childCapacity + 1)
+	if children < 2 {
+		children = 2
+	}
+
+	perChild := (len(items) - (children - 1)) / children
+	extra := (len(items) - (children - 1)) % children
+
+	n.items = make([]item, 0, children-1)
+	n.children = make([]*node, 0, children)
+	for i := 0; i < children; i++ {
+		size := perChild
+		if i < extra {
+			size++
+		}
+
+		n.children = append(n.children, tree.buildNode(items[:size], height-1, childCapacity))
+		items = items[size:]
+
+		if i < children-1 {
+			n.items = append(n.items, items[0])
+			items = items[1:]
+		}
+	}
+
+	return n
+}
@@ -0,0 +1,76 @@
+package btree
+
+import (
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestBuildFromSorted(t *testing.T) {
+	for _, degree := range []int{2, 3, 4, DefaultDegree} {
+		for _, count := range []int{0, 1, 2, 3, 7, 8, 100, 1000, 4321} {
+			i := 0
+			tree, err := BuildFromSortedWithDegree(degree, func() ([]byte, int64, error) {
+				if i == count {
+					return nil, 0, io.EOF
+				}
+				i++
+				return []byte(fmt.Sprintf("key%05d", i-1)), int64(i - 1), nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := Check(tree); err != nil {
+				t.Fatalf("Tree of degree %d built from %d entries is invalid: %v", degree, count, err)
+			}
+			if tree.Len() != count {
+				t.Errorf("Expected built tree to hold %d entries but got %d", count, tree.Len())
+			}
+
+			for j := 0; j < count; j++ {
+				key := []byte(fmt.Sprintf("key%05d", j))
+				ok, value := tree.Search(key)
+				if !ok || value != int64(j) {
+					t.Fatalf("Expected to find value %v for key %s but found %v", j, key, value)
+				}
+			}
+
+			// The built tree must stay valid once modified
+			for j := 0; j < count; j += 3 {
+				tree.Delete([]byte(fmt.Sprintf("key%05d", j)))
+				tree.Insert([]byte(fmt.Sprintf("new%05d", j)), int64(j))
+			}
+			if err := Check(tree); err != nil {
+				t.Fatalf("Tree of degree %d built from %d entries is invalid once modified: %v", degree, count, err)
+			}
+		}
+	}
+}
+
+func TestBuildFromSortedErrors(t *testing.T) {
+	keys := []string{"a", "c", "b"}
+	_, err := BuildFromSorted(SliceIterator(keys))
+	if err != ErrNotSorted {
+		t.Errorf("Expected unsorted entries to fail with %v but got %v", ErrNotSorted, err)
+	}
+
+	failure := fmt.Errorf("read failure")
+	_, err = BuildFromSorted(func() ([]byte, int64, error) {
+		return nil, 0, failure
+	})
+	if err != failure {
+		t.Errorf("Expected iterator error to be returned but got %v", err)
+	}
+}
+
+func SliceIterator(keys []string) EntryIterator {
+	i := 0
+	return func() ([]byte, int64, error) {
+		if i == len(keys) {
+			return nil, 0, io.EOF
+		}
+		i++
+		return []byte(keys[i-1]), int64(i - 1), nil
+	}
+}
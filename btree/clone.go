@@ -0,0 +1,53 @@
+package btree
+
+// copyOnWriteContext marks the nodes a tree may modify in place. Nodes owned by
+// another context are shared with a clone and get copied before any change.
+type copyOnWriteContext struct {
+	// a zero sized struct could share its address with another context
+	_ int
+}
+
+// Clone returns a copy of the tree in O(1). Both trees share their nodes until
+// either is modified, and a change made to one is never seen by the other.
+//
+// A clone is a consistent snapshot: it can be read from other goroutines while
+// the original keeps being written to. Clone itself must not run concurrently
+// with writes to the tree.
+func (tree *Tree) Clone() *Tree {
+	clone := *tree
+
+	// Neither tree owns the current nodes anymore
+	tree.cow = &copyOnWriteContext{}
+	clone.cow = &copyOnWriteContext{}
+
+	return &clone
+}
+
+func (cow *copyOnWriteContext) newNode() *node {
+	return &node{cow: cow}
+}
+
+// mutableFor returns n if it is owned by cow, a copy of n owned by cow
+// otherwise.
+func (n *node) mutableFor(cow *copyOnWriteContext) *node {
+	if n.cow == cow {
+		return n
+	}
+
+	out := cow.newNode()
+	out.count = n.count
+	out.items = make([]item, len(n.items), cap(n.items))
+	copy(out.items, n.items)
+	if !n.isLeaf() {
+		out.children = make([]*node, len(n.children), cap(n.children))
+		copy(out.children, n.children)
+	}
+
+	return out
+}
+
+func (n *node) mutableChild(i int) *node {
+	child := n.children[i].mutableFor(n.cow)
+	n.children[i] = child
+	return child
+}
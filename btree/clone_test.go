@@ -0,0 +1,92 @@
+package btree
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestCloneIsolation(t *testing.T) {
+	tree := NewWithDegree(2)
+	for i := 0; i < 100; i++ {
+		tree.Insert([]byte(fmt.Sprintf("key%03d", i)), int64(i))
+	}
+
+	before := Snapshot(tree)
+	clone := tree.Clone()
+
+	for i := 0; i < 100; i += 2 {
+		tree.Delete([]byte(fmt.Sprintf("key%03d", i)))
+	}
+	for i := 1; i < 100; i += 2 {
+		tree.Replace([]byte(fmt.Sprintf("key%03d", i)), int64(1000+i))
+	}
+	for i := 100; i < 200; i++ {
+		tree.Insert([]byte(fmt.Sprintf("key%03d", i)), int64(i))
+	}
+
+	if !reflect.DeepEqual(Snapshot(clone), before) {
+		t.Errorf("Expected changes to the original tree to not be seen by its clone")
+	}
+	if err := Check(tree); err != nil {
+		t.Error(err)
+	}
+
+	cloneBefore := Snapshot(clone)
+	treeBefore := Snapshot(tree)
+	for i := 0; i < 50; i++ {
+		clone.Delete([]byte(fmt.Sprintf("key%03d", i)))
+		clone.Insert([]byte(fmt.Sprintf("new%03d", i)), int64(i))
+	}
+
+	if !reflect.DeepEqual(Snapshot(tree), treeBefore) {
+		t.Errorf("Expected changes to the clone to not be seen by the original tree")
+	}
+	if reflect.DeepEqual(Snapshot(clone), cloneBefore) {
+		t.Errorf("Expected the clone to be writable")
+	}
+	if err := Check(clone); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCloneConcurrentReads(t *testing.T) {
+	tree := New()
+	for i := 0; i < 1000; i++ {
+		tree.Insert([]byte(fmt.Sprintf("key%04d", i)), int64(i))
+	}
+
+	snapshot := tree.Clone()
+
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				key := []byte(fmt.Sprintf("key%04d", i))
+				ok, value := snapshot.Search(key)
+				if !ok || value != int64(i) {
+					t.Errorf("Expected snapshot to find value %v for key %s but found %v", i, key, value)
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key%04d", i))
+		tree.Replace(key, -1)
+		tree.Insert([]byte(fmt.Sprintf("other%04d", i)), int64(i))
+	}
+
+	wg.Wait()
+}
+
+func Snapshot(tree *Tree) map[string]int64 {
+	values := make(map[string]int64)
+	tree.Walk(func(key []byte, value int64) {
+		values[string(key)] = value
+	})
+	return values
+}
@@ -0,0 +1,167 @@
+package btree
+
+// Cursor walks a Tree in key order, in both directions. A cursor is invalidated
+// by any change made to the tree after it was positioned.
+type Cursor struct {
+	tree  *Tree
+	stack []cursorFrame
+}
+
+// cursorFrame is a position in a node. For the top of the stack index is the
+// current item, for every frame below it is the child the cursor went into.
+type cursorFrame struct {
+	node  *node
+	index int
+}
+
+func (tree *Tree) Cursor() *Cursor {
+	return &Cursor{tree: tree}
+}
+
+func (c *Cursor) Valid() bool {
+	return len(c.stack) > 0
+}
+
+func (c *Cursor) Key() []byte {
+	if !c.Valid() {
+		return nil
+	}
+	top := c.stack[len(c.stack)-1]
+	return top.node.items[top.index].key
+}
+
+func (c *Cursor) Value() int64 {
+	if !c.Valid() {
+		return 0
+	}
+	top := c.stack[len(c.stack)-1]
+	return top.node.items[top.index].value
+}
+
+// First moves to the smallest key and reports whether the tree has one.
+func (c *Cursor) First() bool {
+	c.stack = c.stack[:0]
+	if c.tree.root != nil {
+		c.descendFirst(c.tree.root)
+	}
+	return c.Valid()
+}
+
+// Last moves to the greatest key and reports whether the tree has one.
+func (c *Cursor) Last() bool {
+	c.stack = c.stack[:0]
+	if c.tree.root != nil {
+		c.descendLast(c.tree.root)
+	}
+	return c.Valid()
+}
+
+// Seek moves to the first key greater than or equal to key and reports
+// whether there is one.
+func (c *Cursor) Seek(key []byte) bool {
+	c.stack = c.stack[:0]
+
+	for n := c.tree.root; n != nil; {
+		i := n.lowerBound(key)
+		c.stack = append(c.stack, cursorFrame{n, i})
+		if n.isLeaf() {
+			break
+		}
+		n = n.children[i]
+	}
+
+	if c.Valid() {
+		top := c.stack[len(c.stack)-1]
+		if top.index >= len(top.node.items) {
+			c.ascendNext()
+		}
+	}
+
+	return c.Valid()
+}
+
+func (c *Cursor) Next() bool {
+	if !c.Valid() {
+		return false
+	}
+
+	top := &c.stack[len(c.stack)-1]
+	if !top.node.isLeaf() {
+		top.index++
+		c.descendFirst(top.node.children[top.index])
+		return true
+	}
+
+	top.index++
+	if top.index < len(top.node.items) {
+		return true
+	}
+
+	c.ascendNext()
+	return c.Valid()
+}
+
+func (c *Cursor) Prev() bool {
+	if !c.Valid() {
+		return false
+	}
+
+	top := &c.stack[len(c.stack)-1]
+	if !top.node.isLeaf() {
+		c.descendLast(top.node.children[top.index])
+		return true
+	}
+
+	top.index--
+	if top.index >= 0 {
+		return true
+	}
+
+	c.ascendPrev()
+	return c.Valid()
+}
+
+func (c *Cursor) descendFirst(n *node) {
+	for {
+		c.stack = append(c.stack, cursorFrame{n, 0})
+		if n.isLeaf() {
+			return
+		}
+		n = n.children[0]
+	}
+}
+
+func (c *Cursor) descendLast(n *node) {
+	for !n.isLeaf() {
+		c.stack = append(c.stack, cursorFrame{n, len(n.children) - 1})
+		n = n.children[len(n.children)-1]
+	}
+	c.stack = append(c.stack, cursorFrame{n, len(n.items) - 1})
+}
+
+// ascendNext pops exhausted frames until an ancestor has an item after the
+// child the cursor came from. The cursor is invalid if there is none.
+func (c *Cursor) ascendNext() {
+	c.stack = c.stack[:len(c.stack)-1]
+	for c.Valid() {
+		top := c.stack[len(c.stack)-1]
+		if top.index < len(top.node.items) {
+			return
+		}
+		c.stack = c.stack[:len(c.stack)-1]
+	}
+}
+
+// ascendPrev pops exhausted frames until an ancestor has an item before the
+// child the cursor came from. The cursor is invalid if there is none.
+func (c *Cursor) ascendPrev() {
+	c.stack = c.stack[:len(c.stack)-1]
+	for c.Valid() {
+		top := &c.stack[len(c.stack)-1]
+		if top.index > 0 {
+			top.index--
+			return
+		}
+		c.stack = c.stack[:len(c.stack)-1]
+	}
+}
@@ -0,0 +1,92 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestCursorForwardAndBackward(t *testing.T) {
+	for _, degree := range []int{2, 3, DefaultDegree} {
+		tree := NewWithDegree(degree)
+
+		count := 1000
+		for i := count - 1; i >= 0; i-- {
+			tree.Insert([]byte(fmt.Sprintf("key%04d", i)), int64(i))
+		}
+
+		cursor := tree.Cursor()
+		i := 0
+		for ok := cursor.First(); ok; ok = cursor.Next() {
+			if cursor.Value() != int64(i) {
+				t.Fatalf("Expected cursor to yield value %v but got %v", i, cursor.Value())
+			}
+			i++
+		}
+		if i != count {
+			t.Errorf("Expected cursor to yield %d keys moving forward but got %d", count, i)
+		}
+
+		i = count - 1
+		for ok := cursor.Last(); ok; ok = cursor.Prev() {
+			if cursor.Value() != int64(i) {
+				t.Fatalf("Expected cursor to yield value %v but got %v", i, cursor.Value())
+			}
+			i--
+		}
+		if i != -1 {
+			t.Errorf("Expected cursor to yield %d keys moving backward but stopped at %d", count, i)
+		}
+	}
+}
+
+func TestCursorSeek(t *testing.T) {
+	tree := NewWithDegree(2)
+	for i := 0; i < 100; i += 2 {
+		tree.Insert([]byte(fmt.Sprintf("key%02d", i)), int64(i))
+	}
+
+	tt := []struct {
+		Seek  string
+		Found bool
+		Key   string
+	}{
+		{"a", true, "key00"},
+		{"key00", true, "key00"},
+		{"key01", true, "key02"},
+		{"key42", true, "key42"},
+		{"key43", true, "key44"},
+		{"key98", true, "key98"},
+		{"key99", false, ""},
+	}
+
+	cursor := tree.Cursor()
+	for _, example := range tt {
+		ok := cursor.Seek([]byte(example.Seek))
+		if ok != example.Found || bytes.Compare(cursor.Key(), []byte(example.Key)) != 0 {
+			t.Errorf("Expected seeking %s to land on %q but got %q", example.Seek, example.Key, cursor.Key())
+		}
+	}
+
+	cursor.Seek([]byte("key43"))
+	cursor.Prev()
+	if bytes.Compare(cursor.Key(), []byte("key42")) != 0 {
+		t.Errorf("Expected cursor to move back to %s but got %s", "key42", cursor.Key())
+	}
+	cursor.Next()
+	cursor.Next()
+	if bytes.Compare(cursor.Key(), []byte("key46")) != 0 {
+		t.Errorf("Expected cursor to move forward to %s but got %s", "key46", cursor.Key())
+	}
+}
+
+func TestCursorEmptyTree(t *testing.T) {
+	cursor := New().Cursor()
+
+	if cursor.First() || cursor.Last() || cursor.Seek([]byte("foo")) {
+		t.Errorf("Expected cursor over an empty tree to be invalid")
+	}
+	if cursor.Next() || cursor.Prev() || cursor.Key() != nil {
+		t.Errorf("Expected invalid cursor to stay invalid")
+	}
+}
@@ -0,0 +1,1033 @@
+package btree
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"sort"
+	"sync"
+)
+
+// DiskTree is a B+tree stored in fixed size pages, for indexes too large to be
+// kept in memory. Entries live in leaves linked to their siblings, internal
+// pages only hold separator keys. Recently used pages are kept in an LRU cache
+// and changes reach the file when evicted from it or on Flush.
+//
+// File format, every page ending with the CRC32C of its content:
+//
+//	page 0:   magic - version - page-size - root - page-count - length - state - meta-size - meta
+//	leaf:     kind - count - prev - next | key-size - key - value | ...
+//	internal: kind - count - child | key-size - key - child | ...
+//
+// Unlike Tree, a key is stored once: Replace overwrites its value.
+//
+// Pages are written in place, in no particular order, so a tree is only
+// consistent once flushed. The state of page 0 tells: before the first page
+// write following a Flush, the tree is marked dirty and the file synced, and
+// Flush syncs every page before marking it clean again. There is no write
+// ahead log: a tree changed since its last Flush but not flushed, because the
+// process crashed, is opened failed with ErrDiskTreeDirty, and is rebuilt
+// after a Clear. Changes which didn't reach the file are simply lost, the tree
+// being the flushed one. meta, set with SetMeta, lets the caller record what
+// the flushed tree covers.
+//
+// Read and write errors, like corrupted pages, fail the tree: Err returns the
+// first one, and the tree then finds nothing and changes nothing until
+// cleared. A DiskTree is safe for concurrent use, reads also move pages in
+// the cache so every call holds the tree lock.
+type DiskTree struct {
+	lock     sync.Mutex
+	file     PageFile
+	pageSize int
+	root     uint64
+	pages    uint64
+	length   int
+	meta     []byte
+	cache    *pageCache
+	// clean is whether page 0 marks the file as flushed
+	clean bool
+	err   error
+}
+
+// PageFile is where a DiskTree stores its pages, usually an *os.File.
+type PageFile interface {
+	io.ReaderAt
+	io.WriterAt
+	Sync() error
+}
+
+type DiskOptions struct {
+	// PageSize is only used when creating a tree, existing trees keep the
+	// one they were created with.
+	PageSize   int
+	CachePages int
+}
+
+const (
+	DefaultPageSize   = 4096
+	DefaultCachePages = 1024
+	MinPageSize       = 256
+	MaxPageSize       = 1 << 16
+	minCachePages     = 8
+)
+
+var diskMagic = [4]byte{'J', 'B', 'P', 'T'}
+
+const diskVersion = uint32(2)
+
+var (
+	ErrInvalidDiskTree = errors.New("btree: not a disk tree file")
+	ErrDiskTreeVersion = errors.New("btree: unsupported disk tree version")
+	ErrDiskTreeDirty   = errors.New("btree: disk tree was changed but not flushed")
+	ErrPageChecksum    = errors.New("btree: page checksum mismatch")
+	ErrKeyTooLarge     = errors.New("btree: key too large for the page size")
+	ErrMetaTooLarge    = errors.New("btree: meta too large for the page size")
+	ErrPageSize        = errors.New("btree: page size out of bounds")
+)
+
+const (
+	leafPage     = byte(1)
+	internalPage = byte(2)
+
+	cleanState = byte(1)
+	dirtyState = byte(2)
+
+	metaSize         = 4 + 4 + 4 + 8 + 8 + 8 + 1 + 2
+	leafHeaderSize   = 1 + 2 + 8 + 8
+	internalHeaders  = 1 + 2 + 8
+	cellOverhead     = 2 + 8
+	pageChecksumSize = 4
+)
+
+// OpenDiskTree loads the tree stored in file, or creates an empty one if the
+// file is empty. A tree which was not flushed after its last change, or whose
+// page 0 is corrupted, is returned failed: Err reports it, and Clear empties
+// it to be rebuilt.
+func OpenDiskTree(file PageFile, options DiskOptions) (*DiskTree, error) {
+	if options.PageSize == 0 {
+		options.PageSize = DefaultPageSize
+	}
+	if options.CachePages == 0 {
+		options.CachePages = DefaultCachePages
+	}
+	if options.PageSize < MinPageSize || options.PageSize > MaxPageSize {
+		return nil, ErrPageSize
+	}
+	if options.CachePages < minCachePages {
+		options.CachePages = minCachePages
+	}
+
+	t := &DiskTree{
+		file:  file,
+		cache: newPageCache(options.CachePages),
+	}
+
+	var meta [metaSize]byte
+	n, err := file.ReadAt(meta[:], 0)
+	if n == 0 && err == io.EOF {
+		return t, t.create(options.PageSize)
+	}
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if n < metaSize {
+		return nil, ErrInvalidDiskTree
+	}
+
+	return t, t.readMeta(meta[:])
+}
+
+func (t *DiskTree) create(pageSize int) error {
+	t.pageSize = pageSize
+	t.reset()
+
+	// Mark the new file dirty before writing its first pages
+	t.clean = true
+	return t.Flush()
+}
+
+// reset empties the tree, in memory only.
+func (t *DiskTree) reset() {
+	t.cache = newPageCache(t.cache.capacity)
+	t.pages, t.length, t.meta, t.err = 1, 0, nil, nil
+	t.root = t.allocate(true).id
+}
+
+// readMeta reads the tree from page 0, given its first bytes. Only a file
+// which is not a tree, or of another version, fails opening it.
+func (t *DiskTree) readMeta(meta []byte) error {
+	if !bytes.Equal(meta[:4], diskMagic[:]) {
+		return ErrInvalidDiskTree
+	}
+	if binary.LittleEndian.Uint32(meta[4:]) != diskVersion {
+		return ErrDiskTreeVersion
+	}
+
+	t.pageSize = int(binary.LittleEndian.Uint32(meta[8:]))
+	if t.pageSize < MinPageSize || t.pageSize > MaxPageSize {
+		return ErrInvalidDiskTree
+	}
+
+	page, err := t.readPage(0)
+	if err == ErrPageChecksum || err == io.ErrUnexpectedEOF {
+		t.err = err
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	t.root = binary.LittleEndian.Uint64(page[12:])
+	t.pages = binary.LittleEndian.Uint64(page[20:])
+	t.length = int(binary.LittleEndian.Uint64(page[28:]))
+	t.clean = page[36] == cleanState
+	if !t.clean {
+		t.err = ErrDiskTreeDirty
+	}
+
+	size := int(binary.LittleEndian.Uint16(page[37:]))
+	if metaSize+size > len(page)-pageChecksumSize {
+		return ErrInvalidDiskTree
+	}
+	if size > 0 {
+		t.meta = append([]byte(nil), page[metaSize:metaSize+size]...)
+	}
+
+	return nil
+}
+
+func (t *DiskTree) writeMeta(state byte) error {
+	page := make([]byte, t.pageSize)
+	copy(page, diskMagic[:])
+	binary.LittleEndian.PutUint32(page[4:], diskVersion)
+	binary.LittleEndian.PutUint32(page[8:], uint32(t.pageSize))
+	binary.LittleEndian.PutUint64(page[12:], t.root)
+	binary.LittleEndian.PutUint64(page[20:], t.pages)
+	binary.LittleEndian.PutUint64(page[28:], uint64(t.length))
+	page[36] = state
+	binary.LittleEndian.PutUint16(page[37:], uint16(len(t.meta)))
+	copy(page[metaSize:], t.meta)
+
+	return t.writePage(0, page)
+}
+
+// markDirty records in the file that its pages are about to change, before
+// the first page write following a Flush.
+func (t *DiskTree) markDirty() error {
+	if !t.clean {
+		return nil
+	}
+
+	err := t.writeMeta(dirtyState)
+	if err != nil {
+		return err
+	}
+	err = t.file.Sync()
+	if err != nil {
+		return err
+	}
+
+	t.clean = false
+	return nil
+}
+
+// Len returns the number of entries in the tree.
+func (t *DiskTree) Len() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.length
+}
+
+// MaxKeySize is the largest key the tree accepts. Pages must hold at least
+// four entries so that splitting one always leaves two valid pages.
+func (t *DiskTree) MaxKeySize() int {
+	size := (t.pageSize-pageChecksumSize-leafHeaderSize)/4 - cellOverhead
+	if size > 0xffff {
+		return 0xffff
+	}
+	return size
+}
+
+// Err returns the error which failed the tree, if any.
+func (t *DiskTree) Err() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.err
+}
+
+func (t *DiskTree) fail(err error) {
+	if t.err == nil {
+		t.err = err
+	}
+}
+
+// Meta returns the bytes stored along with the tree by the last Flush, or set
+// since with SetMeta.
+func (t *DiskTree) Meta() []byte {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return append([]byte(nil), t.meta...)
+}
+
+// SetMeta sets the bytes stored along with the tree by the next Flush. They
+// must fit in page 0.
+func (t *DiskTree) SetMeta(meta []byte) error {
+	if metaSize+len(meta) > t.pageSize-pageChecksumSize {
+		return ErrMetaTooLarge
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.meta = append([]byte(nil), meta...)
+	return nil
+}
+
+// Clear empties the tree, and clears the error which failed it. The pages
+// already written are overwritten as the tree grows back, and the file is
+// only consistent again once flushed.
+func (t *DiskTree) Clear() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.reset()
+}
+
+// Flush writes every modified page, then marks the file clean along with the
+// tree metadata, syncing it in between so that a clean file only refers to
+// written pages.
+func (t *DiskTree) Flush() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.err != nil {
+		return t.err
+	}
+
+	for e := t.cache.lru.Front(); e != nil; e = e.Next() {
+		n := e.Value.(*diskNode)
+		if n.dirty {
+			err := t.writeNode(n)
+			if err != nil {
+				t.fail(err)
+				return err
+			}
+		}
+	}
+
+	err := t.file.Sync()
+	if err == nil {
+		err = t.writeMeta(cleanState)
+	}
+	if err == nil {
+		err = t.file.Sync()
+	}
+	if err != nil {
+		t.fail(err)
+		return err
+	}
+
+	t.clean = true
+	return nil
+}
+
+// Search returns the value of key.
+func (t *DiskTree) Search(key []byte) (bool, int64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	n, err := t.leafFor(key)
+	if err != nil {
+		t.fail(err)
+		return false, 0
+	}
+
+	i := lowerBoundKeys(n.keys, key)
+	if i < len(n.keys) && bytes.Equal(n.keys[i], key) {
+		return true, n.values[i]
+	}
+	return false, 0
+}
+
+// Ceiling returns the entry with the smallest key greater than or equal to
+// key, like Tree.Ceiling.
+func (t *DiskTree) Ceiling(key []byte) (bool, []byte, int64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	c := &DiskCursor{tree: t}
+	if !c.seek(key) {
+		return false, nil, 0
+	}
+	return true, c.leaf.keys[c.index], c.leaf.values[c.index]
+}
+
+// Floor returns the entry with the greatest key less than or equal to key,
+// like Tree.Floor.
+func (t *DiskTree) Floor(key []byte) (bool, []byte, int64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	c := &DiskCursor{tree: t}
+	found := c.seek(key)
+	if found && !bytes.Equal(c.leaf.keys[c.index], key) {
+		found = c.prev()
+	} else if !found && c.err == nil {
+		// Every key is less than key
+		found = c.last()
+	}
+
+	if !found {
+		return false, nil, 0
+	}
+	return true, c.leaf.keys[c.index], c.leaf.values[c.index]
+}
+
+// Replace sets the value of key, inserting it when it is not in the tree yet.
+// It reports whether an existing entry was overwritten and its old value. A
+// key larger than MaxKeySize fails the tree with ErrKeyTooLarge.
+func (t *DiskTree) Replace(key []byte, value int64) (bool, int64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	replaced, old, err := t.replace(key, value)
+	if err != nil {
+		t.fail(err)
+	}
+	return replaced, old
+}
+
+func (t *DiskTree) replace(key []byte, value int64) (bool, int64, error) {
+	if t.err != nil {
+		return false, 0, t.err
+	}
+	if len(key) > t.MaxKeySize() {
+		return false, 0, ErrKeyTooLarge
+	}
+
+	var path []*diskNode
+	var indexes []int
+
+	n, err := t.node(t.root)
+	for err == nil && !n.leaf {
+		i := upperBoundKeys(n.keys, key)
+		path = append(path, n)
+		indexes = append(indexes, i)
+		n, err = t.node(n.children[i])
+	}
+	if err != nil {
+		return false, 0, err
+	}
+
+	i := lowerBoundKeys(n.keys, key)
+	if i < len(n.keys) && bytes.Equal(n.keys[i], key) {
+		old := n.values[i]
+		n.values[i] = value
+		t.touch(n)
+		return true, old, nil
+	}
+
+	n.keys = insertKeyAt(n.keys, i, append([]byte(nil), key...))
+	n.values = append(n.values, 0)
+	copy(n.values[i+1:], n.values[i:])
+	n.values[i] = value
+	t.length++
+	t.touch(n)
+
+	for n.size() > t.pageSize-pageChecksumSize {
+		separator, right, err := t.split(n)
+		if err != nil {
+			return false, 0, err
+		}
+
+		if len(path) == 0 {
+			root := t.allocate(false)
+			root.keys = [][]byte{separator}
+			root.children = []uint64{n.id, right.id}
+			t.root = root.id
+			break
+		}
+
+		parent, at := path[len(path)-1], indexes[len(indexes)-1]
+		path, indexes = path[:len(path)-1], indexes[:len(indexes)-1]
+
+		parent.keys = insertKeyAt(parent.keys, at, separator)
+		parent.children = append(parent.children, 0)
+		copy(parent.children[at+2:], parent.children[at+1:])
+		parent.children[at+1] = right.id
+		t.touch(parent)
+
+		n = parent
+	}
+
+	return false, 0, t.err
+}
+
+// Delete removes key and reports whether it was in the tree and its value.
+// Pages are not merged: a leaf left empty stays linked to its siblings, and
+// is filled again by the keys inserted in its range.
+func (t *DiskTree) Delete(key []byte) (bool, int64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	n, err := t.leafFor(key)
+	if err != nil {
+		t.fail(err)
+		return false, 0
+	}
+
+	i := lowerBoundKeys(n.keys, key)
+	if i == len(n.keys) || !bytes.Equal(n.keys[i], key) {
+		return false, 0
+	}
+
+	value := n.values[i]
+	n.keys = append(n.keys[:i], n.keys[i+1:]...)
+	n.values = append(n.values[:i], n.values[i+1:]...)
+	t.length--
+	t.touch(n)
+
+	return true, value
+}
+
+// split moves the upper half of n, by size, into a new page. It returns the
+// key separating both pages in their parent.
+func (t *DiskTree) split(n *diskNode) ([]byte, *diskNode, error) {
+	half := n.size() / 2
+	m, size := 0, 0
+	for m < len(n.keys)-1 && size < half {
+		size += cellOverhead + len(n.keys[m])
+		m++
+	}
+
+	right := t.allocate(n.leaf)
+	var separator []byte
+
+	if n.leaf {
+		right.keys = append(right.keys, n.keys[m:]...)
+		right.values = append(right.values, n.values[m:]...)
+		n.keys, n.values = n.keys[:m], n.values[:m]
+		separator = right.keys[0]
+
+		right.prev, right.next = n.id, n.next
+		if n.next != 0 {
+			next, err := t.node(n.next)
+			if err != nil {
+				return nil, nil, err
+			}
+			next.prev = right.id
+			t.touch(next)
+		}
+		n.next = right.id
+	} else {
+		if m == len(n.keys)-1 {
+			m--
+		}
+		separator = n.keys[m]
+		right.keys = append(right.keys, n.keys[m+1:]...)
+		right.children = append(right.children, n.children[m+1:]...)
+		n.keys, n.children = n.keys[:m], n.children[:m+1]
+	}
+
+	t.touch(n)
+	return separator, right, nil
+}
+
+// leafFor returns the leaf where key is, or would be inserted.
+func (t *DiskTree) leafFor(key []byte) (*diskNode, error) {
+	n, err := t.node(t.root)
+	for err == nil && !n.leaf {
+		n, err = t.node(n.children[upperBoundKeys(n.keys, key)])
+	}
+	return n, err
+}
+
+// Walk calls fn in key order for every entry, holding the tree lock: fn must
+// not use the tree.
+func (t *DiskTree) Walk(fn WalkerFunc) {
+	t.WalkRange(nil, nil, func(key []byte, value int64) bool {
+		fn(key, value)
+		return true
+	})
+}
+
+// WalkRange calls fn in key order for every key in [from, to). A nil from
+// starts at the smallest key and a nil to runs to the greatest one. Like
+// Walk, fn must not use the tree.
+func (t *DiskTree) WalkRange(from, to []byte, fn RangeFunc) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	c := t.Cursor()
+
+	var ok bool
+	if from == nil {
+		ok = c.first()
+	} else {
+		ok = c.seek(from)
+	}
+
+	for ; ok; ok = c.next() {
+		if to != nil && bytes.Compare(c.leaf.keys[c.index], to) >= 0 {
+			break
+		}
+		if !fn(c.leaf.keys[c.index], c.leaf.values[c.index]) {
+			break
+		}
+	}
+}
+
+func (t *DiskTree) allocate(leaf bool) *diskNode {
+	n := &diskNode{
+		id:   t.pages,
+		leaf: leaf,
+	}
+	t.pages++
+	t.touch(n)
+	return n
+}
+
+// node returns the page id, from the cache when possible. Nothing is read
+// once the tree failed.
+func (t *DiskTree) node(id uint64) (*diskNode, error) {
+	if t.err != nil {
+		return nil, t.err
+	}
+	if n := t.cache.get(id); n != nil {
+		return n, nil
+	}
+
+	page, err := t.readPage(id)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := decodeNode(id, page)
+	if err != nil {
+		return nil, err
+	}
+
+	return n, t.cache.put(n, t.writeNode)
+}
+
+// touch marks n as modified, making sure it is cached until written. Failing
+// to write the pages it evicts fails the tree.
+func (t *DiskTree) touch(n *diskNode) {
+	n.dirty = true
+	if t.cache.get(n.id) == nil {
+		err := t.cache.put(n, t.writeNode)
+		if err != nil {
+			t.fail(err)
+		}
+	}
+}
+
+func (t *DiskTree) writeNode(n *diskNode) error {
+	err := t.markDirty()
+	if err != nil {
+		return err
+	}
+
+	page := make([]byte, t.pageSize)
+	n.encode(page)
+
+	err = t.writePage(n.id, page)
+	if err != nil {
+		return err
+	}
+	n.dirty = false
+	return nil
+}
+
+func (t *DiskTree) readPage(id uint64) ([]byte, error) {
+	page := make([]byte, t.pageSize)
+	_, err := t.file.ReadAt(page, int64(id)*int64(t.pageSize))
+	if err != nil {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	end := len(page) - pageChecksumSize
+	if crc32.Checksum(page[:end], castagnoli) != binary.LittleEndian.Uint32(page[end:]) {
+		return nil, ErrPageChecksum
+	}
+
+	return page, nil
+}
+
+func (t *DiskTree) writePage(id uint64, page []byte) error {
+	end := len(page) - pageChecksumSize
+	binary.LittleEndian.PutUint32(page[end:], crc32.Checksum(page[:end], castagnoli))
+
+	_, err := t.file.WriteAt(page, int64(id)*int64(t.pageSize))
+	return err
+}
+
+type diskNode struct {
+	id       uint64
+	leaf     bool
+	keys     [][]byte
+	values   []int64
+	children []uint64
+	// leaf siblings, 0 when there is none as page 0 holds the metadata
+	prev, next uint64
+	dirty      bool
+}
+
+func (n *diskNode) size() int {
+	size := internalHeaders
+	if n.leaf {
+		size = leafHeaderSize
+	}
+	for _, key := range n.keys {
+		size += cellOverhead + len(key)
+	}
+	return size
+}
+
+func (n *diskNode) encode(page []byte) {
+	binary.LittleEndian.PutUint16(page[1:], uint16(len(n.keys)))
+
+	var at int
+	if n.leaf {
+		page[0] = leafPage
+		binary.LittleEndian.PutUint64(page[3:], n.prev)
+		binary.LittleEndian.PutUint64(page[11:], n.next)
+		at = leafHeaderSize
+	} else {
+		page[0] = internalPage
+		binary.LittleEndian.PutUint64(page[3:], n.children[0])
+		at = internalHeaders
+	}
+
+	for i, key := range n.keys {
+		binary.LittleEndian.PutUint16(page[at:], uint16(len(key)))
+		at += 2
+		at += copy(page[at:], key)
+		if n.leaf {
+			binary.LittleEndian.PutUint64(page[at:], uint64(n.values[i]))
+		} else {
+			binary.LittleEndian.PutUint64(page[at:], n.children[i+1])
+		}
+		at += 8
+	}
+}
+
+func decodeNode(id uint64, page []byte) (*diskNode, error) {
+	n := &diskNode{id: id}
+	count := int(binary.LittleEndian.Uint16(page[1:]))
+	end := len(page) - pageChecksumSize
+
+	var at int
+	switch page[0] {
+	case leafPage:
+		n.leaf = true
+		n.prev = binary.LittleEndian.Uint64(page[3:])
+		n.next = binary.LittleEndian.Uint64(page[11:])
+		n.values = make([]int64, 0, count)
+		at = leafHeaderSize
+	case internalPage:
+		n.children = make([]uint64, 0, count+1)
+		n.children = append(n.children, binary.LittleEndian.Uint64(page[3:]))
+		at = internalHeaders
+	default:
+		return nil, ErrInvalidDiskTree
+	}
+
+	n.keys = make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		if at+2 > end {
+			return nil, ErrInvalidDiskTree
+		}
+		keyLen := int(binary.LittleEndian.Uint16(page[at:]))
+		at += 2
+		if at+keyLen+8 > end {
+			return nil, ErrInvalidDiskTree
+		}
+
+		n.keys = append(n.keys, append([]byte(nil), page[at:at+keyLen]...))
+		at += keyLen
+
+		ref := binary.LittleEndian.Uint64(page[at:])
+		if n.leaf {
+			n.values = append(n.values, int64(ref))
+		} else {
+			n.children = append(n.children, ref)
+		}
+		at += 8
+	}
+
+	return n, nil
+}
+
+// DiskCursor walks a DiskTree in key order, in both directions, following the
+// links between leaves and skipping the ones left empty by Delete. A cursor
+// is invalidated by any change made to the tree after it was positioned.
+type DiskCursor struct {
+	tree  *DiskTree
+	leaf  *diskNode
+	index int
+	err   error
+}
+
+func (t *DiskTree) Cursor() *DiskCursor {
+	return &DiskCursor{tree: t}
+}
+
+func (c *DiskCursor) Valid() bool {
+	c.tree.lock.Lock()
+	defer c.tree.lock.Unlock()
+
+	return c.valid()
+}
+
+func (c *DiskCursor) valid() bool {
+	return c.leaf != nil && c.index < len(c.leaf.keys)
+}
+
+// Err returns the error that made the cursor invalid, if any. It also failed
+// the tree.
+func (c *DiskCursor) Err() error {
+	return c.err
+}
+
+func (c *DiskCursor) Key() []byte {
+	c.tree.lock.Lock()
+	defer c.tree.lock.Unlock()
+
+	if !c.valid() {
+		return nil
+	}
+	return c.leaf.keys[c.index]
+}
+
+func (c *DiskCursor) Value() int64 {
+	c.tree.lock.Lock()
+	defer c.tree.lock.Unlock()
+
+	if !c.valid() {
+		return 0
+	}
+	return c.leaf.values[c.index]
+}
+
+// First moves to the smallest key and reports whether the tree has one.
+func (c *DiskCursor) First() bool {
+	c.tree.lock.Lock()
+	defer c.tree.lock.Unlock()
+
+	return c.first()
+}
+
+// Last moves to the greatest key and reports whether the tree has one.
+func (c *DiskCursor) Last() bool {
+	c.tree.lock.Lock()
+	defer c.tree.lock.Unlock()
+
+	return c.last()
+}
+
+// Seek moves to the first key greater than or equal to key and reports
+// whether there is one.
+func (c *DiskCursor) Seek(key []byte) bool {
+	c.tree.lock.Lock()
+	defer c.tree.lock.Unlock()
+
+	return c.seek(key)
+}
+
+func (c *DiskCursor) Next() bool {
+	c.tree.lock.Lock()
+	defer c.tree.lock.Unlock()
+
+	return c.next()
+}
+
+func (c *DiskCursor) Prev() bool {
+	c.tree.lock.Lock()
+	defer c.tree.lock.Unlock()
+
+	return c.prev()
+}
+
+// The cursor moves below run with the tree lock held.
+
+func (c *DiskCursor) first() bool {
+	n, err := c.tree.node(c.tree.root)
+	for err == nil && !n.leaf {
+		n, err = c.tree.node(n.children[0])
+	}
+	if err != nil {
+		return c.fail(err)
+	}
+
+	if len(n.keys) == 0 {
+		return c.nextLeaf(n)
+	}
+	return c.moveTo(n, 0)
+}
+
+func (c *DiskCursor) last() bool {
+	n, err := c.tree.node(c.tree.root)
+	for err == nil && !n.leaf {
+		n, err = c.tree.node(n.children[len(n.children)-1])
+	}
+	if err != nil {
+		return c.fail(err)
+	}
+
+	if len(n.keys) == 0 {
+		return c.prevLeaf(n)
+	}
+	return c.moveTo(n, len(n.keys)-1)
+}
+
+func (c *DiskCursor) seek(key []byte) bool {
+	n, err := c.tree.leafFor(key)
+	if err != nil {
+		return c.fail(err)
+	}
+
+	i := lowerBoundKeys(n.keys, key)
+	if i < len(n.keys) {
+		return c.moveTo(n, i)
+	}
+	return c.nextLeaf(n)
+}
+
+func (c *DiskCursor) next() bool {
+	if !c.valid() {
+		return false
+	}
+	if c.index+1 < len(c.leaf.keys) {
+		c.index++
+		return true
+	}
+	return c.nextLeaf(c.leaf)
+}
+
+func (c *DiskCursor) prev() bool {
+	if !c.valid() {
+		return false
+	}
+	if c.index > 0 {
+		c.index--
+		return true
+	}
+	return c.prevLeaf(c.leaf)
+}
+
+// nextLeaf moves to the first key of the first leaf after n holding one.
+func (c *DiskCursor) nextLeaf(n *diskNode) bool {
+	for n.next != 0 {
+		var err error
+		n, err = c.tree.node(n.next)
+		if err != nil {
+			return c.fail(err)
+		}
+		if len(n.keys) > 0 {
+			return c.moveTo(n, 0)
+		}
+	}
+	return c.moveTo(nil, 0)
+}
+
+// prevLeaf moves to the last key of the first leaf before n holding one.
+func (c *DiskCursor) prevLeaf(n *diskNode) bool {
+	for n.prev != 0 {
+		var err error
+		n, err = c.tree.node(n.prev)
+		if err != nil {
+			return c.fail(err)
+		}
+		if len(n.keys) > 0 {
+			return c.moveTo(n, len(n.keys)-1)
+		}
+	}
+	return c.moveTo(nil, 0)
+}
+
+// moveTo positions the cursor at index in leaf, a nil leaf invalidating it.
+func (c *DiskCursor) moveTo(leaf *diskNode, index int) bool {
+	c.leaf, c.index, c.err = leaf, index, nil
+	return leaf != nil
+}
+
+// fail invalidates the cursor, and the tree, with err.
+func (c *DiskCursor) fail(err error) bool {
+	c.tree.fail(err)
+	c.leaf, c.index, c.err = nil, 0, err
+	return false
+}
+
+func lowerBoundKeys(keys [][]byte, key []byte) int {
+	return sort.Search(len(keys), func(i int) bool {
+		return bytes.Compare(keys[i], key) >= 0
+	})
+}
+
+func upperBoundKeys(keys [][]byte, key []byte) int {
+	return sort.Search(len(keys), func(i int) bool {
+		return bytes.Compare(keys[i], key) > 0
+	})
+}
+
+func insertKeyAt(keys [][]byte, i int, key []byte) [][]byte {
+	keys = append(keys, nil)
+	copy(keys[i+1:], keys[i:])
+	keys[i] = key
+	return keys
+}
+
+// pageCache keeps the most recently used pages in memory.
+type pageCache struct {
+	capacity int
+	pages    map[uint64]*list.Element
+	lru      *list.List
+}
+
+func newPageCache(capacity int) *pageCache {
+	return &pageCache{
+		capacity: capacity,
+		pages:    make(map[uint64]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+func (c *pageCache) get(id uint64) *diskNode {
+	e, ok := c.pages[id]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*diskNode)
+}
+
+// put caches n, evicting the least recently used pages over capacity. Dirty
+// pages are passed to write before being dropped.
+func (c *pageCache) put(n *diskNode, write func(*diskNode) error) error {
+	c.pages[n.id] = c.lru.PushFront(n)
+
+	for c.lru.Len() > c.capacity {
+		e := c.lru.Back()
+		evicted := e.Value.(*diskNode)
+		if evicted.dirty {
+			err := write(evicted)
+			if err != nil {
+				return err
+			}
+		}
+		c.lru.Remove(e)
+		delete(c.pages, evicted.id)
+	}
+
+	return nil
+}
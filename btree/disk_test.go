@@ -0,0 +1,359 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestDiskTree(t *testing.T) {
+	tree, teardown := GenerateDiskTree(t, DiskOptions{PageSize: MinPageSize, CachePages: 8})
+	defer teardown()
+
+	count := 5000
+	random := rand.New(rand.NewSource(42))
+	for _, i := range random.Perm(count) {
+		replaced, _ := tree.Replace([]byte(fmt.Sprintf("key%05d", i)), int64(i))
+		if replaced {
+			t.Errorf("Expected inserting new key %d to not replace anything", i)
+		}
+	}
+
+	if tree.Err() != nil {
+		t.Fatal(tree.Err())
+	}
+	if tree.Len() != count {
+		t.Errorf("Expected disk tree length to be %d but got %d", count, tree.Len())
+	}
+
+	for i := 0; i < count; i++ {
+		key := []byte(fmt.Sprintf("key%05d", i))
+		ok, value := tree.Search(key)
+		if !ok || value != int64(i) {
+			t.Fatalf("Expected to find value %v for key %s but found %v (%v)", i, key, value, tree.Err())
+		}
+	}
+
+	ok, _ := tree.Search([]byte("missing"))
+	if ok {
+		t.Errorf("Expected to NOT find key %s", "missing")
+	}
+
+	replaced, old := tree.Replace([]byte("key00042"), -42)
+	if !replaced || old != 42 {
+		t.Errorf("Expected rewriting key %s to replace value %v but got %v, %v", "key00042", 42, replaced, old)
+	}
+
+	var walked []int64
+	tree.Walk(func(_ []byte, value int64) {
+		walked = append(walked, value)
+	})
+	if len(walked) != count || walked[0] != 0 || walked[42] != -42 || walked[count-1] != int64(count-1) {
+		t.Errorf("Expected disk tree to be walked in key order")
+	}
+}
+
+func TestDiskTreeCursor(t *testing.T) {
+	tree, teardown := GenerateDiskTree(t, DiskOptions{PageSize: MinPageSize, CachePages: 8})
+	defer teardown()
+
+	cursor := tree.Cursor()
+	if cursor.First() || cursor.Last() || cursor.Seek([]byte("key")) {
+		t.Errorf("Expected cursor over an empty disk tree to be invalid")
+	}
+
+	for i := 0; i < 1000; i += 2 {
+		tree.Replace([]byte(fmt.Sprintf("key%04d", i)), int64(i))
+	}
+
+	i := 998
+	for ok := cursor.Last(); ok; ok = cursor.Prev() {
+		if cursor.Value() != int64(i) {
+			t.Fatalf("Expected cursor to yield value %v but got %v", i, cursor.Value())
+		}
+		i -= 2
+	}
+	if i != -2 || cursor.Err() != nil {
+		t.Errorf("Expected cursor to walk every key backward, stopped at %d (%v)", i, cursor.Err())
+	}
+
+	tt := []struct {
+		Seek  string
+		Found bool
+		Key   string
+	}{
+		{"a", true, "key0000"},
+		{"key0421", true, "key0422"},
+		{"key0422", true, "key0422"},
+		{"key0998", true, "key0998"},
+		{"key0999", false, ""},
+	}
+	for _, example := range tt {
+		ok := cursor.Seek([]byte(example.Seek))
+		if ok != example.Found || bytes.Compare(cursor.Key(), []byte(example.Key)) != 0 {
+			t.Errorf("Expected seeking %s to land on %q but got %q", example.Seek, example.Key, cursor.Key())
+		}
+	}
+
+	nearest := []struct {
+		Key     string
+		Ceiling string
+		Floor   string
+	}{
+		{"a", "key0000", ""},
+		{"key0421", "key0422", "key0420"},
+		{"key0422", "key0422", "key0422"},
+		{"key0999", "", "key0998"},
+	}
+	for _, example := range nearest {
+		_, ceiling, _ := tree.Ceiling([]byte(example.Key))
+		_, floor, _ := tree.Floor([]byte(example.Key))
+		if string(ceiling) != example.Ceiling || string(floor) != example.Floor {
+			t.Errorf("Expected the keys around %s to be %q and %q but got %q and %q", example.Key, example.Floor, example.Ceiling, floor, ceiling)
+		}
+	}
+
+	var values []int64
+	tree.WalkRange([]byte("key0100"), []byte("key0107"), func(_ []byte, value int64) bool {
+		values = append(values, value)
+		return true
+	})
+	if !reflect.DeepEqual(values, []int64{100, 102, 104, 106}) {
+		t.Errorf("Expected range walk to yield %v but got %v", []int64{100, 102, 104, 106}, values)
+	}
+}
+
+func TestDiskTreeReopen(t *testing.T) {
+	file, err := ioutil.TempFile("", "index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	tree, err := OpenDiskTree(file, DiskOptions{PageSize: 512})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		tree.Replace([]byte(fmt.Sprintf("key%04d", i)), int64(i))
+	}
+	err = tree.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The page size is read back from the file
+	reopened, err := OpenDiskTree(file, DiskOptions{CachePages: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.Len() != 1000 {
+		t.Errorf("Expected reopened disk tree length to be %d but got %d", 1000, reopened.Len())
+	}
+	ok, value := reopened.Search([]byte("key0777"))
+	if !ok || value != 777 {
+		t.Errorf("Expected to find value %v for key %s but found %v (%v)", 777, "key0777", value, reopened.Err())
+	}
+
+	_, err = file.WriteAt([]byte{0xff}, 512+100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened, err = OpenDiskTree(file, DiskOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened.Walk(func(_ []byte, _ int64) {})
+	if reopened.Err() != ErrPageChecksum {
+		t.Errorf("Expected reading a corrupted page to fail with %v but got %v", ErrPageChecksum, reopened.Err())
+	}
+	if ok, _ := reopened.Search([]byte("key0000")); ok {
+		t.Errorf("Expected a failed disk tree to find nothing")
+	}
+
+	reopened.Clear()
+	reopened.Replace([]byte("key"), 1)
+	if reopened.Err() != nil || reopened.Len() != 1 {
+		t.Errorf("Expected clearing a failed disk tree to make it usable again (%v)", reopened.Err())
+	}
+}
+
+func TestDiskTreeKeyTooLarge(t *testing.T) {
+	tree, teardown := GenerateDiskTree(t, DiskOptions{PageSize: MinPageSize})
+	defer teardown()
+
+	for i := 0; i < 20; i++ {
+		key := bytes.Repeat([]byte{byte('a' + i)}, tree.MaxKeySize())
+		tree.Replace(key, int64(i))
+	}
+	if tree.Err() != nil || tree.Len() != 20 {
+		t.Errorf("Expected keys of the maximum size to be accepted (%v)", tree.Err())
+	}
+
+	tree.Replace(make([]byte, tree.MaxKeySize()+1), 1)
+	if tree.Err() != ErrKeyTooLarge {
+		t.Errorf("Expected oversized key to fail with %v but got %v", ErrKeyTooLarge, tree.Err())
+	}
+}
+
+func TestDiskTreeDelete(t *testing.T) {
+	tree, teardown := GenerateDiskTree(t, DiskOptions{PageSize: MinPageSize, CachePages: 8})
+	defer teardown()
+
+	for i := 0; i < 1000; i++ {
+		tree.Replace([]byte(fmt.Sprintf("key%04d", i)), int64(i))
+	}
+
+	// Empty whole leaves in the middle and at both ends of the tree
+	for i := 0; i < 1000; i++ {
+		if i < 100 || (i >= 400 && i < 600) || i >= 900 {
+			deleted, value := tree.Delete([]byte(fmt.Sprintf("key%04d", i)))
+			if !deleted || value != int64(i) {
+				t.Fatalf("Expected deleting key %d to remove value %v but got %v, %v", i, i, deleted, value)
+			}
+		}
+	}
+	if deleted, _ := tree.Delete([]byte("key0000")); deleted {
+		t.Errorf("Expected deleting a missing key to delete nothing")
+	}
+	if tree.Err() != nil || tree.Len() != 600 {
+		t.Errorf("Expected disk tree length to be %d but got %d (%v)", 600, tree.Len(), tree.Err())
+	}
+	if ok, _ := tree.Search([]byte("key0500")); ok {
+		t.Errorf("Expected to NOT find deleted key %s", "key0500")
+	}
+
+	var forward []int64
+	tree.Walk(func(_ []byte, value int64) {
+		forward = append(forward, value)
+	})
+	if len(forward) != 600 || forward[0] != 100 || forward[299] != 399 || forward[300] != 600 || forward[599] != 899 {
+		t.Errorf("Expected walk to skip deleted keys, got %d values", len(forward))
+	}
+
+	cursor := tree.Cursor()
+	count := 0
+	for ok := cursor.Last(); ok; ok = cursor.Prev() {
+		count++
+	}
+	if count != 600 {
+		t.Errorf("Expected cursor to walk %d keys backward but got %d", 600, count)
+	}
+	if !cursor.Seek([]byte("key0400")) || cursor.Value() != 600 {
+		t.Errorf("Expected seeking a deleted range to land after it, got %v", cursor.Value())
+	}
+
+	tree.Replace([]byte("key0500"), 500)
+	if ok, value := tree.Search([]byte("key0500")); !ok || value != 500 {
+		t.Errorf("Expected to insert back deleted key %s", "key0500")
+	}
+}
+
+func TestDiskTreeDirty(t *testing.T) {
+	file, err := ioutil.TempFile("", "index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	tree, err := OpenDiskTree(file, DiskOptions{PageSize: MinPageSize, CachePages: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		tree.Replace([]byte(fmt.Sprintf("key%04d", i)), int64(i))
+	}
+	tree.SetMeta([]byte("covered"))
+	err = tree.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Changes kept in the cache are lost, the flushed tree is read back
+	tree.Replace([]byte("key0000"), -1)
+	reopened, err := OpenDiskTree(file, DiskOptions{})
+	if err != nil || reopened.Err() != nil {
+		t.Fatalf("Expected a flushed disk tree to open but got %v, %v", err, reopened.Err())
+	}
+	if ok, value := reopened.Search([]byte("key0000")); !ok || value != 0 || reopened.Len() != 100 {
+		t.Errorf("Expected reopened disk tree to be the flushed one")
+	}
+	if string(reopened.Meta()) != "covered" {
+		t.Errorf("Expected disk tree meta to be %q but got %q", "covered", reopened.Meta())
+	}
+
+	// Evicted pages are written in place, making the file dirty until flushed
+	for i := 100; i < 1000; i++ {
+		tree.Replace([]byte(fmt.Sprintf("key%04d", i)), int64(i))
+	}
+	reopened, err = OpenDiskTree(file, DiskOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.Err() != ErrDiskTreeDirty {
+		t.Errorf("Expected opening a disk tree changed since its flush to fail with %v but got %v", ErrDiskTreeDirty, reopened.Err())
+	}
+	if err := reopened.Flush(); err != ErrDiskTreeDirty {
+		t.Errorf("Expected flushing a dirty disk tree to fail with %v but got %v", ErrDiskTreeDirty, err)
+	}
+
+	err = tree.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened, err = OpenDiskTree(file, DiskOptions{})
+	if err != nil || reopened.Err() != nil || reopened.Len() != 1000 {
+		t.Errorf("Expected a flushed disk tree to open with %d keys but got %d (%v, %v)", 1000, reopened.Len(), err, reopened.Err())
+	}
+}
+
+func TestDiskTreeConcurrency(t *testing.T) {
+	tree, teardown := GenerateDiskTree(t, DiskOptions{PageSize: MinPageSize, CachePages: 8})
+	defer teardown()
+
+	var wg sync.WaitGroup
+	for reader := 0; reader < 4; reader++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				tree.Search([]byte(fmt.Sprintf("key%04d", i)))
+			}
+		}()
+	}
+	for i := 0; i < 1000; i++ {
+		tree.Replace([]byte(fmt.Sprintf("key%04d", i)), int64(i))
+	}
+	wg.Wait()
+
+	if tree.Err() != nil || tree.Len() != 1000 {
+		t.Errorf("Expected disk tree length to be %d but got %d (%v)", 1000, tree.Len(), tree.Err())
+	}
+}
+
+func GenerateDiskTree(t *testing.T, options DiskOptions) (*DiskTree, func()) {
+	file, err := ioutil.TempFile("", "index")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	teardown := func() {
+		file.Close()
+		os.Remove(file.Name())
+	}
+
+	tree, err := OpenDiskTree(file, options)
+	if err != nil {
+		teardown()
+		t.Fatal(err)
+	}
+
+	return tree, teardown
+}
@@ -0,0 +1,191 @@
+package btree
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// Index file format:
+//
+//   magic - version - degree - count - size | key-size - key - value | ... | crc32c
+//
+// Entries are written in key order, size is the number of bytes they take.
+// The trailing CRC32C covers every byte before it.
+
+var indexMagic = [4]byte{'J', 'B', 'T', 'I'}
+
+const indexVersion = uint32(2)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	ErrInvalidIndex   = errors.New("btree: not an index file")
+	ErrIndexVersion   = errors.New("btree: unsupported index file version")
+	ErrIndexChecksum  = errors.New("btree: index file checksum mismatch")
+	ErrIndexTruncated = errors.New("btree: index file is truncated")
+)
+
+// WriteTo serializes the tree to w. It implements io.WriterTo.
+func (tree *Tree) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	hw := &hashWriter{w: cw, h: crc32.New(castagnoli)}
+	bw := bufio.NewWriter(hw)
+
+	var err error
+	write := func(v interface{}) {
+		if err == nil {
+			err = binary.Write(bw, binary.LittleEndian, v)
+		}
+	}
+
+	write(indexMagic)
+	write(indexVersion)
+	write(uint32(tree.degree))
+	write(int64(tree.Len()))
+
+	var size int64
+	tree.Walk(func(key []byte, value int64) {
+		size += 8 + int64(len(key)) + 8
+	})
+	write(size)
+
+	tree.Walk(func(key []byte, value int64) {
+		write(int64(len(key)))
+		write(key)
+		write(value)
+	})
+	if err != nil {
+		return cw.n, err
+	}
+
+	err = bw.Flush()
+	if err != nil {
+		return cw.n, err
+	}
+
+	err = binary.Write(cw, binary.LittleEndian, hw.h.Sum32())
+	return cw.n, err
+}
+
+// Load reads a tree serialized with WriteTo. It reads no further than the
+// tree, so that whatever follows it can be read from r afterwards.
+func Load(r io.Reader) (*Tree, error) {
+	h := crc32.New(castagnoli)
+	hr := io.TeeReader(r, h)
+
+	var err error
+	read := func(v interface{}) {
+		if err == nil {
+			err = binary.Read(hr, binary.LittleEndian, v)
+		}
+	}
+
+	var magic [4]byte
+	var version, degree uint32
+	var count, size int64
+	read(&magic)
+	if err == nil && magic != indexMagic {
+		return nil, ErrInvalidIndex
+	}
+	read(&version)
+	if err == nil && version != indexVersion {
+		return nil, ErrIndexVersion
+	}
+	read(&degree)
+	read(&count)
+	read(&size)
+	if err != nil {
+		return nil, indexReadError(err)
+	}
+	if degree < 2 || count < 0 || size < 0 {
+		return nil, ErrInvalidIndex
+	}
+
+	// Entries and checksum are read through a buffer, bounded so that it
+	// doesn't read past the tree.
+	br := bufio.NewReader(io.LimitReader(r, size+4))
+	hr = io.TeeReader(br, h)
+
+	tree := NewWithDegree(int(degree))
+
+	// Entries are stored in key order
+	next := func() ([]byte, int64, error) {
+		if count == 0 {
+			return nil, 0, io.EOF
+		}
+		count--
+
+		var keyLen, value int64
+		read(&keyLen)
+		if err == nil && keyLen < 0 {
+			return nil, 0, ErrInvalidIndex
+		}
+
+		// Copy rather than allocate keyLen upfront: the length is not
+		// trusted until the checksum has been verified.
+		var key bytes.Buffer
+		if err == nil {
+			_, err = io.CopyN(&key, hr, keyLen)
+		}
+		read(&value)
+		if err != nil {
+			return nil, 0, indexReadError(err)
+		}
+
+		return key.Bytes(), value, nil
+	}
+
+	err = tree.build(next)
+	if err == ErrNotSorted {
+		return nil, ErrInvalidIndex
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sum := h.Sum32()
+	var expected uint32
+	err = binary.Read(br, binary.LittleEndian, &expected)
+	if err != nil {
+		return nil, indexReadError(err)
+	}
+	if sum != expected {
+		return nil, ErrIndexChecksum
+	}
+
+	return tree, nil
+}
+
+func indexReadError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrIndexTruncated
+	}
+	return err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+type hashWriter struct {
+	w io.Writer
+	h hash.Hash32
+}
+
+func (hw *hashWriter) Write(p []byte) (int, error) {
+	n, err := hw.w.Write(p)
+	hw.h.Write(p[:n])
+	return n, err
+}
@@ -0,0 +1,131 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestWriteToLoad(t *testing.T) {
+	tree := NewWithDegree(3)
+	for i := 0; i < 500; i++ {
+		tree.Insert([]byte(fmt.Sprintf("key%04d", i)), int64(i*10))
+	}
+
+	buff := bytes.NewBufferString("")
+	n, err := tree.WriteTo(buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(buff.Len()) {
+		t.Errorf("Expected WriteTo to report the written size.\nExpected: %v\nGot:      %v", buff.Len(), n)
+	}
+
+	loaded, err := Load(bytes.NewReader(buff.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if loaded.degree != tree.degree {
+		t.Errorf("Expected loaded tree to keep its degree.\nExpected: %v\nGot:      %v", tree.degree, loaded.degree)
+	}
+	if !reflect.DeepEqual(loaded.Keys(), tree.Keys()) {
+		t.Errorf("Expected loaded tree to hold the same keys")
+	}
+
+	ok, value := loaded.Search([]byte("key0042"))
+	if !ok || value != 420 {
+		t.Errorf("Expected to find value %v for key %s but found %v", 420, "key0042", value)
+	}
+}
+
+func TestLoadEmptyTree(t *testing.T) {
+	buff := bytes.NewBufferString("")
+	_, err := New().WriteTo(buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := Load(buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Keys()) != 0 {
+		t.Errorf("Expected loaded tree to be empty")
+	}
+}
+
+func TestLoadInvalidIndex(t *testing.T) {
+	tree := New()
+	tree.Insert([]byte("foo"), 1)
+	tree.Insert([]byte("bar"), 2)
+
+	buff := bytes.NewBufferString("")
+	_, err := tree.WriteTo(buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := buff.Bytes()
+
+	flipped := append([]byte(nil), valid...)
+	flipped[len(flipped)-8] ^= 0x01
+
+	badMagic := append([]byte(nil), valid...)
+	badMagic[0] = 'X'
+
+	badVersion := append([]byte(nil), valid...)
+	badVersion[4] = 0x42
+
+	tt := []struct {
+		Name     string
+		Data     []byte
+		Expected error
+	}{
+		{"flipped bit", flipped, ErrIndexChecksum},
+		{"truncated", valid[:len(valid)-3], ErrIndexTruncated},
+		{"empty", []byte{}, ErrIndexTruncated},
+		{"bad magic", badMagic, ErrInvalidIndex},
+		{"bad version", badVersion, ErrIndexVersion},
+	}
+
+	for _, example := range tt {
+		_, err := Load(bytes.NewReader(example.Data))
+		if err != example.Expected {
+			t.Errorf("Expected loading a %s index to fail with %v but got %v", example.Name, example.Expected, err)
+		}
+	}
+}
+
+func TestLoadFollowedByData(t *testing.T) {
+	tree := New()
+	for i := 0; i < 5000; i++ {
+		tree.Insert([]byte(fmt.Sprintf("key%04d", i)), int64(i))
+	}
+
+	buff := bytes.NewBufferString("")
+	_, err := tree.WriteTo(buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buff.Len() <= 4096 {
+		t.Fatalf("Expected an index larger than a read buffer but got %d bytes", buff.Len())
+	}
+	buff.WriteString("trailer")
+
+	// A plain reader: loading must not buffer past the tree
+	r := bytes.NewReader(buff.Bytes())
+	loaded, err := Load(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Len() != tree.Len() {
+		t.Errorf("Unexpected loaded tree length.\nExpected: %v\nGot:      %v", tree.Len(), loaded.Len())
+	}
+
+	rest, _ := ioutil.ReadAll(r)
+	if string(rest) != "trailer" {
+		t.Errorf("Expected to read what follows the tree.\nExpected: %q\nGot:      %q", "trailer", rest)
+	}
+}
@@ -0,0 +1,119 @@
+package btree
+
+// Min returns the entry with the smallest key.
+func (tree *Tree) Min() (bool, []byte, int64) {
+	if tree.root == nil {
+		return false, nil, 0
+	}
+
+	n := tree.root
+	for !n.isLeaf() {
+		n = n.children[0]
+	}
+	return true, n.items[0].key, n.items[0].value
+}
+
+// Max returns the entry with the greatest key.
+func (tree *Tree) Max() (bool, []byte, int64) {
+	if tree.root == nil {
+		return false, nil, 0
+	}
+
+	it := tree.root.max()
+	return true, it.key, it.value
+}
+
+// Floor returns the entry with the greatest key less than or equal to key.
+// When key is stored more than once, the last inserted entry is returned.
+func (tree *Tree) Floor(key []byte) (bool, []byte, int64) {
+	var found *item
+
+	for n := tree.root; n != nil; {
+		// Every item before i is <= key, every item from i on is > key
+		i := n.upperBound(key)
+		if i > 0 {
+			found = &n.items[i-1]
+		}
+
+		if n.isLeaf() {
+			break
+		}
+		n = n.children[i]
+	}
+
+	if found == nil {
+		return false, nil, 0
+	}
+	return true, found.key, found.value
+}
+
+// Ceiling returns the entry with the smallest key greater than or equal to
+// key. When key is stored more than once, the first inserted entry is
+// returned, like Search does.
+func (tree *Tree) Ceiling(key []byte) (bool, []byte, int64) {
+	var found *item
+
+	for n := tree.root; n != nil; {
+		// Every item before i is < key, every item from i on is >= key
+		i := n.lowerBound(key)
+		if i < len(n.items) {
+			found = &n.items[i]
+		}
+
+		if n.isLeaf() {
+			break
+		}
+		n = n.children[i]
+	}
+
+	if found == nil {
+		return false, nil, 0
+	}
+	return true, found.key, found.value
+}
+
+// Rank returns the number of entries whose key is less than key, which is the
+// position key has, or would have, in the tree.
+func (tree *Tree) Rank(key []byte) int {
+	rank := 0
+
+	for n := tree.root; n != nil; {
+		i := n.lowerBound(key)
+		rank += i
+		if n.isLeaf() {
+			break
+		}
+
+		for _, child := range n.children[:i] {
+			rank += child.count
+		}
+		n = n.children[i]
+	}
+
+	return rank
+}
+
+// Select returns the entry at position i in key order, starting from 0.
+func (tree *Tree) Select(i int) (bool, []byte, int64) {
+	if i < 0 || i >= tree.Len() {
+		return false, nil, 0
+	}
+
+	n := tree.root
+	for !n.isLeaf() {
+		j := 0
+		for ; j < len(n.items); j++ {
+			if i < n.children[j].count {
+				break
+			}
+			i -= n.children[j].count
+			if i == 0 {
+				return true, n.items[j].key, n.items[j].value
+			}
+			i--
+		}
+		n = n.children[j]
+	}
+
+	return true, n.items[i].key, n.items[i].value
+}
@@ -0,0 +1,118 @@
+package btree
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestMinMax(t *testing.T) {
+	tree := NewWithDegree(2)
+
+	ok, _, _ := tree.Min()
+	if ok {
+		t.Errorf("Expected an empty tree to have no minimum")
+	}
+	ok, _, _ = tree.Max()
+	if ok {
+		t.Errorf("Expected an empty tree to have no maximum")
+	}
+
+	for _, i := range []int{5, 3, 9, 1, 7} {
+		tree.Insert([]byte(fmt.Sprintf("key%d", i)), int64(i))
+	}
+
+	ok, key, value := tree.Min()
+	if !ok || string(key) != "key1" || value != 1 {
+		t.Errorf("Expected minimum to be %s but got %s", "key1", key)
+	}
+	ok, key, value = tree.Max()
+	if !ok || string(key) != "key9" || value != 9 {
+		t.Errorf("Expected maximum to be %s but got %s", "key9", key)
+	}
+}
+
+func TestFloorCeiling(t *testing.T) {
+	tree := NewWithDegree(2)
+	for i := 10; i < 100; i += 10 {
+		tree.Insert([]byte(fmt.Sprintf("t%03d", i)), int64(i))
+	}
+	tree.Insert([]byte("t050"), 51)
+
+	tt := []struct {
+		Key     string
+		Floor   int64
+		Ceiling int64
+	}{
+		{"t000", -1, 10},
+		{"t010", 10, 10},
+		{"t015", 10, 20},
+		{"t050", 51, 50},
+		{"t055", 51, 60},
+		{"t090", 90, 90},
+		{"t095", 90, -1},
+	}
+
+	for _, example := range tt {
+		ok, _, value := tree.Floor([]byte(example.Key))
+		if !ok {
+			value = -1
+		}
+		if value != example.Floor {
+			t.Errorf("Expected floor of %s to be %v but got %v", example.Key, example.Floor, value)
+		}
+
+		ok, _, value = tree.Ceiling([]byte(example.Key))
+		if !ok {
+			value = -1
+		}
+		if value != example.Ceiling {
+			t.Errorf("Expected ceiling of %s to be %v but got %v", example.Key, example.Ceiling, value)
+		}
+	}
+}
+
+func TestRankSelect(t *testing.T) {
+	tree := NewWithDegree(2)
+	count := 500
+	for i := 0; i < count; i++ {
+		tree.Insert([]byte(fmt.Sprintf("key%03d", i*2)), int64(i*2))
+	}
+	for i := 0; i < count; i += 3 {
+		tree.Delete([]byte(fmt.Sprintf("key%03d", i*2)))
+	}
+	if err := Check(tree); err != nil {
+		t.Fatal(err)
+	}
+
+	position := 0
+	tree.Walk(func(key []byte, value int64) {
+		if rank := tree.Rank(key); rank != position {
+			t.Errorf("Expected rank of %s to be %d but got %d", key, position, rank)
+		}
+
+		ok, selected, _ := tree.Select(position)
+		if !ok || string(selected) != string(key) {
+			t.Errorf("Expected to select %s at position %d but got %s", key, position, selected)
+		}
+
+		// Missing keys rank after every smaller key
+		missing := []byte(fmt.Sprintf("key%03d", value+1))
+		if rank := tree.Rank(missing); rank != position+1 {
+			t.Errorf("Expected rank of missing key %s to be %d but got %d", missing, position+1, rank)
+		}
+
+		position++
+	})
+
+	ok, _, _ := tree.Select(tree.Len())
+	if ok {
+		t.Errorf("Expected selecting past the end to fail")
+	}
+	ok, _, _ = tree.Select(-1)
+	if ok {
+		t.Errorf("Expected selecting a negative position to fail")
+	}
+	if rank := tree.Rank([]byte("a")); rank != 0 {
+		t.Errorf("Expected rank of a key before every other to be 0 but got %d", rank)
+	}
+}
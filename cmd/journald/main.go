@@ -6,16 +6,39 @@ import (
 	"log"
 
 	"github.com/journald/lsmtree"
+	"github.com/journald/sstable"
 )
 
+var codecs = map[string]sstable.Codec{
+	"none":  nil,
+	"flate": sstable.FlateCodec,
+	"gzip":  sstable.GzipCodec,
+	"zlib":  sstable.ZlibCodec,
+	"lzw":   sstable.LZWCodec,
+}
+
 func main() {
 	dbDirectoryPtr := flag.String("db", "./data", "database directory")
+	codecPtr := flag.String("codec", "none", "value compression: none, flate, gzip, zlib or lzw")
+	mmapPtr := flag.Bool("mmap", false, "read the last level through a memory mapping")
+	strictPtr := flag.Bool("strict", false, "refuse to open data files ending with a torn write")
+	blockSizePtr := flag.Int("block-size", 0, "store a new last level in blocks of that size, 0 for one index entry per key")
 	flag.Parse()
 
-	tree, err := lsmtree.New(5, *dbDirectoryPtr)
+	codec, ok := codecs[*codecPtr]
+	if !ok {
+		log.Fatalf("unknown codec %s", *codecPtr)
+	}
+
+	tree, err := lsmtree.NewWithOptions(5, *dbDirectoryPtr, lsmtree.Options{Codec: codec, Mmap: *mmapPtr, Strict: *strictPtr, BlockSize: *blockSizePtr})
 	if err != nil {
 		log.Fatal(err)
 	}
+	for level, dropped := range tree.Dropped() {
+		if dropped > 0 {
+			log.Printf("dropped a torn write of %d bytes from level %d", dropped, level)
+		}
+	}
 
 	if len(flag.Args()) < 1 {
 		fmt.Println("print usage here")
@@ -25,6 +48,11 @@ func main() {
 			if err != nil {
 				log.Fatal(err)
 			}
+		} else if flag.Args()[0] == "delete" {
+			err = tree.Delete([]byte(flag.Args()[1]))
+			if err != nil {
+				log.Fatal(err)
+			}
 		} else if flag.Args()[0] == "get" {
 			data, err := tree.Get([]byte(flag.Args()[1]))
 			if err != nil {
@@ -48,4 +76,9 @@ func main() {
 			}
 		}
 	}
+
+	err = tree.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
 }
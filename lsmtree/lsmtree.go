@@ -1,10 +1,13 @@
 package lsmtree
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path"
 	"strings"
+
+	"github.com/journald/sstable"
 )
 
 type LSMTree struct {
@@ -14,13 +17,57 @@ type LSMTree struct {
 	C2        *Segment
 }
 
+type Options struct {
+	// Codec compresses the values written to every level, nil stores them as
+	// is. Values already stored are read whatever the codec.
+	Codec sstable.Codec
+	// Keyring encrypts the segments written, nil stores them in plaintext.
+	// Segments encrypted with a previous key are read as long as the keyring
+	// holds it, and written with the current one when merged into.
+	Keyring     *sstable.Keyring
+	EncryptKeys bool
+	// Mmap reads C2, which is only merged into, through a memory mapping.
+	// Values read from it are then read only, and only valid until the tree
+	// is closed.
+	Mmap bool
+	// Strict refuses to open a level whose data file ends with a torn record,
+	// left by an interrupted write, instead of cutting it off. Dropped reports
+	// the size cut off otherwise.
+	Strict bool
+	// BlockSize stores C2, which holds most records, in the block format with
+	// blocks of that size: its index then keeps a few bytes per block rather
+	// than an entry per key. It only applies to a C2 holding no records yet:
+	// an existing C2 is opened in the format, and with the block size, its
+	// header records. C2 can't be encrypted nor mapped in the block format.
+	BlockSize int
+}
+
+var ErrBlockOptions = errors.New("lsmtree: block format C2 can't be encrypted nor mapped")
+
 func New(threshold int64, dataPath string) (*LSMTree, error) {
+	return NewWithOptions(threshold, dataPath, Options{})
+}
+
+func NewWithOptions(threshold int64, dataPath string, options Options) (*LSMTree, error) {
+	c2path := path.Join(dataPath, "2")
+	blocks := blockFormat(c2path, options.BlockSize)
+	if blocks && (options.Keyring != nil || options.Mmap) {
+		return &LSMTree{}, ErrBlockOptions
+	}
+
+	tableOptions := sstable.Options{
+		Codec:       options.Codec,
+		Keyring:     options.Keyring,
+		EncryptKeys: options.EncryptKeys,
+		Strict:      options.Strict,
+	}
+
 	c0path := path.Join(dataPath, "0")
 	err := os.MkdirAll(c0path, 0755)
 	if err != nil {
 		return &LSMTree{}, err
 	}
-	c0, err := NewSegment(c0path)
+	c0, err := NewSegmentWithOptions(c0path, tableOptions)
 	if err != nil {
 		return &LSMTree{}, err
 	}
@@ -30,20 +77,34 @@ func New(threshold int64, dataPath string) (*LSMTree, error) {
 	if err != nil {
 		return &LSMTree{}, err
 	}
-	c1, err := NewSegment(c1path)
+	c1, err := NewSegmentWithOptions(c1path, tableOptions)
 	if err != nil {
 		return &LSMTree{}, err
 	}
 
-	c2path := path.Join(dataPath, "2")
 	err = os.MkdirAll(c2path, 0755)
 	if err != nil {
 		return &LSMTree{}, err
 	}
-	c2, err := NewSegment(c2path)
+	var c2 *Segment
+	if blocks {
+		c2, err = NewBlockSegment(c2path, sstable.BlockOptions{
+			BlockSize: options.BlockSize,
+			Codec:     options.Codec,
+			Strict:    options.Strict,
+		})
+	} else {
+		c2, err = NewSegmentWithOptions(c2path, tableOptions)
+	}
 	if err != nil {
 		return &LSMTree{}, err
 	}
+	if options.Mmap {
+		err = c2.Map()
+		if err != nil {
+			return &LSMTree{}, err
+		}
+	}
 
 	return &LSMTree{
 		Threshold: threshold,
@@ -53,12 +114,36 @@ func New(threshold int64, dataPath string) (*LSMTree, error) {
 	}, nil
 }
 
+// blockFormat reports whether the C2 segment stored in dir is in the block
+// format: the format its header records when it holds one, whether blockSize
+// is set otherwise. A header failing to read is reported by the segment.
+func blockFormat(dir string, blockSize int) bool {
+	file, err := os.Open(path.Join(dir, "data"))
+	if err != nil {
+		return blockSize > 0
+	}
+	defer file.Close()
+
+	header, err := sstable.ReadHeader(file)
+	if err != nil {
+		return blockSize > 0
+	}
+	return header.Flags&sstable.FlagBlocks != 0
+}
+
 func (t *LSMTree) Put(key, value []byte) error {
 	err := t.C0.Put(key, value)
 	if err != nil {
 		return err
 	}
 
+	t.compact()
+
+	return nil
+}
+
+// compact merges levels that reached their size threshold into older ones.
+func (t *LSMTree) compact() {
 	if t.C0.Size() >= t.Threshold {
 		t.C1.Merge(t.C0)
 	}
@@ -66,31 +151,81 @@ func (t *LSMTree) Put(key, value []byte) error {
 	if t.C1.Size() >= 10*t.Threshold {
 		t.C2.Merge(t.C1)
 	}
+}
+
+// Delete writes a tombstone for key, hiding it and its older versions.
+func (t *LSMTree) Delete(key []byte) error {
+	err := t.C0.Delete(key)
+	if err != nil {
+		return err
+	}
+
+	t.compact()
 
 	return nil
 }
 
+// Get returns the value of key from the newest level storing it. Only a key
+// missing from a level makes Get look into older ones: any other error, such
+// as a newer tombstone failing to read, is returned.
 func (t *LSMTree) Get(key []byte) ([]byte, error) {
-	value, err := t.C0.Get(key)
-	if err == nil {
-		return value, nil
+	for _, segment := range []*Segment{t.C0, t.C1} {
+		value, err := segment.Get(key)
+		if !IsNotFound(err) || IsDeleted(err) {
+			return value, err
+		}
 	}
 
-	value, err = t.C1.Get(key)
-	if err == nil {
-		return value, nil
+	return t.C2.Get(key)
+}
+
+// Has reports whether key is stored and was not deleted since. Levels whose
+// filter rules key out are skipped without reading their index.
+func (t *LSMTree) Has(key []byte) (bool, error) {
+	for _, segment := range []*Segment{t.C0, t.C1, t.C2} {
+		if !segment.MayContain(key) {
+			continue
+		}
+
+		_, err := segment.Get(key)
+		if err == nil {
+			return true, nil
+		}
+		if IsDeleted(err) {
+			return false, nil
+		}
+		if !IsNotFound(err) {
+			return false, err
+		}
 	}
 
-	return t.C2.Get(key)
+	return false, nil
+}
+
+// IsNotFound reports whether err comes from reading a key a level doesn't
+// store, or stores as deleted.
+func IsNotFound(err error) bool {
+	_, ok := err.(sstable.NotFoundError)
+	return ok
+}
+
+// IsDeleted reports whether err comes from reading a key deleted in a newer
+// level, which must hide the versions stored in older ones.
+func IsDeleted(err error) bool {
+	notFound, ok := err.(sstable.NotFoundError)
+	return ok && notFound.Deleted
 }
 
+// Scan calls fn for every key written since the last version of from, level
+// by level, oldest first. Keys written to a newer level, deletions included,
+// are only yielded by that level.
 func (t *LSMTree) Scan(from []byte, fn func(key, data []byte)) error {
 	// We start looking for 'from' key in the oldest C2 level
-	err := t.C2.Scan(from, fn)
+	err := t.C2.Scan(from, visible(fn, t.C1, t.C0))
 	if err != nil {
 		// 'from' key is NOT in C2 "older" level, so we check if it is a slightly
 		// newer C1 level
-		err := t.C1.Scan(from, fn)
+		err := t.C1.Scan(from, visible(fn, t.C0))
 		if err != nil {
 			// 'from' is not in C1 level neither, we look for it in C0
 			return t.C0.Scan(from, fn)
@@ -100,23 +235,22 @@ func (t *LSMTree) Scan(from []byte, fn func(key, data []byte)) error {
 		}
 	} else {
 		// 'from' key is in C2 "older" level, so we scan all "newer" levels
-		err := t.C1.ScanAll(fn)
+		err := t.C1.ScanAll(visible(fn, t.C0))
 		if err != nil {
 			return err
 		}
 
 		return t.C0.ScanAll(fn)
 	}
-	return fmt.Errorf("key %s not found", from)
 }
 
 func (t *LSMTree) ScanAll(fn func(key, data []byte)) error {
-	err := t.C2.ScanAll(fn)
+	err := t.C2.ScanAll(visible(fn, t.C1, t.C0))
 	if err != nil {
 		return err
 	}
 
-	err = t.C1.ScanAll(fn)
+	err = t.C1.ScanAll(visible(fn, t.C0))
 	if err != nil {
 		return err
 	}
@@ -124,6 +258,25 @@ func (t *LSMTree) ScanAll(fn func(key, data []byte)) error {
 	return t.C0.ScanAll(fn)
 }
 
+// visible wraps fn to skip the keys written to any of the newer segments,
+// whose versions hide the ones of older levels.
+func visible(fn func(key, data []byte), newer ...*Segment) func(key, data []byte) {
+	return func(key, data []byte) {
+		for _, segment := range newer {
+			if segment.SSTable.MayContain(key) && len(segment.SSTable.Offsets(key)) > 0 {
+				return
+			}
+		}
+		fn(key, data)
+	}
+}
+
+// Dropped returns the size of the torn tail cut off the data file of every
+// level when the tree was opened, C0 first.
+func (t *LSMTree) Dropped() []int64 {
+	return []int64{t.C0.Dropped, t.C1.Dropped, t.C2.Dropped}
+}
+
 func (t *LSMTree) Close() error {
 	err := t.C0.Close()
 	if err != nil {
@@ -2,9 +2,14 @@ package lsmtree
 
 import (
 	"bytes"
+	"fmt"
 	"io/ioutil"
+	"os"
 	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/journald/sstable"
 )
 
 func TestGetPut(t *testing.T) {
@@ -182,6 +187,378 @@ func TestPutMergeC1IntoC2AfterThreshold(t *testing.T) {
 	}
 }
 
+func TestDelete(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "data")
+	if err != nil {
+		t.Error(err)
+	}
+
+	tree, err := New(2, tempDir)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// 25 letters starting from ASCII 'A': 65, spread over every level
+	for i := 65; i <= 89; i++ {
+		err = tree.Put(append([]byte("key"), byte(i)), []byte{byte(i)})
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	err = tree.Delete([]byte("keyA"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = tree.Get([]byte("keyA"))
+	if !IsDeleted(err) {
+		t.Errorf("Expected tombstone in a newer level to hide the older versions but got %v", err)
+	}
+
+	_, err = tree.Get([]byte("keyB"))
+	if err != nil {
+		t.Errorf("Expected to still find keyB: %v", err)
+	}
+
+	values, err := CaptureScanAll(tree)
+	if err != nil {
+		t.Error(err)
+	}
+	if _, ok := values["keyA"]; ok || len(values) != 24 {
+		t.Errorf("Expected scan to hide the deleted key but got %v", values)
+	}
+	if strings.Contains(tree.String(), "keyA") {
+		t.Errorf("Expected String to hide the deleted key but got %q", tree.String())
+	}
+
+	err = tree.Put([]byte("keyA"), []byte("again"))
+	if err != nil {
+		t.Error(err)
+	}
+	value, err := tree.Get([]byte("keyA"))
+	if err != nil || string(value) != "again" {
+		t.Errorf("Expected a deleted key to be writable again but got '%s' (%v)", value, err)
+	}
+
+	values, err = CaptureScanAll(tree)
+	if err != nil || values["keyA"] != "again" {
+		t.Errorf("Expected scan to yield the last version of keyA but got '%s' (%v)", values["keyA"], err)
+	}
+}
+
+func TestGetReadError(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "data")
+	if err != nil {
+		t.Error(err)
+	}
+
+	tree, err := New(2, tempDir)
+	if err != nil {
+		t.Error(err)
+	}
+
+	for i := 65; i <= 89; i++ {
+		err = tree.Put(append([]byte("key"), byte(i)), []byte{byte(i)})
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	err = tree.Delete([]byte("keyA"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Corrupt the tombstone: failing to read it must not reveal the deleted
+	// value stored in C2
+	var segment *Segment
+	for _, s := range []*Segment{tree.C0, tree.C1} {
+		if _, err := s.Get([]byte("keyA")); IsDeleted(err) {
+			segment = s
+			break
+		}
+	}
+	if segment == nil {
+		t.Fatal("Expected the tombstone to be in C0 or C1")
+	}
+	_, offset := segment.SSTable.Index.Search([]byte("keyA"))
+	_, err = segment.DataFile.WriteAt([]byte("XXXX"), offset+17)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := tree.Get([]byte("keyA"))
+	if err == nil || IsNotFound(err) {
+		t.Errorf("Expected the corrupted tombstone to fail the read but got '%s' (%v)", value, err)
+	}
+}
+
+func TestHas(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "data")
+	if err != nil {
+		t.Error(err)
+	}
+
+	tree, err := New(2, tempDir)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// 25 letters starting from ASCII 'A': 65, spread over every level
+	for i := 65; i <= 89; i++ {
+		err = tree.Put(append([]byte("key"), byte(i)), []byte{byte(i)})
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	err = tree.Delete([]byte("keyA"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	expected := map[string]bool{
+		"keyA":   false,
+		"keyB":   true,
+		"keyY":   true,
+		"absent": false,
+	}
+	for key, present := range expected {
+		actual, err := tree.Has([]byte(key))
+		if err != nil {
+			t.Error(err)
+		}
+		if actual != present {
+			t.Errorf("Expected presence of %s.\nExpected: %v\nGot:      %v", key, present, actual)
+		}
+	}
+}
+
+func TestCodec(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "data")
+	if err != nil {
+		t.Error(err)
+	}
+
+	tree, err := NewWithOptions(2, tempDir, Options{Codec: sstable.GzipCodec})
+	if err != nil {
+		t.Error(err)
+	}
+
+	value := bytes.Repeat([]byte(`{"level":"info"}`), 10)
+	for i := 65; i <= 89; i++ {
+		err = tree.Put(append([]byte("key"), byte(i)), value)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	err = tree.Close()
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Values are read back whatever the codec
+	tree, err = New(2, tempDir)
+	if err != nil {
+		t.Error(err)
+	}
+	for i := 65; i <= 89; i++ {
+		actual, err := tree.Get(append([]byte("key"), byte(i)))
+		if err != nil || bytes.Compare(actual, value) != 0 {
+			t.Errorf("Expected to read back a compressed value at key%c but got '%s' (%v)", i, actual, err)
+		}
+	}
+}
+
+func TestTornWrite(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "data")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	tree, err := New(10, tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tree.Put([]byte("keyA"), []byte("valueA"))
+	if err != nil {
+		t.Error(err)
+	}
+	// An interrupted write to C0, without the index saved on close
+	tree.C0.DataFile.Write([]byte{0x4, 0x0, 0x0})
+	tree.C0.DataFile.Close()
+	tree.C1.Close()
+	tree.C2.Close()
+
+	_, err = NewWithOptions(10, tempDir, Options{Strict: true})
+	if _, ok := err.(sstable.TornWriteError); !ok {
+		t.Errorf("Expected a strict tree to refuse a torn write but got %v", err)
+	}
+
+	tree, err = New(10, tempDir)
+	if err != nil {
+		t.Fatalf("Expected a torn write to be recovered: %v", err)
+	}
+	defer tree.Close()
+
+	expected := []int64{3, 0, 0}
+	if !reflect.DeepEqual(tree.Dropped(), expected) {
+		t.Errorf("Unexpected dropped bytes.\nExpected: %v\nGot:      %v", expected, tree.Dropped())
+	}
+	value, err := tree.Get([]byte("keyA"))
+	if err != nil || string(value) != "valueA" {
+		t.Errorf("Expected to keep the records before the torn write but got '%s' (%v)", value, err)
+	}
+}
+
+func TestMmap(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "data")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	tree, err := NewWithOptions(2, tempDir, Options{Mmap: true})
+	if err == sstable.ErrMmapUnsupported {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 65; i <= 89; i++ {
+		err = tree.Put(append([]byte("key"), byte(i)), append([]byte("value"), byte(i)))
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if tree.C2.Size() == 0 {
+		t.Errorf("Expected records to be merged into the mapped level")
+	}
+
+	for _, reopen := range []bool{false, true} {
+		if reopen {
+			err = tree.Close()
+			if err != nil {
+				t.Error(err)
+			}
+			tree, err = NewWithOptions(2, tempDir, Options{Mmap: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for i := 65; i <= 89; i++ {
+			actual, err := tree.Get(append([]byte("key"), byte(i)))
+			if err != nil || bytes.Compare(actual, append([]byte("value"), byte(i))) != 0 {
+				t.Errorf("Expected to read back key%c but got '%s' (%v)", i, actual, err)
+			}
+		}
+	}
+
+	err = tree.C1.Merge(tree.C2)
+	if err != ErrMappedSegment {
+		t.Errorf("Unexpected error merging a mapped segment.\nExpected: %v\nGot:      %v", ErrMappedSegment, err)
+	}
+	tree.Close()
+}
+
+func TestBlocks(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "data")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	_, err = NewWithOptions(2, tempDir, Options{BlockSize: sstable.MinBlockSize, Mmap: true})
+	if err != ErrBlockOptions {
+		t.Errorf("Unexpected error mapping a block level.\nExpected: %v\nGot:      %v", ErrBlockOptions, err)
+	}
+
+	tree, err := NewWithOptions(2, tempDir, Options{BlockSize: sstable.MinBlockSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 200; i++ {
+		err = tree.Put([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%03d", i)))
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if tree.C2.Blocks == nil || tree.C2.Blocks.Blocks() == 0 {
+		t.Fatalf("Expected records to be merged into the blocks of C2")
+	}
+
+	for _, reopen := range []bool{false, true} {
+		if reopen {
+			err = tree.Close()
+			if err != nil {
+				t.Error(err)
+			}
+			tree, err = NewWithOptions(2, tempDir, Options{BlockSize: sstable.MinBlockSize})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for i := 0; i < 200; i++ {
+			actual, err := tree.Get([]byte(fmt.Sprintf("key%03d", i)))
+			if err != nil || string(actual) != fmt.Sprintf("value%03d", i) {
+				t.Errorf("Expected to read back key%03d but got '%s' (%v)", i, actual, err)
+			}
+		}
+		ok, err := tree.Has([]byte("key000"))
+		if err != nil || !ok {
+			t.Errorf("Expected key000 to be found in the block level (%v)", err)
+		}
+	}
+	tree.Close()
+}
+
+func TestBlocksToggled(t *testing.T) {
+	for _, blockSize := range []int{sstable.MinBlockSize, 0} {
+		tempDir, err := ioutil.TempDir("", "data")
+		if err != nil {
+			t.Error(err)
+		}
+		defer os.RemoveAll(tempDir)
+
+		tree, err := NewWithOptions(2, tempDir, Options{BlockSize: blockSize})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 200; i++ {
+			err = tree.Put([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%03d", i)))
+			if err != nil {
+				t.Error(err)
+			}
+		}
+		err = tree.Close()
+		if err != nil {
+			t.Error(err)
+		}
+
+		// C2 keeps the format it was written in, whatever the option says
+		toggled := sstable.MinBlockSize - blockSize
+		tree, err = NewWithOptions(2, tempDir, Options{BlockSize: toggled})
+		if err != nil {
+			t.Fatalf("Expected a tree written with block size %d to reopen with %d: %v", blockSize, toggled, err)
+		}
+		if (tree.C2.Blocks != nil) != (blockSize > 0) {
+			t.Errorf("Expected C2 to keep its format.\nExpected: %v\nGot:      %v", blockSize > 0, tree.C2.Blocks != nil)
+		}
+		for i := 0; i < 200; i++ {
+			actual, err := tree.Get([]byte(fmt.Sprintf("key%03d", i)))
+			if err != nil || string(actual) != fmt.Sprintf("value%03d", i) {
+				t.Errorf("Expected to read back key%03d but got '%s' (%v)", i, actual, err)
+			}
+		}
+		tree.Close()
+	}
+}
+
 func TestScan(t *testing.T) {
 	tempDir, err := ioutil.TempDir("", "data")
 	if err != nil {
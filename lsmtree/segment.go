@@ -1,6 +1,8 @@
 package lsmtree
 
 import (
+	"bufio"
+	"errors"
 	"io"
 	"os"
 	"path"
@@ -10,17 +12,38 @@ import (
 )
 
 type Segment struct {
-	SSTable  sstable.SSTable
+	SSTable sstable.SSTable
+	// Blocks holds the records instead of SSTable in segments of the block
+	// format, opened with NewBlockSegment.
+	Blocks   *sstable.BlockTable
 	DataFile *os.File
+	Dir      string
+	// Dropped is the size of the torn tail cut off the data file when the
+	// segment was opened.
+	Dropped int64
+
+	// mapping reads the data file once Map is called
+	mapping *sstable.Mmap
 }
 
+var (
+	ErrMappedSegment = errors.New("lsmtree: mapped segment can't be merged into another")
+	ErrBlockSegment  = errors.New("lsmtree: block segments are only merged into, and have no key index")
+)
+
 func NewSegment(dir string) (*Segment, error) {
+	return NewSegmentWithOptions(dir, sstable.Options{})
+}
+
+func NewSegmentWithOptions(dir string, options sstable.Options) (*Segment, error) {
 	file, err := os.OpenFile(path.Join(dir, "data"), os.O_RDWR|os.O_CREATE, 0660)
 	if err != nil {
 		return &Segment{}, err
 	}
 
-	table, err := sstable.Load(file)
+	// Data files of an older version are read in place, and rewritten in the
+	// current one when merged into
+	table, err := loadTable(file, path.Join(dir, "index"), options)
 	if err != nil {
 		return &Segment{}, err
 	}
@@ -28,14 +51,227 @@ func NewSegment(dir string) (*Segment, error) {
 	return &Segment{
 		DataFile: file,
 		SSTable:  table,
+		Dir:      dir,
+		Dropped:  table.Dropped,
 	}, nil
 }
 
+// NewBlockSegment opens a segment storing its records in the block format,
+// whose index only keeps a few bytes per block. It is meant for levels which
+// are only merged into: Walk, ScanRange, Iterator and Map need the key index
+// of the sstable format, and newer segments can't be of the block format.
+func NewBlockSegment(dir string, options sstable.BlockOptions) (*Segment, error) {
+	file, err := os.OpenFile(path.Join(dir, "data"), os.O_RDWR|os.O_CREATE, 0660)
+	if err != nil {
+		return &Segment{}, err
+	}
+
+	table, err := loadBlocks(file, path.Join(dir, "index"), options)
+	if err != nil {
+		return &Segment{}, err
+	}
+
+	return &Segment{
+		DataFile: file,
+		Blocks:   table,
+		Dir:      dir,
+		Dropped:  table.Dropped,
+	}, nil
+}
+
+// loadBlocks is loadTable for block tables.
+func loadBlocks(data *os.File, indexPath string, options sstable.BlockOptions) (*sstable.BlockTable, error) {
+	index, err := os.Open(indexPath)
+	if err != nil {
+		return sstable.OpenBlockTable(data, options)
+	}
+	defer index.Close()
+
+	table, err := sstable.OpenBlockTableIndexed(data, bufio.NewReader(index), options)
+	if err != nil {
+		return sstable.OpenBlockTable(data, options)
+	}
+
+	return table, nil
+}
+
+// loadTable starts from the index saved when the segment was last closed,
+// and falls back to scanning the whole data file when it is missing or can't
+// be used.
+func loadTable(data *os.File, indexPath string, options sstable.Options) (sstable.SSTable, error) {
+	index, err := os.Open(indexPath)
+	if err != nil {
+		return sstable.LoadWithOptions(data, options)
+	}
+	defer index.Close()
+
+	table, err := sstable.LoadIndexedWithOptions(data, bufio.NewReader(index), options)
+	if err != nil {
+		return sstable.LoadWithOptions(data, options)
+	}
+
+	return table, nil
+}
+
+// rewrite writes the table of a data file to a new one with fn, like
+// SSTable.Rewrite, then swaps it with the original.
+func rewrite(file *os.File, dir string, fn func(data *os.File) error) (*os.File, error) {
+	tmpPath := path.Join(dir, "data.tmp")
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0660)
+	if err != nil {
+		return nil, err
+	}
+
+	err = fn(tmp)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		// The saved index points into the original file
+		err = os.Remove(path.Join(dir, "index"))
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path.Join(dir, "data"))
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return nil, err
+	}
+
+	file.Close()
+	return tmp, nil
+}
+
+// syncDir flushes the entries of dir, so that a file renamed in it stays
+// renamed after a crash.
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return file.Sync()
+}
+
+// Map reads the segment through a memory mapping of its data file, for
+// segments that are only appended to: keys and values read are then read only
+// slices of the mapping, valid until the segment is closed. A mapped segment
+// can't be merged into another, as wiping it would pull the rug from under
+// them.
+func (s *Segment) Map() error {
+	if s.Blocks != nil {
+		return ErrBlockSegment
+	}
+
+	mapping, err := sstable.OpenMmap(s.DataFile)
+	if err != nil {
+		return err
+	}
+
+	s.mapping = mapping
+	s.SSTable.Reader = mapping
+	return nil
+}
+
+func (s *Segment) indexPath() string {
+	return path.Join(s.Dir, "index")
+}
+
+// SaveIndex persists the in memory index next to the data file, the block
+// index for block segments. Indexes of encrypted keys are not saved: the
+// segment is scanned when opened instead.
+func (s *Segment) SaveIndex() error {
+	save := s.SSTable.SaveIndex
+	if s.Blocks != nil {
+		save = s.Blocks.SaveIndex
+	} else if s.SSTable.Header.Flags&sstable.FlagEncryptedKeys != 0 {
+		err := os.Remove(s.indexPath())
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return err
+	}
+
+	tmpPath := s.indexPath() + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	if err != nil {
+		return err
+	}
+
+	err = save(file)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpPath, s.indexPath())
+	if err != nil {
+		return err
+	}
+
+	return syncDir(s.Dir)
+}
+
+// Merge appends the records of newer, then wipes it. A segment written with a
+// previous key or version is rewritten first, so that merged segments are
+// written with the current ones. When newer deletes keys, the segment is
+// compacted afterwards so that the values deleted don't stay on disk. Block
+// segments only get the last version of every key of newer.
 func (s *Segment) Merge(newer *Segment) error {
-	err := s.SSTable.Merge(newer.SSTable)
+	if newer.mapping != nil {
+		return ErrMappedSegment
+	}
+	if newer.Blocks != nil {
+		return ErrBlockSegment
+	}
+
+	if s.Blocks == nil && s.SSTable.Stale() {
+		err := s.rewrite(s.SSTable.Rewrite)
+		if err != nil {
+			return err
+		}
+	}
+
+	deletes, err := hasTombstones(newer.SSTable)
 	if err != nil {
 		return err
 	}
+
+	if s.Blocks != nil {
+		err = s.Blocks.Merge(newer.SSTable)
+	} else {
+		err = s.SSTable.Merge(newer.SSTable)
+	}
+	if err != nil {
+		return err
+	}
+	if deletes && s.Blocks != nil {
+		err = s.rewriteBlocks()
+	} else if deletes {
+		err = s.rewrite(s.SSTable.Compact)
+	}
+	if err != nil {
+		return err
+	}
+	// The saved index would point past the end of the wiped data file
+	err = os.Remove(newer.indexPath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
 	_, err = newer.DataFile.Seek(0, io.SeekStart)
 	if err != nil {
 		return err
@@ -44,34 +280,145 @@ func (s *Segment) Merge(newer *Segment) error {
 	if err != nil {
 		return err
 	}
-	newer.SSTable = sstable.New(newer.DataFile)
+	newer.SSTable = sstable.NewWithOptions(newer.DataFile, newer.SSTable.Options)
 	return nil
 }
 
+// rewrite swaps the data file with the one fn writes, like SSTable.Rewrite.
+func (s *Segment) rewrite(fn func(data io.ReadWriteSeeker) (sstable.SSTable, error)) error {
+	var table sstable.SSTable
+	file, err := rewrite(s.DataFile, s.Dir, func(data *os.File) error {
+		var err error
+		table, err = fn(data)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if s.mapping != nil {
+		// Records already read still point into the previous file
+		err = s.mapping.Reset(file)
+		if err != nil {
+			return err
+		}
+		table.Reader = s.mapping
+	}
+
+	s.DataFile, s.SSTable = file, table
+	return syncDir(s.Dir)
+}
+
+// rewriteBlocks swaps the data file of a block segment with its compaction.
+func (s *Segment) rewriteBlocks() error {
+	var table *sstable.BlockTable
+	file, err := rewrite(s.DataFile, s.Dir, func(data *os.File) error {
+		var err error
+		table, err = s.Blocks.Compact(data)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	s.DataFile, s.Blocks = file, table
+	return syncDir(s.Dir)
+}
+
+// hasTombstones reports whether table deletes any key.
+func hasTombstones(table sstable.SSTable) (bool, error) {
+	found := false
+	err := table.ScanAllEntries(func(entry sstable.DataEntry) {
+		found = found || entry.IsTombstone()
+	})
+	return found, err
+}
+
 func (s *Segment) Close() error {
+	err := s.SaveIndex()
+	if s.mapping != nil {
+		unmapErr := s.mapping.Close()
+		if err == nil {
+			err = unmapErr
+		}
+	}
+	if err != nil {
+		s.DataFile.Close()
+		return err
+	}
 	return s.DataFile.Close()
 }
 
 func (s *Segment) Put(key, value []byte) error {
+	if s.Blocks != nil {
+		return s.Blocks.Put(key, value)
+	}
 	return s.SSTable.Put(key, value)
 }
 
+func (s *Segment) Delete(key []byte) error {
+	if s.Blocks != nil {
+		return s.Blocks.Delete(key)
+	}
+	return s.SSTable.Delete(key)
+}
+
 func (s *Segment) Get(key []byte) ([]byte, error) {
+	if s.Blocks != nil {
+		return s.Blocks.Get(key)
+	}
 	return s.SSTable.Get(key)
 }
 
+// MayContain returns false when key is not in the segment.
+func (s *Segment) MayContain(key []byte) bool {
+	if s.Blocks != nil {
+		return s.Blocks.MayContain(key)
+	}
+	return s.SSTable.MayContain(key)
+}
+
 func (s *Segment) Scan(from []byte, fn func(key, data []byte)) error {
+	if s.Blocks != nil {
+		return s.Blocks.Scan(from, fn)
+	}
 	return s.SSTable.Scan(from, fn)
 }
 
 func (s *Segment) ScanAll(fn func(key, data []byte)) error {
+	if s.Blocks != nil {
+		return s.Blocks.ScanAll(fn)
+	}
 	return s.SSTable.ScanAll(fn)
 }
 
+// ScanRange fails with ErrBlockSegment for block segments.
+func (s *Segment) ScanRange(r sstable.Range, fn func(key, data []byte)) error {
+	if s.Blocks != nil {
+		return ErrBlockSegment
+	}
+	return s.SSTable.ScanRange(r, fn)
+}
+
+// Iterator returns nil for block segments.
+func (s *Segment) Iterator() *sstable.Iterator {
+	if s.Blocks != nil {
+		return nil
+	}
+	return s.SSTable.Iterator()
+}
+
+// Walk calls fn for every indexed key, none for block segments.
 func (s *Segment) Walk(fn btree.WalkerFunc) {
-	s.SSTable.Index.Walk(fn)
+	if s.Blocks != nil {
+		return
+	}
+	s.SSTable.Walk(fn)
 }
 
+// Size returns the number of keys, or of records for block segments.
 func (s *Segment) Size() int64 {
+	if s.Blocks != nil {
+		return s.Blocks.Size()
+	}
 	return s.SSTable.Size()
 }
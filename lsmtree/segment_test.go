@@ -2,9 +2,14 @@ package lsmtree
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
+	"path"
 	"testing"
+
+	"github.com/journald/sstable"
 )
 
 func TestMerge(t *testing.T) {
@@ -90,3 +95,377 @@ func TestMerge(t *testing.T) {
 		t.Errorf("Expected to find newer keys inside older index after merge")
 	}
 }
+
+func TestMergeDropsDeletedValues(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "data")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(tempDir)
+	older, err := NewSegment(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newerDir, err := ioutil.TempDir("", "data")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(newerDir)
+	newer, err := NewSegment(newerDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	older.Put([]byte("keyA"), []byte("secretA"))
+	older.Put([]byte("keyB"), []byte("valueB"))
+	newer.Put([]byte("keyC"), []byte("secretC"))
+	newer.Delete([]byte("keyA"))
+	newer.Delete([]byte("keyC"))
+
+	err = older.Merge(newer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path.Join(tempDir, "data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("secret")) {
+		t.Errorf("Expected merge to drop the deleted values from the data file")
+	}
+
+	_, err = older.Get([]byte("keyA"))
+	if !IsDeleted(err) {
+		t.Errorf("Expected the tombstone to be kept but got %v", err)
+	}
+	value, err := older.Get([]byte("keyB"))
+	if err != nil || string(value) != "valueB" {
+		t.Errorf("Expected to find '%s' at key '%s' but found '%s' (%v)", "valueB", "keyB", value, err)
+	}
+}
+
+func TestBlockSegment(t *testing.T) {
+	blockDir, err := ioutil.TempDir("", "data")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(blockDir)
+	newerDir, err := ioutil.TempDir("", "data")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(newerDir)
+
+	options := sstable.BlockOptions{BlockSize: sstable.MinBlockSize}
+	segment, err := NewBlockSegment(blockDir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newer, err := NewSegment(newerDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newer.Close()
+
+	for i := 0; i < 50; i++ {
+		newer.Put([]byte(fmt.Sprintf("key%02d", i)), []byte("old"))
+		newer.Put([]byte(fmt.Sprintf("key%02d", i)), []byte(fmt.Sprintf("value%02d", i)))
+	}
+	err = segment.Merge(newer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if segment.Size() != 50 {
+		t.Errorf("Expected only the last versions to be merged.\nExpected: %v\nGot:      %v", 50, segment.Size())
+	}
+
+	newer.Put([]byte("key00"), []byte("value00"))
+	newer.Delete([]byte("key01"))
+	err = segment.Merge(newer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if segment.Size() != 50 {
+		t.Errorf("Expected merging deletes to compact the segment.\nExpected: %v\nGot:      %v", 50, segment.Size())
+	}
+
+	err = newer.Merge(segment)
+	if err != ErrBlockSegment {
+		t.Errorf("Unexpected error merging a block segment.\nExpected: %v\nGot:      %v", ErrBlockSegment, err)
+	}
+
+	err = segment.Close()
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = os.Stat(path.Join(blockDir, "index"))
+	if err != nil {
+		t.Errorf("Expected closing a block segment to save its index: %v", err)
+	}
+
+	segment, err = NewBlockSegment(blockDir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer segment.Close()
+
+	value, err := segment.Get([]byte("key42"))
+	if err != nil || string(value) != "value42" {
+		t.Errorf("Expected to find 'value42' at key 'key42' but found '%s' (%v)", value, err)
+	}
+	_, err = segment.Get([]byte("key01"))
+	if !IsDeleted(err) {
+		t.Errorf("Expected key01 to be deleted but got %v", err)
+	}
+}
+
+func TestReopenFromSavedIndex(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "data")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	segment, err := NewSegment(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = segment.Put([]byte("keyA"), []byte("valueA"))
+	if err != nil {
+		t.Error(err)
+	}
+	err = segment.Close()
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = os.Stat(path.Join(tempDir, "index"))
+	if err != nil {
+		t.Errorf("Expected closing a segment to save its index: %v", err)
+	}
+
+	segment, err = NewSegment(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = segment.Put([]byte("keyB"), []byte("valueB"))
+	if err != nil {
+		t.Error(err)
+	}
+	// Closing the file directly leaves the saved index behind the data
+	segment.DataFile.Close()
+
+	segment, err = NewSegment(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer segment.Close()
+
+	for _, key := range []string{"keyA", "keyB"} {
+		_, err := segment.Get([]byte(key))
+		if err != nil {
+			t.Errorf("Expected to find key %s after reopening the segment: %v", key, err)
+		}
+	}
+}
+
+func TestReopenWithCorruptedIndex(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "data")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	segment, err := NewSegment(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = segment.Put([]byte("keyA"), []byte("valueA"))
+	if err != nil {
+		t.Error(err)
+	}
+	err = segment.Close()
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = ioutil.WriteFile(path.Join(tempDir, "index"), []byte("garbage"), 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	segment, err = NewSegment(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer segment.Close()
+
+	value, err := segment.Get([]byte("keyA"))
+	if err != nil || bytes.Compare(value, []byte("valueA")) != 0 {
+		t.Errorf("Expected a corrupted index to fall back to scanning the data file")
+	}
+}
+
+func TestMigrateLegacySegment(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "data")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// Data file written with MD5 records and no header
+	legacy := bytes.NewBufferString("")
+	sstable.NewDataEntry([]byte("keyA"), []byte("valueA")).WriteVersion(legacy, sstable.LegacyVersion)
+	sstable.NewTombstone([]byte("keyB")).WriteVersion(legacy, sstable.LegacyVersion)
+	err = ioutil.WriteFile(path.Join(tempDir, "data"), legacy.Bytes(), 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	segment, err := NewSegment(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if segment.SSTable.Header.Version != sstable.LegacyVersion {
+		t.Errorf("Expected a legacy segment to be read in place.\nExpected: %v\nGot:      %v", sstable.LegacyVersion, segment.SSTable.Header.Version)
+	}
+	value, err := segment.Get([]byte("keyA"))
+	if err != nil || bytes.Compare(value, []byte("valueA")) != 0 {
+		t.Errorf("Expected to read a legacy record but got '%s' (%v)", value, err)
+	}
+
+	newerDir, err := ioutil.TempDir("", "data")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(newerDir)
+	newer, err := NewSegment(newerDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newer.Close()
+	newer.Put([]byte("keyC"), []byte("valueC"))
+
+	err = segment.Merge(newer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if segment.SSTable.Header.Version != sstable.CurrentVersion {
+		t.Errorf("Expected a legacy segment to be migrated when merged into.\nExpected: %v\nGot:      %v", sstable.CurrentVersion, segment.SSTable.Header.Version)
+	}
+	err = segment.Close()
+	if err != nil {
+		t.Error(err)
+	}
+
+	segment, err = NewSegment(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer segment.Close()
+
+	for key, expected := range map[string]string{"keyA": "valueA", "keyC": "valueC"} {
+		value, err := segment.Get([]byte(key))
+		if err != nil || string(value) != expected {
+			t.Errorf("Expected to find '%s' at key '%s' but found '%s' (%v)", expected, key, value, err)
+		}
+	}
+	_, err = segment.Get([]byte("keyB"))
+	if !IsDeleted(err) {
+		t.Errorf("Expected a migrated tombstone to still hide its key but got %v", err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "data")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(tempDir)
+	olderDir, newerDir := path.Join(tempDir, "1"), path.Join(tempDir, "0")
+	os.Mkdir(olderDir, 0755)
+	os.Mkdir(newerDir, 0755)
+
+	keyring := &sstable.Keyring{
+		Current: 1,
+		Keys:    map[uint32][]byte{1: bytes.Repeat([]byte{0x1}, 32)},
+	}
+	older, err := NewSegmentWithOptions(olderDir, sstable.Options{Keyring: keyring})
+	if err != nil {
+		t.Fatal(err)
+	}
+	older.Put([]byte("keyA"), []byte("valueA"))
+	older.Close()
+
+	// Rotate to a new key, keeping the previous one to read old segments
+	keyring.Keys[2] = bytes.Repeat([]byte{0x2}, 32)
+	keyring.Current = 2
+
+	older, err = NewSegmentWithOptions(olderDir, sstable.Options{Keyring: keyring})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer older.Close()
+	newer, err := NewSegmentWithOptions(newerDir, sstable.Options{Keyring: keyring})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newer.Close()
+
+	value, err := older.Get([]byte("keyA"))
+	if err != nil || bytes.Compare(value, []byte("valueA")) != 0 {
+		t.Errorf("Expected to read a segment written with the previous key but got '%s' (%v)", value, err)
+	}
+
+	newer.Put([]byte("keyB"), []byte("valueB"))
+	err = older.Merge(newer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if older.SSTable.Header.KeyID != 2 {
+		t.Errorf("Expected a merged segment to use the new key.\nExpected: %v\nGot:      %v", 2, older.SSTable.Header.KeyID)
+	}
+
+	for _, key := range []string{"keyA", "keyB"} {
+		_, err = older.Get([]byte(key))
+		if err != nil {
+			t.Errorf("Expected to read %s from the merged segment but got %v", key, err)
+		}
+	}
+}
+
+func TestReopenWithTornWrite(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "data")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	segment, err := NewSegment(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = segment.Put([]byte("keyA"), []byte("valueA"))
+	if err != nil {
+		t.Error(err)
+	}
+	// An interrupted write, without the index saved on close
+	segment.DataFile.Write([]byte{0x4, 0x0, 0x0})
+	segment.DataFile.Close()
+
+	segment, err = NewSegment(tempDir)
+	if err != nil {
+		t.Fatalf("Expected a torn write to be recovered: %v", err)
+	}
+	defer segment.Close()
+
+	if segment.SSTable.Dropped != 3 {
+		t.Errorf("Unexpected dropped bytes.\nExpected: %v\nGot:      %v", 3, segment.SSTable.Dropped)
+	}
+	value, err := segment.Get([]byte("keyA"))
+	if err != nil || bytes.Compare(value, []byte("valueA")) != 0 {
+		t.Errorf("Expected to keep the records before the torn write but got '%s' (%v)", value, err)
+	}
+}
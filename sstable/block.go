@@ -0,0 +1,892 @@
+package sstable
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"sort"
+	"sync"
+)
+
+// BlockTable is an sstable grouping its records into blocks, so that the index
+// keeps a few bytes per block instead of an entry per key, and reads fetch a
+// whole block at once.
+//
+// Records keep their insert order, so any key may be in any block: each block
+// is indexed with its offset, first key, key range and a bloom filter, and Get
+// only reads the newest blocks that may hold the key. While the key ranges of
+// the blocks follow each other, as when keys are written in order, the block
+// holding a key is found by binary search. A block is sealed with a trailer
+// once its records reach the block size. The records written since form the
+// open block, which is also kept in memory.
+//
+// SaveIndex writes the index of the sealed blocks, so that opening the table
+// with it only reads the open block.
+//
+// Like SSTable, it is safe for concurrent use: reads only hold the lock to
+// take a view of the index, and read blocks with ReadAt when the data file
+// supports it.
+//
+// Block format:
+//
+//	record | record | ... | count - crc32c
+type BlockTable struct {
+	Data    io.ReadWriteSeeker
+	Header  Header
+	Options BlockOptions
+	// Dropped is the size of the torn tail cut off the data file when the
+	// table was opened.
+	Dropped int64
+
+	lock   sync.RWMutex
+	blocks []blockInfo
+	// ordered is whether every block holds greater keys than the previous one
+	ordered bool
+	open    openBlock
+	// size is the offset where the next record is written
+	size int64
+}
+
+type BlockOptions struct {
+	// BlockSize is the size records must reach to seal a block, a power of
+	// two between MinBlockSize and MaxBlockSize. Existing tables use the size
+	// stored in their header.
+	BlockSize int
+	Limits    Limits
+	// Codec compresses the values written, nil stores them as is.
+	Codec Codec
+	// Strict refuses to open a data file ending with a torn record, left by
+	// an interrupted write, instead of cutting it off.
+	Strict bool
+}
+
+const (
+	DefaultBlockSize = 16 << 10
+	MinBlockSize     = 1 << 9
+	MaxBlockSize     = 1 << 20
+
+	// FlagBlocks marks the header of a block table data file. The log2 of the
+	// block size is stored in the high byte of the flags.
+	FlagBlocks = uint16(1)
+
+	blockTrailerSize = 8
+)
+
+var (
+	ErrBlockSize     = errors.New("sstable: block size out of bounds")
+	ErrBlockChecksum = errors.New("sstable: block checksum mismatch")
+	ErrBlockTable    = errors.New("sstable: data file is a block table")
+	ErrNotBlockTable = errors.New("sstable: data file is not a block table")
+	ErrBlockCipher   = errors.New("sstable: block tables don't hold encrypted records")
+)
+
+// blockInfo is the index entry of a sealed block.
+type blockInfo struct {
+	offset int64
+	length int64
+	count  uint32
+	first  []byte
+	min    []byte
+	max    []byte
+	filter *BloomFilter
+}
+
+func (b blockInfo) mayContain(key []byte) bool {
+	return bytes.Compare(key, b.min) >= 0 && bytes.Compare(key, b.max) <= 0 && b.filter.MayContain(key)
+}
+
+type openBlock struct {
+	offset  int64
+	entries []DataEntry
+	size    int64
+	crc     uint32
+}
+
+// OpenBlockTable loads the block table stored in data, or creates an empty one
+// if data is empty.
+func OpenBlockTable(data io.ReadWriteSeeker, options BlockOptions) (*BlockTable, error) {
+	t, empty, err := openBlockHeader(data, options)
+	if err != nil || empty {
+		return t, err
+	}
+
+	return t, t.load(HeaderSize)
+}
+
+// openBlockHeader reads the header of a block table, and reports whether data
+// was empty, the table being created then.
+func openBlockHeader(data io.ReadWriteSeeker, options BlockOptions) (*BlockTable, bool, error) {
+	if options.BlockSize == 0 {
+		options.BlockSize = DefaultBlockSize
+	}
+	shift := blockShift(options.BlockSize)
+	if shift < 0 {
+		return nil, false, ErrBlockSize
+	}
+
+	t := &BlockTable{
+		Data:    data,
+		Options: options,
+		ordered: true,
+	}
+
+	_, err := data.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, false, err
+	}
+	header, err := ReadHeader(data)
+	if err == io.EOF {
+		return t, true, t.create(uint16(shift))
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if header.Flags&FlagBlocks == 0 {
+		return nil, false, ErrNotBlockTable
+	}
+
+	t.Header = header
+	t.Options.BlockSize = 1 << (header.Flags >> 8)
+	if blockShift(t.Options.BlockSize) < 0 {
+		return nil, false, ErrBlockSize
+	}
+
+	return t, false, nil
+}
+
+// blockShift returns the log2 of a valid block size, -1 otherwise.
+func blockShift(size int) int {
+	for shift := 0; 1<<uint(shift) <= MaxBlockSize; shift++ {
+		if 1<<uint(shift) == size && size >= MinBlockSize {
+			return shift
+		}
+	}
+	return -1
+}
+
+func (t *BlockTable) create(shift uint16) error {
+	t.Header = NewHeader()
+	t.Header.Flags = FlagBlocks | shift<<8
+
+	_, err := t.Data.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	err = t.Header.Write(t.Data)
+	if err != nil {
+		return err
+	}
+
+	t.size = HeaderSize
+	t.open.offset = t.size
+	return nil
+}
+
+// load indexes the blocks stored from offset, checking their trailers, and
+// reads the records of the open block. A torn tail is cut off.
+func (t *BlockTable) load(offset int64) error {
+	t.size = offset
+	t.open.offset = t.size
+	_, err := t.Data.Seek(t.size, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	// Records are checksummed in their blocks as read
+	data := &teeReadSeeker{ReadSeeker: t.Data}
+	for {
+		data.read = data.read[:0]
+		entry, err := ReadDataEntryLimits(data, t.Header.Version, t.Options.Limits)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			end, _ := t.Data.Seek(0, io.SeekCurrent)
+			t.Dropped, err = truncateTail(t.Data, t.Options.Strict, entry.Offset, end, err, t.recordFollows)
+			return err
+		}
+
+		t.addOpen(entry, data.read)
+		if t.open.size < int64(t.Options.BlockSize) {
+			continue
+		}
+
+		var trailer [blockTrailerSize]byte
+		n, err := io.ReadFull(t.Data, trailer[:])
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// Interrupted before the trailer was written
+			return t.reseal(t.size+int64(n), io.ErrUnexpectedEOF)
+		}
+		if err != nil {
+			return err
+		}
+
+		if binary.LittleEndian.Uint32(trailer[:]) != uint32(len(t.open.entries)) || binary.LittleEndian.Uint32(trailer[4:]) != t.open.crc {
+			// Records passed their own checksum, a trailer ending the file
+			// was torn
+			return t.reseal(t.size+blockTrailerSize, DecodeError{Offset: t.open.offset, Err: ErrBlockChecksum})
+		}
+		t.closeOpen()
+	}
+}
+
+// recordFollows reports whether a record starts after offset in the first
+// size bytes of the data file.
+func (t *BlockTable) recordFollows(offset, size int64) bool {
+	return recordFollows(t.readerAt(), offset, size, func(r io.ReadSeeker) error {
+		_, err := ReadDataEntryLimits(r, t.Header.Version, t.Options.Limits)
+		return err
+	})
+}
+
+// reseal cuts off the trailer of the open block, torn when reading it failed
+// at end, and writes it again.
+func (t *BlockTable) reseal(end int64, cause error) error {
+	var err error
+	t.Dropped, err = truncateTail(t.Data, t.Options.Strict, t.size, end, cause, nil)
+	if err != nil {
+		return err
+	}
+
+	return t.seal()
+}
+
+func (t *BlockTable) Put(key, value []byte) error {
+	return t.write(NewDataEntry(key, value))
+}
+
+// Delete appends a tombstone for key: Get reports it as not found from then on.
+func (t *BlockTable) Delete(key []byte) error {
+	return t.write(NewTombstone(key))
+}
+
+func (t *BlockTable) write(entry DataEntry) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.append(entry)
+}
+
+// append writes entry at the end of the data file and adds it to the open
+// block. The caller holds the lock.
+func (t *BlockTable) append(entry DataEntry) error {
+	limits := t.Options.Limits.orDefault()
+	err := limits.checkKey(int64(len(entry.Key)))
+	if err != nil {
+		return err
+	}
+	err = limits.checkData(entry.DataLen)
+	if err != nil {
+		return err
+	}
+
+	// Keep a copy: the open block is read from memory
+	entry.Key = append([]byte{}, entry.Key...)
+	if !entry.IsTombstone() {
+		entry.Data = append([]byte{}, entry.Data...)
+	}
+	entry.Offset = t.size
+	if t.Options.Codec != nil {
+		entry.Codec = t.Options.Codec.ID()
+	}
+
+	record := bytes.NewBuffer(nil)
+	err = entry.WriteVersion(record, t.Header.Version)
+	if err != nil {
+		return err
+	}
+
+	_, err = t.Data.Seek(t.size, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	_, err = t.Data.Write(record.Bytes())
+	if err != nil {
+		return err
+	}
+
+	t.addOpen(entry, record.Bytes())
+	if t.open.size >= int64(t.Options.BlockSize) {
+		return t.seal()
+	}
+
+	return nil
+}
+
+// addOpen adds a record written at the end of the data file to the open block.
+func (t *BlockTable) addOpen(entry DataEntry, record []byte) {
+	t.open.entries = append(t.open.entries, entry)
+	t.open.size += int64(len(record))
+	t.open.crc = crc32.Update(t.open.crc, castagnoli, record)
+	t.size += int64(len(record))
+}
+
+// teeReadSeeker keeps a copy of the bytes read.
+type teeReadSeeker struct {
+	io.ReadSeeker
+	read []byte
+}
+
+func (r *teeReadSeeker) Read(p []byte) (int, error) {
+	n, err := r.ReadSeeker.Read(p)
+	r.read = append(r.read, p[:n]...)
+	return n, err
+}
+
+// seal writes the trailer of the open block.
+func (t *BlockTable) seal() error {
+	var trailer [blockTrailerSize]byte
+	binary.LittleEndian.PutUint32(trailer[:], uint32(len(t.open.entries)))
+	binary.LittleEndian.PutUint32(trailer[4:], t.open.crc)
+
+	_, err := t.Data.Seek(t.size, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	_, err = t.Data.Write(trailer[:])
+	if err != nil {
+		return err
+	}
+
+	t.closeOpen()
+	return nil
+}
+
+// closeOpen indexes the open block, whose trailer follows its records, and
+// starts a new one.
+func (t *BlockTable) closeOpen() {
+	info := blockInfo{
+		offset: t.open.offset,
+		length: t.open.size + blockTrailerSize,
+		count:  uint32(len(t.open.entries)),
+		first:  t.open.entries[0].Key,
+		min:    t.open.entries[0].Key,
+		max:    t.open.entries[0].Key,
+		filter: NewBloomFilter(int64(len(t.open.entries)), DefaultFalsePositive),
+	}
+	for _, entry := range t.open.entries {
+		if bytes.Compare(entry.Key, info.min) < 0 {
+			info.min = entry.Key
+		}
+		if bytes.Compare(entry.Key, info.max) > 0 {
+			info.max = entry.Key
+		}
+		info.filter.Add(entry.Key)
+	}
+
+	t.addBlock(info)
+	t.size += blockTrailerSize
+	t.open = openBlock{offset: t.size}
+}
+
+// addBlock indexes a sealed block, written after the others.
+func (t *BlockTable) addBlock(info blockInfo) {
+	if len(t.blocks) > 0 && bytes.Compare(info.min, t.blocks[len(t.blocks)-1].max) <= 0 {
+		t.ordered = false
+	}
+	t.blocks = append(t.blocks, info)
+}
+
+// blockView is the index of a table at one point in time. Sealed blocks are
+// never rewritten and the open block only grows until it is sealed, so a view
+// stays valid while records are appended after it.
+type blockView struct {
+	blocks  []blockInfo
+	ordered bool
+	open    []DataEntry
+}
+
+// view returns the current index, to read the table without holding its lock.
+func (t *BlockTable) view() blockView {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	return blockView{blocks: t.blocks, ordered: t.ordered, open: t.open.entries}
+}
+
+// readerAt returns the data file as an io.ReaderAt, like *os.File. Other data
+// files are read through their cursor, and can't be read concurrently then.
+func (t *BlockTable) readerAt() io.ReaderAt {
+	if r, ok := t.Data.(io.ReaderAt); ok {
+		return r
+	}
+	return seekReaderAt{t.Data}
+}
+
+// readBlock reads the records of a sealed block.
+func (t *BlockTable) readBlock(info blockInfo) ([]DataEntry, error) {
+	buff := make([]byte, info.length)
+	n, err := t.readerAt().ReadAt(buff, info.offset)
+	if n == len(buff) {
+		err = nil
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, DecodeError{Offset: info.offset, Err: err}
+	}
+
+	records := buff[:len(buff)-blockTrailerSize]
+	trailer := buff[len(records):]
+	if binary.LittleEndian.Uint32(trailer) != info.count || binary.LittleEndian.Uint32(trailer[4:]) != crc32.Checksum(records, castagnoli) {
+		return nil, DecodeError{Offset: info.offset, Err: ErrBlockChecksum}
+	}
+
+	entries := make([]DataEntry, 0, info.count)
+	reader := bytes.NewReader(records)
+	for {
+		entry, err := ReadDataEntryLimits(reader, t.Header.Version, t.Options.Limits)
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			if decodeErr, ok := err.(DecodeError); ok {
+				decodeErr.Offset += info.offset
+				err = decodeErr
+			}
+			return nil, err
+		}
+
+		entry.Offset += info.offset
+		entries = append(entries, entry)
+	}
+}
+
+// last returns the last record of key.
+func (t *BlockTable) last(key []byte) (DataEntry, error) {
+	v := t.view()
+	for i := len(v.open) - 1; i >= 0; i-- {
+		if bytes.Equal(v.open[i].Key, key) {
+			return v.open[i], nil
+		}
+	}
+
+	for _, i := range v.candidates(key) {
+		entries, err := t.readBlock(v.blocks[i])
+		if err != nil {
+			return DataEntry{}, err
+		}
+		for j := len(entries) - 1; j >= 0; j-- {
+			if bytes.Equal(entries[j].Key, key) {
+				return entries[j], nil
+			}
+		}
+	}
+
+	return DataEntry{}, NotFoundError{Key: key}
+}
+
+// candidates returns the sealed blocks that may hold key, newest first. Only
+// the block whose key range holds key can when ranges are ordered.
+func (v blockView) candidates(key []byte) []int {
+	if v.ordered {
+		i := sort.Search(len(v.blocks), func(i int) bool {
+			return bytes.Compare(v.blocks[i].max, key) >= 0
+		})
+		if i < len(v.blocks) && v.blocks[i].mayContain(key) {
+			return []int{i}
+		}
+		return nil
+	}
+
+	var blocks []int
+	for i := len(v.blocks) - 1; i >= 0; i-- {
+		if v.blocks[i].mayContain(key) {
+			blocks = append(blocks, i)
+		}
+	}
+	return blocks
+}
+
+// MayContain returns false when key is not in the table. Otherwise it most
+// likely is, but only a lookup tells.
+func (t *BlockTable) MayContain(key []byte) bool {
+	v := t.view()
+	for _, entry := range v.open {
+		if bytes.Equal(entry.Key, key) {
+			return true
+		}
+	}
+
+	return len(v.candidates(key)) > 0
+}
+
+func (t *BlockTable) Get(key []byte) ([]byte, error) {
+	entry, err := t.last(key)
+	if err != nil {
+		return nil, err
+	}
+	if entry.IsTombstone() {
+		return nil, NotFoundError{Key: key, Deleted: true}
+	}
+
+	return entry.Data, nil
+}
+
+// Has reports whether key is in the table and was not deleted.
+func (t *BlockTable) Has(key []byte) (bool, error) {
+	_, err := t.Get(key)
+	if _, ok := err.(NotFoundError); ok {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// Scan calls fn for every entry written since the last version of from, in
+// insert order. Only the last version of a key is yielded, and none for
+// deleted keys.
+func (t *BlockTable) Scan(from []byte, fn func(key, data []byte)) error {
+	entry, err := t.last(from)
+	if err != nil {
+		return err
+	}
+
+	return t.scanLive(entry.Offset, fn)
+}
+
+func (t *BlockTable) ScanAll(fn func(key, data []byte)) error {
+	return t.scanLive(0, fn)
+}
+
+// scanLive calls fn for the entries from offset which are the last version of
+// their key, and not a deletion.
+func (t *BlockTable) scanLive(offset int64, fn func(key, data []byte)) error {
+	return t.scanLast(t.view(), offset, func(entry DataEntry) {
+		if !entry.IsTombstone() {
+			fn(entry.Key, entry.Data)
+		}
+	})
+}
+
+// scanLast calls fn, in insert order, for the entries of v from offset which
+// are the last version of their key. Blocks are read one at a time: an entry
+// is the last version when no later entry of its block, of the open block or
+// of a newer block whose key range and filter may hold the key has the same
+// key. Only the keys of a block are kept, so that memory doesn't grow with
+// the table.
+func (t *BlockTable) scanLast(v blockView, offset int64, fn func(entry DataEntry)) error {
+	open := lastPositions(v.open)
+	newer := newerBlocks{table: t, view: v, read: -1}
+
+	for i, info := range v.blocks {
+		if info.offset+info.length <= offset {
+			continue
+		}
+
+		entries, err := t.readBlock(info)
+		if err != nil {
+			return err
+		}
+		last := lastPositions(entries)
+		for j, entry := range entries {
+			if entry.Offset < offset || last[string(entry.Key)] != j {
+				continue
+			}
+			if _, ok := open[string(entry.Key)]; ok {
+				continue
+			}
+
+			superseded, err := newer.hold(i, entry.Key)
+			if err != nil {
+				return err
+			}
+			if !superseded {
+				fn(entry)
+			}
+		}
+	}
+
+	for j, entry := range v.open {
+		if entry.Offset >= offset && open[string(entry.Key)] == j {
+			fn(entry)
+		}
+	}
+
+	return nil
+}
+
+// lastPositions maps the keys of entries to the position of their last one.
+func lastPositions(entries []DataEntry) map[string]int {
+	last := make(map[string]int, len(entries))
+	for j, entry := range entries {
+		last[string(entry.Key)] = j
+	}
+	return last
+}
+
+// newerBlocks tells whether blocks written after a given one hold a key. The
+// keys of the last block read are kept, as consecutive keys are often found
+// in the same block.
+type newerBlocks struct {
+	table *BlockTable
+	view  blockView
+	read  int
+	keys  map[string]int
+}
+
+// hold reports whether a sealed block written after block i holds key.
+func (n *newerBlocks) hold(i int, key []byte) (bool, error) {
+	for _, j := range n.view.candidates(key) {
+		if j <= i {
+			// Candidates are newest first
+			return false, nil
+		}
+
+		if j != n.read {
+			entries, err := n.table.readBlock(n.view.blocks[j])
+			if err != nil {
+				return false, err
+			}
+			n.read, n.keys = j, lastPositions(entries)
+		}
+		if _, ok := n.keys[string(key)]; ok {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Merge appends the last version of every key of newer, tombstones included,
+// in insert order. Older versions are left behind.
+func (t *BlockTable) Merge(newer SSTable) error {
+	if newer.header().Flags&FlagEncrypted != 0 {
+		return ErrBlockCipher
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	var appendErr error
+	err := newer.ScanAllEntries(func(entry DataEntry) {
+		if appendErr == nil && newer.last(entry) {
+			appendErr = t.append(entry)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	return appendErr
+}
+
+// Compact copies the last version of every key to the empty data file,
+// tombstones included as they still hide the versions stored in older tables,
+// and returns the table it makes. Records appended meanwhile are left out.
+func (t *BlockTable) Compact(data io.ReadWriteSeeker) (*BlockTable, error) {
+	compacted, err := OpenBlockTable(data, t.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	var appendErr error
+	err = t.scanLast(t.view(), 0, func(entry DataEntry) {
+		if appendErr == nil {
+			appendErr = compacted.append(entry)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return compacted, appendErr
+}
+
+// Size returns the number of records, every version of a key counting: only
+// blocks are indexed.
+func (t *BlockTable) Size() int64 {
+	v := t.view()
+	size := int64(len(v.open))
+	for _, info := range v.blocks {
+		size += int64(info.count)
+	}
+	return size
+}
+
+// Blocks returns the number of sealed blocks.
+func (t *BlockTable) Blocks() int {
+	return len(t.view().blocks)
+}
+
+// FirstKeys returns the first key of every sealed block, in insert order.
+func (t *BlockTable) FirstKeys() [][]byte {
+	v := t.view()
+	keys := make([][]byte, 0, len(v.blocks))
+	for _, info := range v.blocks {
+		keys = append(keys, info.first)
+	}
+	return keys
+}
+
+// Block index format:
+//
+//	magic - version - flags - created - covered - crc32c | count | block | ... | crc32c
+//	block: offset - length - count - key-size - first - key-size - min - key-size - max - filter
+//
+// The header is the one of sstable index files, flagged as a block list, and
+// covered is the offset of the open block. The last CRC32C covers the block
+// list, filters included.
+
+// SaveIndex writes the index of the sealed blocks to w, so that
+// OpenBlockTableIndexed only reads the open block.
+func (t *BlockTable) SaveIndex(w io.Writer) error {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	header := indexHeader{flags: indexBlocks, created: t.Header.Created.UnixNano(), covered: t.open.offset}
+	err := header.write(w)
+	if err != nil {
+		return err
+	}
+
+	crc := crc32.New(castagnoli)
+	w = io.MultiWriter(w, crc)
+
+	_, err = w.Write(appendUint32(nil, uint32(len(t.blocks))))
+	if err != nil {
+		return err
+	}
+	for _, info := range t.blocks {
+		buff := appendUint64(nil, uint64(info.offset))
+		buff = appendUint64(buff, uint64(info.length))
+		buff = appendUint32(buff, info.count)
+		for _, key := range [][]byte{info.first, info.min, info.max} {
+			buff = appendUint32(buff, uint32(len(key)))
+			buff = append(buff, key...)
+		}
+
+		_, err = w.Write(buff)
+		if err != nil {
+			return err
+		}
+		_, err = info.filter.WriteTo(w)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = w.Write(appendUint32(nil, crc.Sum32()))
+	return err
+}
+
+// OpenBlockTableIndexed opens a block table from an index written by
+// SaveIndex, then reads the blocks written since. Like LoadIndexed, indexes
+// saved from another data file are rejected with ErrForeignIndex, and those
+// covering more than the data file with a StaleIndexError.
+func OpenBlockTableIndexed(data io.ReadWriteSeeker, index io.Reader, options BlockOptions) (*BlockTable, error) {
+	saved, err := readIndexHeader(index)
+	if err != nil {
+		return nil, err
+	}
+	if saved.flags != indexBlocks {
+		return nil, ErrInvalidIndex
+	}
+
+	size, err := data.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if saved.covered > size {
+		return nil, StaleIndexError{Covered: saved.covered, Size: size}
+	}
+
+	t, empty, err := openBlockHeader(data, options)
+	if err != nil {
+		return nil, err
+	}
+	if empty {
+		return t, nil
+	}
+	if saved.created != t.Header.Created.UnixNano() {
+		return nil, ErrForeignIndex
+	}
+
+	blocks, err := t.readBlockIndex(index)
+	if err != nil {
+		return nil, err
+	}
+
+	// Blocks follow each other from the header to the open block
+	end := int64(HeaderSize)
+	for _, info := range blocks {
+		if info.offset != end {
+			return nil, ErrInvalidIndex
+		}
+		end += info.length
+		t.addBlock(info)
+	}
+	if end != saved.covered {
+		return nil, ErrInvalidIndex
+	}
+
+	return t, t.load(saved.covered)
+}
+
+// readBlockIndex reads the block list of an index, its keys within the limits
+// of the table.
+func (t *BlockTable) readBlockIndex(index io.Reader) ([]blockInfo, error) {
+	crc := crc32.New(castagnoli)
+	r := io.TeeReader(index, crc)
+	limits := t.Options.Limits.orDefault()
+
+	buff := make([]byte, 8+8+4)
+	_, err := io.ReadFull(r, buff[:4])
+	if err != nil {
+		return nil, err
+	}
+	count := binary.LittleEndian.Uint32(buff)
+
+	var blocks []blockInfo
+	for i := uint32(0); i < count; i++ {
+		_, err = io.ReadFull(r, buff)
+		if err != nil {
+			return nil, err
+		}
+		info := blockInfo{
+			offset: int64(binary.LittleEndian.Uint64(buff)),
+			length: int64(binary.LittleEndian.Uint64(buff[8:])),
+			count:  binary.LittleEndian.Uint32(buff[16:]),
+		}
+
+		keys := make([][]byte, 3)
+		for k := range keys {
+			_, err = io.ReadFull(r, buff[:4])
+			if err != nil {
+				return nil, err
+			}
+			size := int64(binary.LittleEndian.Uint32(buff))
+			err = limits.checkKey(size)
+			if err != nil {
+				return nil, err
+			}
+
+			keys[k] = make([]byte, size)
+			_, err = io.ReadFull(r, keys[k])
+			if err != nil {
+				return nil, err
+			}
+		}
+		info.first, info.min, info.max = keys[0], keys[1], keys[2]
+
+		info.filter, err = ReadBloomFilter(r)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, info)
+	}
+
+	sum := crc.Sum32()
+	_, err = io.ReadFull(index, buff[:4])
+	if err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(buff) != sum {
+		return nil, ErrIndexChecksum
+	}
+
+	return blocks, nil
+}
@@ -0,0 +1,497 @@
+package sstable
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestBlockTable(t *testing.T) {
+	table, teardown, err := GenerateBlockTable(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+
+	if table.Blocks() < 2 {
+		t.Errorf("Expected records to span several blocks but got %d", table.Blocks())
+	}
+	if len(table.FirstKeys()) != table.Blocks() || string(table.FirstKeys()[0]) != "key000" {
+		t.Errorf("Expected the first block to start with key000 but got %s", table.FirstKeys())
+	}
+
+	err = table.Put([]byte("key042"), []byte("again"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = table.Delete([]byte("key007"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := OpenBlockTable(table.Data, BlockOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.Options.BlockSize != MinBlockSize {
+		t.Errorf("Expected the block size to be read from the header.\nExpected: %v\nGot:      %v", MinBlockSize, reopened.Options.BlockSize)
+	}
+
+	for _, opened := range []*BlockTable{table, reopened} {
+		tt := []struct {
+			Key   string
+			Value string
+			Err   error
+		}{
+			{"key000", "value000", nil},
+			{"key042", "again", nil},
+			{"key099", "value099", nil},
+			{"key007", "", NotFoundError{Key: []byte("key007"), Deleted: true}},
+		}
+		for _, example := range tt {
+			value, err := opened.Get([]byte(example.Key))
+			if !reflect.DeepEqual(err, example.Err) || string(value) != example.Value {
+				t.Errorf("Expected to find '%s' at key '%s' but found '%s' (%v)", example.Value, example.Key, value, err)
+			}
+		}
+
+		_, err = opened.Get([]byte("absent"))
+		if _, ok := err.(NotFoundError); !ok {
+			t.Errorf("Expected an absent key not to be found but got %v", err)
+		}
+	}
+}
+
+func TestBlockTableScan(t *testing.T) {
+	table, teardown, err := GenerateBlockTable(50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+
+	err = table.Delete([]byte("key049"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []string{}
+	err = table.Scan([]byte("key045"), func(key, data []byte) {
+		keys = append(keys, string(key))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"key045", "key046", "key047", "key048"}
+	if !reflect.DeepEqual(expected, keys) {
+		t.Errorf("Expected to scan in insert order, without the deleted key.\nExpected: %v\nGot:      %v", expected, keys)
+	}
+
+	count := 0
+	err = table.ScanAll(func(key, data []byte) {
+		if string(key) != fmt.Sprintf("key%03d", count) {
+			t.Errorf("Expected to scan in insert order.\nExpected: key%03d\nGot:      %s", count, key)
+		}
+		count++
+	})
+	if err != nil || count != 49 {
+		t.Errorf("Expected to scan every live record.\nExpected: %v\nGot:      %v (%v)", 49, count, err)
+	}
+}
+
+func TestBlockTableTornWrite(t *testing.T) {
+	table, teardown, err := GenerateBlockTable(30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+
+	table.Data.Seek(0, io.SeekEnd)
+	table.Data.Write([]byte{0x6, 0x0, 0x0})
+
+	reopened, err := OpenBlockTable(table.Data, BlockOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = reopened.Put([]byte("key030"), []byte("value030"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err = OpenBlockTable(table.Data, BlockOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"key000", "key029", "key030"} {
+		_, err := reopened.Get([]byte(key))
+		if err != nil {
+			t.Errorf("Expected to find %s after recovering a torn write: %v", key, err)
+		}
+	}
+}
+
+func TestBlockTableCorrupted(t *testing.T) {
+	table, teardown, err := GenerateBlockTable(30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+
+	// Flip a bit in the data of the first record
+	table.Data.Seek(HeaderSize+16+6, io.SeekStart)
+	table.Data.Write([]byte("V"))
+
+	_, err = table.Get([]byte("key000"))
+	if decodeErr, ok := err.(DecodeError); !ok || decodeErr.Err != ErrBlockChecksum {
+		t.Errorf("Expected a corrupted block to be reported but got %v", err)
+	}
+
+	_, err = OpenBlockTable(table.Data, BlockOptions{})
+	if err == nil {
+		t.Errorf("Expected a corrupted block to be reported when opening the table")
+	}
+}
+
+func TestBlockTableFormat(t *testing.T) {
+	table, teardown, err := GenerateBlockTable(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+
+	_, err = Load(table.Data)
+	if err != ErrBlockTable {
+		t.Errorf("Expected a block table not to load as an sstable.\nExpected: %v\nGot:      %v", ErrBlockTable, err)
+	}
+
+	sstable, teardown, err := GenerateTable(`FOO | foo`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+
+	_, err = OpenBlockTable(sstable.Data, BlockOptions{})
+	if err != ErrNotBlockTable {
+		t.Errorf("Expected an sstable not to open as a block table.\nExpected: %v\nGot:      %v", ErrNotBlockTable, err)
+	}
+
+	_, err = OpenBlockTable(sstable.Data, BlockOptions{BlockSize: 1000})
+	if err != ErrBlockSize {
+		t.Errorf("Expected block sizes to be powers of two.\nExpected: %v\nGot:      %v", ErrBlockSize, err)
+	}
+}
+
+func TestBlockTableTornTail(t *testing.T) {
+	// Blocks of the smallest size hold 15 records of 35 bytes, the last byte
+	// of the file is corrupted unless a tail is appended
+	tt := []struct {
+		Name    string
+		Records int
+		Tail    []byte
+		Dropped int64
+	}{
+		// The last record of the open block fails its checksum
+		{"record", 26, nil, 35},
+		// The trailer of the last block, ending the file, doesn't match it
+		{"trailer", 30, nil, blockTrailerSize},
+		// Zeros left by the file system past an interrupted write
+		{"zero-filled tail", 26, make([]byte, 64), 64},
+	}
+
+	for _, example := range tt {
+		table, teardown, err := GenerateBlockTable(example.Records)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer teardown()
+
+		size, _ := table.Data.Seek(0, io.SeekEnd)
+		if example.Tail != nil {
+			table.Data.Write(example.Tail)
+		} else {
+			table.Data.Seek(size-1, io.SeekStart)
+			table.Data.Write([]byte{0xff})
+		}
+
+		_, err = OpenBlockTable(table.Data, BlockOptions{Strict: true})
+		if _, ok := err.(TornWriteError); !ok {
+			t.Errorf("Expected a torn %s to be refused when strict but got %v", example.Name, err)
+		}
+
+		reopened, err := OpenBlockTable(table.Data, BlockOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reopened.Dropped != example.Dropped {
+			t.Errorf("Unexpected size cut off a torn %s.\nExpected: %v\nGot:      %v", example.Name, example.Dropped, reopened.Dropped)
+		}
+
+		reopened, err = OpenBlockTable(table.Data, BlockOptions{})
+		if err != nil || reopened.Dropped != 0 {
+			t.Errorf("Expected a table cut off its torn %s to open cleanly but got %v, %v", example.Name, reopened.Dropped, err)
+		}
+	}
+}
+
+func TestBlockTableIndex(t *testing.T) {
+	table, teardown, err := GenerateBlockTable(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+
+	index := bytes.NewBufferString("")
+	err = table.SaveIndex(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Written after the index was saved, must be read
+	for i := 100; i < 150; i++ {
+		table.Put([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%03d", i)))
+	}
+
+	loaded, err := OpenBlockTableIndexed(table.Data, bytes.NewReader(index.Bytes()), BlockOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Blocks() != table.Blocks() || !reflect.DeepEqual(loaded.FirstKeys(), table.FirstKeys()) {
+		t.Errorf("Unexpected blocks loaded from the index.\nExpected: %s\nGot:      %s", table.FirstKeys(), loaded.FirstKeys())
+	}
+	for _, key := range []string{"key000", "key099", "key149"} {
+		_, err := loaded.Get([]byte(key))
+		if err != nil {
+			t.Errorf("Expected to find %s in a table opened from its index: %v", key, err)
+		}
+	}
+
+	other, teardownOther, err := GenerateBlockTable(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardownOther()
+	other.Put(bytes.Repeat([]byte("k"), 10*MinBlockSize), []byte("value"))
+
+	_, err = OpenBlockTableIndexed(other.Data, bytes.NewReader(index.Bytes()), BlockOptions{})
+	if err != ErrForeignIndex {
+		t.Errorf("Unexpected error loading the index of another data file.\nExpected: %v\nGot:      %v", ErrForeignIndex, err)
+	}
+
+	corrupted := append([]byte{}, index.Bytes()...)
+	corrupted[indexHeaderSize+8] ^= 0xff
+	_, err = OpenBlockTableIndexed(table.Data, bytes.NewReader(corrupted), BlockOptions{})
+	if err != ErrIndexChecksum {
+		t.Errorf("Unexpected error loading a corrupted index.\nExpected: %v\nGot:      %v", ErrIndexChecksum, err)
+	}
+
+	_, err = LoadIndexed(table.Data, bytes.NewReader(index.Bytes()))
+	if err != ErrInvalidIndex {
+		t.Errorf("Unexpected error loading a block index as an sstable one.\nExpected: %v\nGot:      %v", ErrInvalidIndex, err)
+	}
+}
+
+func TestBlockTableUnordered(t *testing.T) {
+	table, teardown, err := GenerateBlockTable(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+
+	random := rand.New(rand.NewSource(42))
+	for _, i := range random.Perm(100) {
+		table.Put([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%03d", i)))
+	}
+	if table.ordered {
+		t.Errorf("Expected blocks of keys written out of order not to be ordered")
+	}
+
+	for i := 0; i < 100; i++ {
+		value, err := table.Get([]byte(fmt.Sprintf("key%03d", i)))
+		if err != nil || string(value) != fmt.Sprintf("value%03d", i) {
+			t.Errorf("Expected to find 'value%03d' at key 'key%03d' but found '%s' (%v)", i, i, value, err)
+		}
+	}
+
+	// Newer versions spread over later blocks and the open one
+	expected := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		expected[fmt.Sprintf("key%03d", i)] = fmt.Sprintf("value%03d", i)
+	}
+	for _, i := range random.Perm(100)[:40] {
+		key := fmt.Sprintf("key%03d", i)
+		if i%4 == 0 {
+			table.Delete([]byte(key))
+			delete(expected, key)
+			continue
+		}
+		table.Put([]byte(key), []byte(fmt.Sprintf("again%03d", i)))
+		expected[key] = fmt.Sprintf("again%03d", i)
+	}
+
+	file, err := ioutil.TempFile("", "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	compacted, err := table.Compact(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compacted.Size() != 100 {
+		t.Errorf("Expected the last version of every key to be kept.\nExpected: %v\nGot:      %v", 100, compacted.Size())
+	}
+
+	for _, opened := range []*BlockTable{table, compacted} {
+		scanned := make(map[string]string)
+		err = opened.ScanAll(func(key, data []byte) {
+			if _, ok := scanned[string(key)]; ok {
+				t.Errorf("Expected key '%s' to be scanned once", key)
+			}
+			scanned[string(key)] = string(data)
+		})
+		if err != nil || !reflect.DeepEqual(scanned, expected) {
+			t.Errorf("Expected to scan the last version of every live key but got %d keys (%v)", len(scanned), err)
+		}
+	}
+}
+
+func TestBlockTableConcurrentReads(t *testing.T) {
+	table, teardown, err := GenerateBlockTable(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+
+	// Reads don't move the cursor of the data file
+	table.Data.Seek(0, io.SeekStart)
+	table.Get([]byte("key042"))
+	offset, _ := table.Data.Seek(0, io.SeekCurrent)
+	if offset != 0 {
+		t.Errorf("Expected reads to leave the data file cursor alone.\nExpected: %v\nGot:      %v", 0, offset)
+	}
+
+	errs := make(chan error, 8)
+	var wg sync.WaitGroup
+	for r := 0; r < 8; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				key := fmt.Sprintf("key%03d", i)
+				value, err := table.Get([]byte(key))
+				if err != nil || string(value) != fmt.Sprintf("value%03d", i) {
+					errs <- fmt.Errorf("read '%s' for %s (%v)", value, key, err)
+					return
+				}
+			}
+			errs <- table.ScanAll(func(key, data []byte) {})
+		}()
+	}
+	for i := 100; i < 200; i++ {
+		err := table.Put([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%03d", i)))
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Expected concurrent reads to succeed but %v", err)
+		}
+	}
+	if table.Size() != 200 {
+		t.Errorf("Unexpected table size.\nExpected: %v\nGot:      %v", 200, table.Size())
+	}
+}
+
+func TestBlockTableMerge(t *testing.T) {
+	table, teardown, err := GenerateBlockTable(30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+
+	newer, teardownNewer, err := GenerateTable(`key030 | value030
+	                                            key031 | value031
+	                                            key030 | again`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardownNewer()
+	newer.Delete([]byte("key000"))
+
+	err = table.Merge(newer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.Size() != 33 {
+		t.Errorf("Expected only the last versions to be merged.\nExpected: %v\nGot:      %v", 33, table.Size())
+	}
+
+	file, err := ioutil.TempFile("", "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+
+	compacted, err := table.Compact(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compacted.Size() != 32 {
+		t.Errorf("Expected the last version of every key to be kept.\nExpected: %v\nGot:      %v", 32, compacted.Size())
+	}
+
+	tt := []struct {
+		Key   string
+		Value string
+		Err   error
+	}{
+		{"key001", "value001", nil},
+		{"key030", "again", nil},
+		{"key031", "value031", nil},
+		{"key000", "", NotFoundError{Key: []byte("key000"), Deleted: true}},
+	}
+	for _, opened := range []*BlockTable{table, compacted} {
+		for _, example := range tt {
+			value, err := opened.Get([]byte(example.Key))
+			if !reflect.DeepEqual(err, example.Err) || string(value) != example.Value {
+				t.Errorf("Expected to find '%s' at key '%s' but found '%s' (%v)", example.Value, example.Key, value, err)
+			}
+		}
+	}
+}
+
+// GenerateBlockTable creates a table of the smallest blocks holding n records,
+// from key000 | value000 on.
+func GenerateBlockTable(n int) (*BlockTable, TeardownFunc, error) {
+	file, err := ioutil.TempFile("", "data")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	teardown := func() {
+		os.Remove(file.Name())
+	}
+
+	table, err := OpenBlockTable(file, BlockOptions{BlockSize: MinBlockSize})
+	if err != nil {
+		return nil, teardown, err
+	}
+
+	for i := 0; i < n; i++ {
+		err = table.Put([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%03d", i)))
+		if err != nil {
+			return table, teardown, err
+		}
+	}
+
+	return table, teardown, nil
+}
@@ -0,0 +1,203 @@
+package sstable
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+// BloomFilter answers whether a key may have been added to it. It has no false
+// negatives and a false positive rate set on creation, as long as no more than
+// Capacity keys are added.
+//
+// Filter format:
+//
+//	magic - version - hashes - capacity - count - rate | word | ... | crc32c
+type BloomFilter struct {
+	bits     []uint64
+	hashes   uint32
+	capacity int64
+	count    int64
+	rate     float64
+}
+
+const (
+	DefaultFilterCapacity = 1024
+	DefaultFalsePositive  = 0.01
+)
+
+var filterMagic = [4]byte{'J', 'B', 'L', 'M'}
+
+const filterVersion = uint32(1)
+
+// maxFilterWords bounds the size of a filter read from a file to 1 GiB.
+const maxFilterWords = 1 << 27
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	ErrInvalidFilter  = errors.New("sstable: not a bloom filter")
+	ErrFilterChecksum = errors.New("sstable: bloom filter checksum mismatch")
+)
+
+// NewBloomFilter sizes a filter for capacity keys with the given false
+// positive rate.
+func NewBloomFilter(capacity int64, falsePositive float64) *BloomFilter {
+	if capacity < 1 {
+		capacity = 1
+	}
+
+	words, hashes := filterSize(capacity, falsePositive)
+	return &BloomFilter{
+		bits:     make([]uint64, int(words)),
+		hashes:   hashes,
+		capacity: capacity,
+		rate:     falsePositive,
+	}
+}
+
+// filterSize returns the number of 64 bits words and of hashes of a filter
+// sized for capacity keys with the given false positive rate.
+func filterSize(capacity int64, falsePositive float64) (float64, uint32) {
+	// Optimal sizes: m = -n ln(p) / ln(2)^2 bits and k = m/n ln(2) hashes
+	bits := math.Ceil(-float64(capacity) * math.Log(falsePositive) / (math.Ln2 * math.Ln2))
+	hashes := math.Ceil(bits / float64(capacity) * math.Ln2)
+
+	return math.Ceil(bits / 64), uint32(hashes)
+}
+
+func (f *BloomFilter) Add(key []byte) {
+	h1, h2 := filterHashes(key)
+	m := uint64(len(f.bits)) * 64
+	for i := uint32(0); i < f.hashes; i++ {
+		bit := (uint64(h1) + uint64(i)*uint64(h2)) % m
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+	f.count++
+}
+
+// MayContain returns false when key was never added.
+func (f *BloomFilter) MayContain(key []byte) bool {
+	h1, h2 := filterHashes(key)
+	m := uint64(len(f.bits)) * 64
+	for i := uint32(0); i < f.hashes; i++ {
+		bit := (uint64(h1) + uint64(i)*uint64(h2)) % m
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Full reports whether more keys than the filter was sized for were added,
+// making false positives more likely than requested.
+func (f *BloomFilter) Full() bool {
+	return f.count > f.capacity
+}
+
+func (f *BloomFilter) Capacity() int64 {
+	return f.capacity
+}
+
+// filterHashes derives the two hashes combined into the k filter hashes, as
+// described by Kirsch and Mitzenmacher.
+func filterHashes(key []byte) (uint32, uint32) {
+	h := fnv.New64a()
+	h.Write(key)
+	sum := h.Sum64()
+
+	// FNV alone spreads similar keys poorly, finish with the murmur3 mixer
+	sum ^= sum >> 33
+	sum *= 0xff51afd7ed558ccd
+	sum ^= sum >> 33
+	sum *= 0xc4ceb9fe1a85ec53
+	sum ^= sum >> 33
+
+	return uint32(sum), uint32(sum>>32) | 1
+}
+
+func (f *BloomFilter) WriteTo(w io.Writer) (int64, error) {
+	buff := make([]byte, 0, 4+4+4+8+8+8+8*len(f.bits)+4)
+	buff = append(buff, filterMagic[:]...)
+	buff = appendUint32(buff, filterVersion)
+	buff = appendUint32(buff, f.hashes)
+	buff = appendUint64(buff, uint64(f.capacity))
+	buff = appendUint64(buff, uint64(f.count))
+	buff = appendUint64(buff, math.Float64bits(f.rate))
+	for _, word := range f.bits {
+		buff = appendUint64(buff, word)
+	}
+	buff = appendUint32(buff, crc32.Checksum(buff, castagnoli))
+
+	n, err := w.Write(buff)
+	return int64(n), err
+}
+
+// ReadBloomFilter reads a filter written by WriteTo.
+func ReadBloomFilter(r io.Reader) (*BloomFilter, error) {
+	header := make([]byte, 4+4+4+8+8+8)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+
+	if string(header[:4]) != string(filterMagic[:]) || binary.LittleEndian.Uint32(header[4:]) != filterVersion {
+		return nil, ErrInvalidFilter
+	}
+
+	f := &BloomFilter{
+		hashes:   binary.LittleEndian.Uint32(header[8:]),
+		capacity: int64(binary.LittleEndian.Uint64(header[12:])),
+		count:    int64(binary.LittleEndian.Uint64(header[20:])),
+		rate:     math.Float64frombits(binary.LittleEndian.Uint64(header[28:])),
+	}
+	if f.capacity < 1 || f.rate <= 0 || f.rate >= 1 {
+		return nil, ErrInvalidFilter
+	}
+
+	// The number of words follows from the capacity and rate. They come from
+	// a file not checked yet, so nothing is allocated for them before the
+	// body has been read and its checksum verified: a corrupted capacity
+	// must not crash the open nor reserve gigabytes for a few bytes of data.
+	words, hashes := filterSize(f.capacity, f.rate)
+	if hashes != f.hashes || words > maxFilterWords {
+		return nil, ErrInvalidFilter
+	}
+
+	size := 8*int64(words) + 4
+	body, err := ioutil.ReadAll(io.LimitReader(r, size))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) < size {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	sum := crc32.Update(crc32.Checksum(header, castagnoli), castagnoli, body[:len(body)-4])
+	if sum != binary.LittleEndian.Uint32(body[len(body)-4:]) {
+		return nil, ErrFilterChecksum
+	}
+
+	f.bits = make([]uint64, int(words))
+	for i := range f.bits {
+		f.bits[i] = binary.LittleEndian.Uint64(body[8*i:])
+	}
+
+	return f, nil
+}
+
+func appendUint32(buff []byte, v uint32) []byte {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	return append(buff, b[:]...)
+}
+
+func appendUint64(buff []byte, v uint64) []byte {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	return append(buff, b[:]...)
+}
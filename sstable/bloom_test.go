@@ -0,0 +1,103 @@
+package sstable
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	filter := NewBloomFilter(1000, 0.01)
+	for i := 0; i < 1000; i++ {
+		filter.Add([]byte(fmt.Sprintf("key%d", i)))
+	}
+
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		if !filter.MayContain(key) {
+			t.Errorf("Expected no false negative but '%s' was ruled out", key)
+		}
+	}
+
+	positives := 0
+	for i := 0; i < 10000; i++ {
+		if filter.MayContain([]byte(fmt.Sprintf("absent%d", i))) {
+			positives++
+		}
+	}
+	if positives > 200 {
+		t.Errorf("Expected about 1%% false positives.\nExpected: <= %d\nGot:      %d", 200, positives)
+	}
+
+	if filter.Full() {
+		t.Errorf("Expected a filter holding its capacity not to be full")
+	}
+	filter.Add([]byte("one more"))
+	if !filter.Full() {
+		t.Errorf("Expected a filter holding more than its capacity to be full")
+	}
+}
+
+func TestBloomFilterEncoding(t *testing.T) {
+	filter := NewBloomFilter(100, 0.01)
+	filter.Add([]byte("FOO"))
+	filter.Add([]byte("BAR"))
+
+	buff := bytes.NewBufferString("")
+	_, err := filter.WriteTo(buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := buff.Bytes()
+
+	loaded, err := ReadBloomFilter(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.MayContain([]byte("FOO")) || !loaded.MayContain([]byte("BAR")) {
+		t.Errorf("Expected a loaded filter to contain the saved keys")
+	}
+
+	corrupted := append([]byte{}, encoded...)
+	corrupted[len(corrupted)/2] ^= 0xff
+	_, err = ReadBloomFilter(bytes.NewReader(corrupted))
+	if err != ErrFilterChecksum {
+		t.Errorf("Expected corruption to be detected.\nExpected: %v\nGot:      %v", ErrFilterChecksum, err)
+	}
+
+	_, err = ReadBloomFilter(bytes.NewReader([]byte("not a bloom filter, just some text long enough")))
+	if err != ErrInvalidFilter {
+		t.Errorf("Expected garbage to be rejected.\nExpected: %v\nGot:      %v", ErrInvalidFilter, err)
+	}
+}
+
+func TestBloomFilterCorruptedCapacity(t *testing.T) {
+	buff := bytes.NewBufferString("")
+	_, err := NewBloomFilter(100, 0.01).WriteTo(buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	examples := []struct {
+		capacity uint64
+		err      error
+	}{
+		// Sized past any filter worth reading
+		{1 << 60, ErrInvalidFilter},
+		{1<<63 - 1, ErrInvalidFilter},
+		// Sized for more bytes than there are left
+		{1 << 20, io.ErrUnexpectedEOF},
+	}
+
+	for _, example := range examples {
+		corrupted := append([]byte{}, buff.Bytes()...)
+		binary.LittleEndian.PutUint64(corrupted[12:], example.capacity)
+
+		_, err = ReadBloomFilter(bytes.NewReader(corrupted))
+		if err != example.err {
+			t.Errorf("Expected a corrupted capacity of %d to be rejected.\nExpected: %v\nGot:      %v", example.capacity, example.err, err)
+		}
+	}
+}
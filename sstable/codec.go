@@ -0,0 +1,193 @@
+package sstable
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/lzw"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// Codec compresses record values. Its id is stored in every record it
+// encodes, so that the codec can be found back when reading, whatever the
+// codec the table is written with.
+type Codec interface {
+	ID() uint8
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// Ids of the built-in codecs. Id 0 is for values stored as is.
+const (
+	NoCodecID = uint8(iota)
+	FlateCodecID
+	GzipCodecID
+	ZlibCodecID
+	LZWCodecID
+)
+
+var (
+	FlateCodec Codec = flateCodec{}
+	GzipCodec  Codec = gzipCodec{}
+	ZlibCodec  Codec = zlibCodec{}
+	LZWCodec   Codec = lzwCodec{}
+)
+
+var ErrCodecRegistered = errors.New("sstable: codec id already registered")
+
+var codecs = struct {
+	sync.RWMutex
+	byID map[uint8]Codec
+}{
+	byID: map[uint8]Codec{},
+}
+
+func init() {
+	for _, codec := range []Codec{FlateCodec, GzipCodec, ZlibCodec, LZWCodec} {
+		RegisterCodec(codec)
+	}
+}
+
+// RegisterCodec makes a codec available to read the records it encodes.
+func RegisterCodec(codec Codec) error {
+	codecs.Lock()
+	defer codecs.Unlock()
+
+	_, taken := codecs.byID[codec.ID()]
+	if taken || codec.ID() == NoCodecID {
+		return ErrCodecRegistered
+	}
+
+	codecs.byID[codec.ID()] = codec
+	return nil
+}
+
+func LookupCodec(id uint8) (Codec, bool) {
+	codecs.RLock()
+	defer codecs.RUnlock()
+
+	codec, ok := codecs.byID[id]
+	return codec, ok
+}
+
+// encode compresses data with codec. It returns data as is, along with
+// NoCodecID, when there is no codec or compressing doesn't make it smaller.
+func encode(codec Codec, data []byte) (uint8, []byte, error) {
+	if codec == nil {
+		return NoCodecID, data, nil
+	}
+
+	buff := bytes.NewBuffer(nil)
+	w, err := codec.NewWriter(buff)
+	if err != nil {
+		return NoCodecID, nil, err
+	}
+	_, err = w.Write(data)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		return NoCodecID, nil, err
+	}
+
+	if buff.Len() >= len(data) {
+		return NoCodecID, data, nil
+	}
+	return codec.ID(), buff.Bytes(), nil
+}
+
+// decode uncompresses data encoded by the codec with the given id, refusing
+// values over max bytes.
+func decode(id uint8, data []byte, max int64) ([]byte, error) {
+	if id == NoCodecID {
+		return data, nil
+	}
+
+	codec, ok := LookupCodec(id)
+	if !ok {
+		return nil, UnknownCodecError(id)
+	}
+
+	r, err := codec.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	decoded, err := ioutil.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(decoded)) > max {
+		return nil, LengthError{Field: "decoded data", Length: int64(len(decoded)), Max: max}
+	}
+
+	return decoded, nil
+}
+
+type UnknownCodecError uint8
+
+func (id UnknownCodecError) Error() string {
+	return fmt.Sprintf("Codec %d is not registered.", uint8(id))
+}
+
+type flateCodec struct{}
+
+func (flateCodec) ID() uint8 {
+	return FlateCodecID
+}
+
+func (flateCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return flate.NewWriter(w, flate.DefaultCompression)
+}
+
+func (flateCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return flate.NewReader(r), nil
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) ID() uint8 {
+	return GzipCodecID
+}
+
+func (gzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+type zlibCodec struct{}
+
+func (zlibCodec) ID() uint8 {
+	return ZlibCodecID
+}
+
+func (zlibCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return zlib.NewWriter(w), nil
+}
+
+func (zlibCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return zlib.NewReader(r)
+}
+
+type lzwCodec struct{}
+
+func (lzwCodec) ID() uint8 {
+	return LZWCodecID
+}
+
+func (lzwCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return lzw.NewWriter(w, lzw.LSB, 8), nil
+}
+
+func (lzwCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return lzw.NewReader(r, lzw.LSB, 8), nil
+}
@@ -0,0 +1,94 @@
+package sstable
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCodecs(t *testing.T) {
+	value := []byte(strings.Repeat(`{"level":"info","message":"request served"}`, 20))
+
+	for _, codec := range []Codec{FlateCodec, GzipCodec, ZlibCodec, LZWCodec} {
+		buff := bytes.NewBufferString("")
+
+		entry := NewDataEntry([]byte("foo"), value)
+		entry.Codec = codec.ID()
+		err := entry.Write(buff)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buff.Len() >= len(value) {
+			t.Errorf("Expected codec %d to compress the value.\nExpected: < %d\nGot:      %d", codec.ID(), len(value), buff.Len())
+		}
+
+		read, err := ReadDataEntry(bytes.NewReader(buff.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if read.Codec != codec.ID() || bytes.Compare(read.Data, value) != 0 || read.DataLen != int64(len(value)) {
+			t.Errorf("Expected codec %d to read back the value but got %d bytes with codec %d", codec.ID(), len(read.Data), read.Codec)
+		}
+	}
+}
+
+func TestCodecIncompressible(t *testing.T) {
+	buff := bytes.NewBufferString("")
+
+	entry := NewDataEntry([]byte("foo"), []byte("bar"))
+	entry.Codec = GzipCodecID
+	entry.Write(buff)
+
+	read, err := ReadDataEntry(bytes.NewReader(buff.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.Codec != NoCodecID || string(read.Data) != "bar" {
+		t.Errorf("Expected a value compression makes bigger to be stored as is but got codec %d", read.Codec)
+	}
+}
+
+func TestCodecLimits(t *testing.T) {
+	buff := bytes.NewBufferString("")
+
+	entry := NewDataEntry([]byte("foo"), make([]byte, 4096))
+	entry.Codec = FlateCodecID
+	entry.Write(buff)
+
+	_, err := ReadDataEntryLimits(bytes.NewReader(buff.Bytes()), CurrentVersion, Limits{MaxValueSize: 1024})
+	expected := DecodeError{Offset: 0, Err: LengthError{Field: "decoded data", Length: 1025, Max: 1024}}
+	if err != expected {
+		t.Errorf("Expected decoded values over the limit to be refused.\nExpected: %v\nGot:      %v", expected, err)
+	}
+}
+
+func TestRegisterCodec(t *testing.T) {
+	err := RegisterCodec(GzipCodec)
+	if err != ErrCodecRegistered {
+		t.Errorf("Expected a codec id to be registered once.\nExpected: %v\nGot:      %v", ErrCodecRegistered, err)
+	}
+
+	codec := customCodec{}
+	err = RegisterCodec(codec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, ok := LookupCodec(codec.ID())
+	if !ok || found != Codec(codec) {
+		t.Errorf("Expected to look up a registered codec")
+	}
+
+	_, err = decode(200, []byte("data"), DefaultMaxValueSize)
+	if err != UnknownCodecError(200) {
+		t.Errorf("Expected an unknown codec to be reported.\nExpected: %v\nGot:      %v", UnknownCodecError(200), err)
+	}
+}
+
+// customCodec is flate registered under another id.
+type customCodec struct {
+	flateCodec
+}
+
+func (customCodec) ID() uint8 {
+	return 100
+}
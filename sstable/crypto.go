@@ -0,0 +1,143 @@
+package sstable
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Keyring holds the key-encryption keys of a database by id, AES keys of 16,
+// 24 or 32 bytes. Every encrypted data file has its own data key, stored in
+// its header wrapped by a key-encryption key: rotating keys only takes adding
+// a new key as the current one, the previous ones must be kept to read the
+// files they wrapped the data key of.
+type Keyring struct {
+	// Current is the id of the key wrapping the data key of new files
+	Current uint32
+	Keys    map[uint32][]byte
+}
+
+const dataKeySize = 32
+
+var ErrDecrypt = errors.New("sstable: message authentication failed")
+
+// newDataKey creates a random data key, and wraps it with the current key.
+func (k *Keyring) newDataKey() (*recordCipher, []byte, error) {
+	kek, err := k.aead(k.Current)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dataKey := make([]byte, dataKeySize)
+	_, err = io.ReadFull(rand.Reader, dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c, err := newRecordCipher(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	wrapped, err := seal(kek, dataKey, keyIDData(k.Current))
+	return c, wrapped, err
+}
+
+// unwrap returns the cipher of the data key wrapped by the key with the given
+// id.
+func (k *Keyring) unwrap(id uint32, wrapped []byte) (*recordCipher, error) {
+	kek, err := k.aead(id)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := open(kek, wrapped, keyIDData(id))
+	if err != nil {
+		return nil, err
+	}
+
+	return newRecordCipher(dataKey)
+}
+
+func (k *Keyring) aead(id uint32) (cipher.AEAD, error) {
+	if k == nil {
+		return nil, KeyNotFoundError(id)
+	}
+	key, ok := k.Keys[id]
+	if !ok {
+		return nil, KeyNotFoundError(id)
+	}
+
+	return newAEAD(key)
+}
+
+// keyIDData binds a wrapped data key to the id of the key wrapping it.
+func keyIDData(id uint32) []byte {
+	var data [4]byte
+	binary.LittleEndian.PutUint32(data[:], id)
+	return data[:]
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// recordCipher encrypts the values of the records of a data file, and their
+// keys too when keys is set.
+type recordCipher struct {
+	aead cipher.AEAD
+	keys bool
+}
+
+func newRecordCipher(dataKey []byte) (*recordCipher, error) {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &recordCipher{aead: aead}, nil
+}
+
+// overhead is the number of bytes encryption adds to a field.
+func (c *recordCipher) overhead() int64 {
+	return int64(c.aead.NonceSize() + c.aead.Overhead())
+}
+
+// seal encrypts plaintext under a random nonce, stored before the ciphertext.
+func seal(aead cipher.AEAD, plaintext, data []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, data), nil
+}
+
+func open(aead cipher.AEAD, ciphertext, data []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, ErrDecrypt
+	}
+
+	plaintext, err := aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], data)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+
+	return plaintext, nil
+}
+
+type KeyNotFoundError uint32
+
+func (id KeyNotFoundError) Error() string {
+	return fmt.Sprintf("Key %d is not in the keyring.", uint32(id))
+}
@@ -0,0 +1,104 @@
+package sstable
+
+import (
+	"bytes"
+	"testing"
+)
+
+func testKeyring() *Keyring {
+	return &Keyring{
+		Current: 1,
+		Keys: map[uint32][]byte{
+			1: bytes.Repeat([]byte{0x1}, 32),
+			2: bytes.Repeat([]byte{0x2}, 16),
+		},
+	}
+}
+
+func TestWrapDataKey(t *testing.T) {
+	keyring := testKeyring()
+
+	c, wrapped, err := keyring.newDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unwrapped, err := keyring.unwrap(1, wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := seal(c.aead, []byte("bar"), []byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened, err := open(unwrapped.aead, sealed, []byte("foo"))
+	if err != nil || string(opened) != "bar" {
+		t.Errorf("Expected the unwrapped key to decrypt but got '%s' (%v)", opened, err)
+	}
+
+	tt := []struct {
+		ID   uint32
+		Data []byte
+		Err  error
+	}{
+		{2, wrapped, ErrDecrypt},
+		{3, wrapped, KeyNotFoundError(3)},
+		{1, wrapped[:len(wrapped)-1], ErrDecrypt},
+		{1, nil, ErrDecrypt},
+	}
+
+	for _, example := range tt {
+		_, err := keyring.unwrap(example.ID, example.Data)
+		if err != example.Err {
+			t.Errorf("Unexpected error unwrapping with key %d.\nExpected: %v\nGot:      %v", example.ID, example.Err, err)
+		}
+	}
+
+	var missing *Keyring
+	_, err = missing.unwrap(1, wrapped)
+	if err != KeyNotFoundError(1) {
+		t.Errorf("Unexpected error unwrapping without keyring.\nExpected: %v\nGot:      %v", KeyNotFoundError(1), err)
+	}
+}
+
+func TestEncryptedEntry(t *testing.T) {
+	c, _, err := testKeyring().newDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, keys := range []bool{false, true} {
+		c.keys = keys
+
+		for _, entry := range []DataEntry{NewDataEntry([]byte("foo"), []byte("bar")), NewTombstone([]byte("foo"))} {
+			buff := bytes.NewBufferString("")
+			err := entry.write(buff, CurrentVersion, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Contains(buff.Bytes(), []byte("bar")) || keys == bytes.Contains(buff.Bytes(), []byte("foo")) {
+				t.Errorf("Unexpected plaintext in record encrypting keys %v: %q", keys, buff.Bytes())
+			}
+
+			read, err := readDataEntry(bytes.NewReader(buff.Bytes()), CurrentVersion, Limits{}, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(read.Key) != "foo" || string(read.Data) != string(entry.Data) || read.DataLen != entry.DataLen {
+				t.Errorf("Read a different entry from what was previously written.\nExpected: %v\nGot:      %v", entry, read)
+			}
+		}
+	}
+
+	// Another data key can't read the record, though its checksum matches
+	other, _, err := testKeyring().newDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buff := bytes.NewBufferString("")
+	NewDataEntry([]byte("foo"), []byte("bar")).write(buff, CurrentVersion, c)
+	_, err = readDataEntry(bytes.NewReader(buff.Bytes()), CurrentVersion, Limits{}, other)
+	if decodeErr, ok := err.(DecodeError); !ok || decodeErr.Err != ErrDecrypt {
+		t.Errorf("Unexpected error reading with another key.\nExpected: %v\nGot:      %v", ErrDecrypt, err)
+	}
+}
@@ -4,29 +4,122 @@ import (
 	"crypto/md5"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"io"
 )
 
 type DataEntry struct {
-	Key      []byte
+	Key []byte
+	// Checksum is the MD5 of Data stored by records before version 2
 	Checksum [md5.Size]byte
-	DataLen  int64
-	Data     []byte
-	Offset   int64
+	// CRC is the CRC32C of the whole record stored from version 2
+	CRC uint32
+	// Codec is the id of the codec compressing Data in the record, from
+	// version 3. Data itself is never compressed.
+	Codec   uint8
+	DataLen int64
+	Data    []byte
+	Offset  int64
 }
 
+// tombstoneLen is the data size written for tombstones, which have no data.
+const tombstoneLen = int64(-1)
+
+// crcVersion is the first version checksumming whole records with CRC32C.
+// Records of older versions only have an MD5 of their data.
+const crcVersion = uint16(2)
+
+// codecVersion is the first version storing the id of the codec compressing
+// the data of a record. Records of older versions store their data as is.
+const codecVersion = uint16(3)
+
 func NewDataEntry(key, data []byte) DataEntry {
-	sum := md5.Sum(data)
+	return DataEntry{
+		Key:     key,
+		DataLen: int64(len(data)),
+		Data:    data,
+	}
+}
 
+// NewTombstone creates an entry marking key as deleted.
+func NewTombstone(key []byte) DataEntry {
 	return DataEntry{
-		Key:      key,
-		Checksum: sum,
-		DataLen:  int64(len(data)),
-		Data:     data,
+		Key:     key,
+		DataLen: tombstoneLen,
 	}
 }
 
+func (e DataEntry) IsTombstone() bool {
+	return e.DataLen == tombstoneLen
+}
+
+// Write writes the entry in the current record layout.
 func (e DataEntry) Write(w io.Writer) error {
+	return e.WriteVersion(w, CurrentVersion)
+}
+
+// WriteVersion writes the entry in the record layout of a data file version.
+// Checksums are computed from the entry content rather than copied from it,
+// and Data is compressed with the codec of the entry if the version allows
+// it and it makes Data smaller.
+func (e DataEntry) WriteVersion(w io.Writer, version uint16) error {
+	return e.write(w, version, nil)
+}
+
+// write writes the entry, encrypting it with c when not nil. Data is
+// compressed before being encrypted, and bound to the plain key.
+func (e DataEntry) write(w io.Writer, version uint16, c *recordCipher) error {
+	if version < crcVersion {
+		return e.writeMD5(w)
+	}
+
+	key, codec, data, dataLen := e.Key, NoCodecID, e.Data, e.DataLen
+	if version >= codecVersion && e.Codec != NoCodecID && !e.IsTombstone() {
+		c, ok := LookupCodec(e.Codec)
+		if !ok {
+			return UnknownCodecError(e.Codec)
+		}
+
+		var err error
+		codec, data, err = encode(c, e.Data)
+		if err != nil {
+			return err
+		}
+		dataLen = int64(len(data))
+	}
+
+	if c != nil {
+		var err error
+		if !e.IsTombstone() {
+			data, err = seal(c.aead, data, e.Key)
+			if err != nil {
+				return err
+			}
+			dataLen = int64(len(data))
+		}
+		if c.keys {
+			key, err = seal(c.aead, e.Key, nil)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	buff := make([]byte, 16, 16+1+len(key)+len(data)+4)
+	binary.LittleEndian.PutUint64(buff, uint64(len(key)))
+	binary.LittleEndian.PutUint64(buff[8:], uint64(dataLen))
+	if version >= codecVersion {
+		buff = append(buff, codec)
+	}
+	buff = append(buff, key...)
+	buff = append(buff, data...)
+	buff = appendUint32(buff, crc32.Checksum(buff, castagnoli))
+
+	_, err := w.Write(buff)
+	return err
+}
+
+func (e DataEntry) writeMD5(w io.Writer) error {
 	err := binary.Write(w, binary.LittleEndian, int64(len(e.Key)))
 	if err != nil {
 		return err
@@ -37,7 +130,8 @@ func (e DataEntry) Write(w io.Writer) error {
 		return err
 	}
 
-	_, err = w.Write(e.Checksum[:])
+	sum := md5.Sum(e.Data)
+	_, err = w.Write(sum[:])
 	if err != nil {
 		return err
 	}
@@ -55,44 +149,237 @@ func (e DataEntry) Write(w io.Writer) error {
 	return nil
 }
 
+// Limits bounds the sizes of the keys and values read from records, so that a
+// corrupted length can't make decoding allocate unbounded memory. Zero fields
+// stand for the defaults.
+type Limits struct {
+	MaxKeySize   int64
+	MaxValueSize int64
+}
+
+const (
+	DefaultMaxKeySize   = 64 << 10
+	DefaultMaxValueSize = 64 << 20
+)
+
+func (l Limits) orDefault() Limits {
+	if l.MaxKeySize <= 0 {
+		l.MaxKeySize = DefaultMaxKeySize
+	}
+	if l.MaxValueSize <= 0 {
+		l.MaxValueSize = DefaultMaxValueSize
+	}
+	return l
+}
+
+func (l Limits) checkKey(keyLen int64) error {
+	if keyLen < 0 || keyLen > l.MaxKeySize {
+		return LengthError{Field: "key", Length: keyLen, Max: l.MaxKeySize}
+	}
+	return nil
+}
+
+func (l Limits) checkData(dataLen int64) error {
+	if dataLen < tombstoneLen || dataLen > l.MaxValueSize {
+		return LengthError{Field: "data", Length: dataLen, Max: l.MaxValueSize}
+	}
+	return nil
+}
+
+// ReadDataEntry reads an entry in the current record layout.
 func ReadDataEntry(r io.ReadSeeker) (DataEntry, error) {
-	var entry DataEntry
+	return ReadDataEntryVersion(r, CurrentVersion)
+}
 
-	// Get current offset
+// ReadDataEntryVersion reads an entry in the record layout of a data file
+// version, within the default limits.
+func ReadDataEntryVersion(r io.ReadSeeker, version uint16) (DataEntry, error) {
+	return ReadDataEntryLimits(r, version, Limits{})
+}
+
+// ReadDataEntryLimits reads an entry in the record layout of a data file
+// version. It returns io.EOF when r has no record left, and a DecodeError when
+// the record can't be decoded.
+func ReadDataEntryLimits(r io.ReadSeeker, version uint16, limits Limits) (DataEntry, error) {
+	return readDataEntry(r, version, limits, nil)
+}
+
+// readDataEntry reads an entry, decrypting it with c when not nil.
+func readDataEntry(r io.ReadSeeker, version uint16, limits Limits, c *recordCipher) (DataEntry, error) {
 	offset, err := r.Seek(0, io.SeekCurrent)
 	if err != nil {
-		return entry, err
+		return DataEntry{}, err
+	}
+	if p, ok := r.(pinner); ok {
+		err = p.pin()
+		if err != nil {
+			return DataEntry{}, DecodeError{Offset: offset, Err: err}
+		}
+		defer p.unpin()
+	}
+
+	var entry DataEntry
+	if version < crcVersion {
+		entry, err = readMD5DataEntry(r, limits.orDefault())
+	} else {
+		entry, err = readCRCDataEntry(r, version, limits.orDefault(), c)
 	}
 	entry.Offset = offset
 
+	if err != nil && err != io.EOF {
+		return entry, DecodeError{Offset: offset, Err: err}
+	}
+	return entry, err
+}
+
+func readCRCDataEntry(r io.Reader, version uint16, limits Limits, c *recordCipher) (DataEntry, error) {
+	var entry DataEntry
+
+	// encrypted fields are longer than the plain ones the limits are for
+	stored := limits
+	if c != nil {
+		stored.MaxValueSize += c.overhead()
+		if c.keys {
+			stored.MaxKeySize += c.overhead()
+		}
+	}
+
+	// read key and data lengths, and the codec
+	lens := make([]byte, 16, 17)
+	_, err := io.ReadFull(r, lens)
+	if err != nil {
+		return entry, err
+	}
+	if version >= codecVersion {
+		lens = lens[:17]
+		err = readFull(r, lens[16:])
+		if err != nil {
+			return entry, err
+		}
+		entry.Codec = lens[16]
+	}
+
+	keyLen := int64(binary.LittleEndian.Uint64(lens[:]))
+	err = stored.checkKey(keyLen)
+	if err != nil {
+		return entry, err
+	}
+	entry.DataLen = int64(binary.LittleEndian.Uint64(lens[8:]))
+	err = stored.checkData(entry.DataLen)
+	if err != nil {
+		return entry, err
+	}
+
+	entry.Key, err = readField(r, keyLen)
+	if err != nil {
+		return entry, err
+	}
+
+	if !entry.IsTombstone() {
+		entry.Data, err = readField(r, entry.DataLen)
+		if err != nil {
+			return entry, err
+		}
+	}
+
+	var sum [4]byte
+	err = readFull(r, sum[:])
+	if err != nil {
+		return entry, err
+	}
+	entry.CRC = binary.LittleEndian.Uint32(sum[:])
+
+	crc := crc32.Checksum(lens, castagnoli)
+	crc = crc32.Update(crc, castagnoli, entry.Key)
+	crc = crc32.Update(crc, castagnoli, entry.Data)
+	if entry.CRC != crc {
+		return entry, CorruptedDataError(entry.Key)
+	}
+
+	if c != nil {
+		err = decryptEntry(&entry, c)
+		if err != nil {
+			return entry, err
+		}
+	}
+
+	if entry.Codec != NoCodecID && !entry.IsTombstone() {
+		entry.Data, err = decode(entry.Codec, entry.Data, limits.MaxValueSize)
+		if err != nil {
+			return entry, err
+		}
+		entry.DataLen = int64(len(entry.Data))
+	}
+
+	return entry, nil
+}
+
+func decryptEntry(entry *DataEntry, c *recordCipher) error {
+	var err error
+	if c.keys {
+		entry.Key, err = open(c.aead, entry.Key, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !entry.IsTombstone() {
+		entry.Data, err = open(c.aead, entry.Data, entry.Key)
+		if err != nil {
+			return err
+		}
+		entry.DataLen = int64(len(entry.Data))
+	}
+
+	return nil
+}
+
+func readMD5DataEntry(r io.Reader, limits Limits) (DataEntry, error) {
+	var entry DataEntry
+
 	// read key length
 	var keyLen int64
-	err = binary.Read(r, binary.LittleEndian, &keyLen)
+	err := binary.Read(r, binary.LittleEndian, &keyLen)
+	if err != nil {
+		return entry, err
+	}
+	err = limits.checkKey(keyLen)
 	if err != nil {
 		return entry, err
 	}
 
-	entry.Key = make([]byte, keyLen)
-	_, err = r.Read(entry.Key)
+	entry.Key, err = readField(r, keyLen)
 	if err != nil {
 		return entry, err
 	}
 
 	// read data checksum
-	_, err = r.Read(entry.Checksum[:])
+	err = readFull(r, entry.Checksum[:])
 	if err != nil {
 		return entry, err
 	}
 
 	// read data length
-	err = binary.Read(r, binary.LittleEndian, &entry.DataLen)
+	var dataLen [8]byte
+	err = readFull(r, dataLen[:])
+	if err != nil {
+		return entry, err
+	}
+	entry.DataLen = int64(binary.LittleEndian.Uint64(dataLen[:]))
+	err = limits.checkData(entry.DataLen)
 	if err != nil {
 		return entry, err
 	}
 
+	if entry.IsTombstone() {
+		if entry.Checksum != md5.Sum(nil) {
+			return entry, CorruptedDataError(entry.Key)
+		}
+		return entry, nil
+	}
+
 	// read data
-	entry.Data = make([]byte, entry.DataLen)
-	_, err = r.Read(entry.Data)
+	entry.Data, err = readField(r, entry.DataLen)
 	if err != nil {
 		return entry, err
 	}
@@ -104,8 +391,113 @@ func ReadDataEntry(r io.ReadSeeker) (DataEntry, error) {
 	return entry, nil
 }
 
+// readFull reads a field after the start of a record, where the end of r means
+// the record was cut short.
+func readFull(r io.Reader, buff []byte) error {
+	_, err := io.ReadFull(r, buff)
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// skipDataEntry moves r past the next record without reading its key and
+// data. It reports whether the record is a tombstone, and returns io.EOF when
+// r has no record left.
+func skipDataEntry(r io.ReadSeeker, version uint16) (bool, error) {
+	if p, ok := r.(pinner); ok {
+		err := p.pin()
+		if err != nil {
+			return false, err
+		}
+		defer p.unpin()
+	}
+
+	var skip, dataLen int64
+	if version < crcVersion {
+		var size [8]byte
+		_, err := io.ReadFull(r, size[:])
+		if err != nil {
+			return false, err
+		}
+		_, err = r.Seek(int64(binary.LittleEndian.Uint64(size[:]))+md5.Size, io.SeekCurrent)
+		if err != nil {
+			return false, err
+		}
+		err = readFull(r, size[:])
+		if err != nil {
+			return false, err
+		}
+		dataLen = int64(binary.LittleEndian.Uint64(size[:]))
+	} else {
+		lens := make([]byte, 16, 17)
+		if version >= codecVersion {
+			lens = lens[:17]
+		}
+		_, err := io.ReadFull(r, lens)
+		if err != nil {
+			return false, err
+		}
+		dataLen = int64(binary.LittleEndian.Uint64(lens[8:]))
+		// key and crc32c
+		skip = int64(binary.LittleEndian.Uint64(lens)) + 4
+	}
+
+	if dataLen != tombstoneLen {
+		skip += dataLen
+	}
+	_, err := r.Seek(skip, io.SeekCurrent)
+	return dataLen == tombstoneLen, err
+}
+
+// slicer is implemented by readers of memory mapped files, returning fields
+// as slices of the mapping rather than copies.
+type slicer interface {
+	next(n int) ([]byte, error)
+}
+
+// pinner is implemented by readers of memory mapped files, which must not be
+// unmapped while a record is decoded.
+type pinner interface {
+	pin() error
+	unpin()
+}
+
+// readField reads the next n bytes of a record.
+func readField(r io.Reader, n int64) ([]byte, error) {
+	if s, ok := r.(slicer); ok {
+		return s.next(int(n))
+	}
+
+	buff := make([]byte, n)
+	return buff, readFull(r, buff)
+}
+
 type CorruptedDataError []byte
 
 func (key CorruptedDataError) Error() string {
-	return fmt.Sprintf("Data for key '%s' checksum missmatch.", key)
+	return fmt.Sprintf("Data for key '%s' checksum missmatch.", []byte(key))
+}
+
+// LengthError reports a record length that is negative or over its limit.
+type LengthError struct {
+	Field  string
+	Length int64
+	Max    int64
+}
+
+func (e LengthError) Error() string {
+	return fmt.Sprintf("Invalid %s length %d, expected at most %d.", e.Field, e.Length, e.Max)
+}
+
+// DecodeError reports a record that could not be decoded. Err is
+// io.ErrUnexpectedEOF for a record cut short, a LengthError, a
+// CorruptedDataError or ErrDecrypt.
+type DecodeError struct {
+	Offset int64
+	Err    error
+}
+
+func (e DecodeError) Error() string {
+	return fmt.Sprintf("Record at offset %d: %v", e.Offset, e.Err)
 }
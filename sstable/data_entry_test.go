@@ -2,7 +2,9 @@ package sstable
 
 import (
 	"bytes"
+	"io"
 	"testing"
+	"testing/iotest"
 )
 
 func TestDataWrite(t *testing.T) {
@@ -11,6 +13,39 @@ func TestDataWrite(t *testing.T) {
 	entry := NewDataEntry([]byte("foo"), []byte("bar"))
 	entry.Write(buff)
 
+	expected := []byte{0x3, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x66, 0x6f, 0x6f, 0x62, 0x61, 0x72, 0x5b, 0x8e, 0x91, 0x2b}
+
+	if bytes.Compare(expected, buff.Bytes()) != 0 {
+		t.Errorf("\nExpected: %#v\nGot:      %#v", expected, buff.Bytes())
+	}
+}
+
+func TestDataWriteCRC(t *testing.T) {
+	buff := bytes.NewBufferString("")
+
+	// Version 2 records have no codec
+	entry := NewDataEntry([]byte("foo"), []byte("bar"))
+	entry.Codec = GzipCodecID
+	entry.WriteVersion(buff, 2)
+
+	expected := []byte{0x3, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x66, 0x6f, 0x6f, 0x62, 0x61, 0x72}
+
+	if bytes.Compare(expected, buff.Bytes()[:len(buff.Bytes())-4]) != 0 {
+		t.Errorf("\nExpected: %#v\nGot:      %#v", expected, buff.Bytes())
+	}
+
+	read, err := ReadDataEntryVersion(bytes.NewReader(buff.Bytes()), 2)
+	if err != nil || string(read.Data) != "bar" {
+		t.Errorf("Expected to read back a version 2 record but got '%s' (%v)", read.Data, err)
+	}
+}
+
+func TestDataWriteMD5(t *testing.T) {
+	buff := bytes.NewBufferString("")
+
+	entry := NewDataEntry([]byte("foo"), []byte("bar"))
+	entry.WriteVersion(buff, LegacyVersion)
+
 	expected := []byte{0x3, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x66, 0x6f, 0x6f, 0x37, 0xb5, 0x1d, 0x19, 0x4a, 0x75, 0x13, 0xe4, 0x5b, 0x56, 0xf6, 0x52, 0x4f, 0x2d, 0x51, 0xf2, 0x3, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x62, 0x61, 0x72}
 
 	if bytes.Compare(expected, buff.Bytes()) != 0 {
@@ -35,9 +70,8 @@ func TestDataRead(t *testing.T) {
 		t.Errorf("Read a different key from what was previously written.\nExpected: %s\nGot:      %s", "foo", read.Key)
 	}
 
-	sum := [16]uint8{0x37, 0xb5, 0x1d, 0x19, 0x4a, 0x75, 0x13, 0xe4, 0x5b, 0x56, 0xf6, 0x52, 0x4f, 0x2d, 0x51, 0xf2}
-	if bytes.Compare(read.Checksum[:], sum[:]) != 0 {
-		t.Errorf("Read a different checksum from what was previously written.\nExpected: %v\nGot:      %v", sum, read.Checksum)
+	if read.CRC != 0x2b918e5b {
+		t.Errorf("Read a different checksum from what was previously written.\nExpected: %v\nGot:      %v", 0x2b918e5b, read.CRC)
 	}
 
 	if read.DataLen != 3 {
@@ -48,3 +82,158 @@ func TestDataRead(t *testing.T) {
 		t.Errorf("Read a different key from what was previously written.\nExpected: %s\nGot:      %s", "bar", read.Data)
 	}
 }
+
+func TestDataReadMD5(t *testing.T) {
+	buff := bytes.NewBufferString("")
+
+	entry := NewDataEntry([]byte("foo"), []byte("bar"))
+	entry.WriteVersion(buff, 1)
+
+	read, err := ReadDataEntryVersion(bytes.NewReader(buff.Bytes()), 1)
+	if err != nil {
+		t.Error(err)
+	}
+
+	sum := [16]uint8{0x37, 0xb5, 0x1d, 0x19, 0x4a, 0x75, 0x13, 0xe4, 0x5b, 0x56, 0xf6, 0x52, 0x4f, 0x2d, 0x51, 0xf2}
+	if bytes.Compare(read.Checksum[:], sum[:]) != 0 {
+		t.Errorf("Read a different checksum from what was previously written.\nExpected: %v\nGot:      %v", sum, read.Checksum)
+	}
+
+	if bytes.Compare(read.Key, []byte("foo")) != 0 || bytes.Compare(read.Data, []byte("bar")) != 0 {
+		t.Errorf("Read a different entry from what was previously written: %s | %s", read.Key, read.Data)
+	}
+}
+
+func TestDataCorrupted(t *testing.T) {
+	buff := bytes.NewBufferString("")
+
+	entry := NewDataEntry([]byte("foo"), []byte("bar"))
+	entry.Write(buff)
+	written := buff.Bytes()
+
+	// Flip a bit in the key length, the data length, the key, the data and the
+	// checksum
+	for _, i := range []int{0, 8, 17, 20, len(written) - 1} {
+		corrupted := append([]byte{}, written...)
+		corrupted[i] ^= 0x1
+
+		_, err := ReadDataEntry(bytes.NewReader(corrupted))
+		if err == nil {
+			t.Errorf("Expected a flipped bit at byte %d to be detected", i)
+		}
+	}
+}
+
+func TestTombstone(t *testing.T) {
+	buff := bytes.NewBufferString("")
+
+	entry := NewTombstone([]byte("foo"))
+	entry.Write(buff)
+
+	expected := []byte{0x3, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x0, 0x66, 0x6f, 0x6f, 0x49, 0x44, 0xe9, 0xed}
+	if bytes.Compare(expected, buff.Bytes()) != 0 {
+		t.Errorf("\nExpected: %#v\nGot:      %#v", expected, buff.Bytes())
+	}
+
+	read, err := ReadDataEntry(bytes.NewReader(buff.Bytes()))
+	if err != nil {
+		t.Error(err)
+	}
+	if !read.IsTombstone() || read.Data != nil {
+		t.Errorf("Expected to read back a tombstone but got %#v", read)
+	}
+
+	corrupted := append([]byte{}, buff.Bytes()...)
+	corrupted[15] = 0xfe
+	_, err = ReadDataEntry(bytes.NewReader(corrupted))
+	if decodeErr, ok := err.(DecodeError); !ok || decodeErr.Err != (LengthError{Field: "data", Length: -72057594037927937, Max: DefaultMaxValueSize}) {
+		t.Errorf("Expected a negative data size to be reported as invalid but got %v", err)
+	}
+}
+
+func TestTombstoneMD5(t *testing.T) {
+	buff := bytes.NewBufferString("")
+
+	entry := NewTombstone([]byte("foo"))
+	entry.WriteVersion(buff, LegacyVersion)
+
+	expected := []byte{0x3, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x66, 0x6f, 0x6f, 0xd4, 0x1d, 0x8c, 0xd9, 0x8f, 0x0, 0xb2, 0x4, 0xe9, 0x80, 0x9, 0x98, 0xec, 0xf8, 0x42, 0x7e, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	if bytes.Compare(expected, buff.Bytes()) != 0 {
+		t.Errorf("\nExpected: %#v\nGot:      %#v", expected, buff.Bytes())
+	}
+
+	read, err := ReadDataEntryVersion(bytes.NewReader(buff.Bytes()), LegacyVersion)
+	if err != nil {
+		t.Error(err)
+	}
+	if !read.IsTombstone() {
+		t.Errorf("Expected to read back a tombstone but got %#v", read)
+	}
+}
+
+func TestDataLimits(t *testing.T) {
+	tt := []struct {
+		Key     []byte
+		Data    []byte
+		Version uint16
+		Limits  Limits
+		Err     error
+	}{
+		{[]byte("foo"), []byte("bar"), CurrentVersion, Limits{MaxKeySize: 3, MaxValueSize: 3}, nil},
+		{[]byte("foo"), []byte("bar"), CurrentVersion, Limits{MaxKeySize: 2}, LengthError{Field: "key", Length: 3, Max: 2}},
+		{[]byte("foo"), []byte("bar"), CurrentVersion, Limits{MaxValueSize: 2}, LengthError{Field: "data", Length: 3, Max: 2}},
+		{[]byte("foo"), []byte("bar"), LegacyVersion, Limits{MaxKeySize: 2}, LengthError{Field: "key", Length: 3, Max: 2}},
+		{[]byte("foo"), []byte("bar"), LegacyVersion, Limits{MaxValueSize: 2}, LengthError{Field: "data", Length: 3, Max: 2}},
+	}
+
+	for _, example := range tt {
+		buff := bytes.NewBufferString("prefix")
+		NewDataEntry(example.Key, example.Data).WriteVersion(buff, example.Version)
+
+		reader := bytes.NewReader(buff.Bytes())
+		reader.Seek(6, io.SeekStart)
+		_, err := ReadDataEntryLimits(reader, example.Version, example.Limits)
+
+		var expected error
+		if example.Err != nil {
+			expected = DecodeError{Offset: 6, Err: example.Err}
+		}
+		if err != expected {
+			t.Errorf("Unexpected error reading with %+v.\nExpected: %v\nGot:      %v", example.Limits, expected, err)
+		}
+	}
+}
+
+func TestDataShortReads(t *testing.T) {
+	for _, version := range []uint16{LegacyVersion, CurrentVersion} {
+		buff := bytes.NewBufferString("")
+		NewDataEntry([]byte("foo"), []byte("bar")).WriteVersion(buff, version)
+		written := buff.Bytes()
+
+		read, err := ReadDataEntryVersion(oneByteReadSeeker{bytes.NewReader(written)}, version)
+		if err != nil || string(read.Key) != "foo" || string(read.Data) != "bar" {
+			t.Errorf("Expected to read a record one byte at a time but got %s | %s (%v)", read.Key, read.Data, err)
+		}
+
+		// Cut short at every byte
+		for i := 1; i < len(written); i++ {
+			_, err := ReadDataEntryVersion(bytes.NewReader(written[:i]), version)
+			if err != (DecodeError{Offset: 0, Err: io.ErrUnexpectedEOF}) {
+				t.Errorf("Expected a record cut at byte %d to be reported.\nExpected: %v\nGot:      %v", i, io.ErrUnexpectedEOF, err)
+			}
+		}
+
+		_, err = ReadDataEntryVersion(bytes.NewReader(nil), version)
+		if err != io.EOF {
+			t.Errorf("Expected io.EOF without any record left.\nExpected: %v\nGot:      %v", io.EOF, err)
+		}
+	}
+}
+
+type oneByteReadSeeker struct {
+	*bytes.Reader
+}
+
+func (r oneByteReadSeeker) Read(p []byte) (int, error) {
+	return iotest.OneByteReader(r.Reader).Read(p)
+}
@@ -0,0 +1,156 @@
+package sstable
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Header identifies a data file and the layout of its records. It is written
+// at the start of the file, before the first record.
+//
+// Header format:
+//
+//	magic - version - flags - created [- key-id - wrapped-key-size - wrapped-key]
+//
+// The key fields are only written for encrypted files.
+type Header struct {
+	Version uint16
+	Flags   uint16
+	Created time.Time
+	// KeyID is the id of the key wrapping the data key of an encrypted file
+	KeyID      uint32
+	WrappedKey []byte
+
+	// cipher encrypts records once the data key is unwrapped
+	cipher *recordCipher
+}
+
+const (
+	HeaderSize = 16
+
+	// LegacyVersion is the version of data files written before headers
+	// existed: they start with their first record.
+	LegacyVersion  = uint16(0)
+	CurrentVersion = uint16(3)
+)
+
+const (
+	// FlagEncrypted marks files whose values are encrypted with AES-GCM
+	FlagEncrypted = uint16(1 << 1)
+	// FlagEncryptedKeys marks encrypted files whose keys are encrypted too
+	FlagEncryptedKeys = uint16(1 << 2)
+
+	maxWrappedKeySize = 1 << 8
+)
+
+var headerMagic = [4]byte{'J', 'R', 'N', 'L'}
+
+func NewHeader() Header {
+	return Header{
+		Version: CurrentVersion,
+		Created: time.Now(),
+	}
+}
+
+// Size is the number of bytes the header takes in the data file, where
+// records start.
+func (h Header) Size() int64 {
+	if h.Version == LegacyVersion {
+		return 0
+	}
+	if h.Flags&FlagEncrypted != 0 {
+		return HeaderSize + 6 + int64(len(h.WrappedKey))
+	}
+	return HeaderSize
+}
+
+// sameCipher reports whether records of both files are encrypted the same
+// way, so that they can be copied from one to the other as is.
+func (h Header) sameCipher(other Header) bool {
+	return h.Flags&(FlagEncrypted|FlagEncryptedKeys) == other.Flags&(FlagEncrypted|FlagEncryptedKeys) &&
+		h.KeyID == other.KeyID && string(h.WrappedKey) == string(other.WrappedKey)
+}
+
+func (h Header) Write(w io.Writer) error {
+	buff := make([]byte, HeaderSize)
+	copy(buff, headerMagic[:])
+	binary.LittleEndian.PutUint16(buff[4:], h.Version)
+	binary.LittleEndian.PutUint16(buff[6:], h.Flags)
+	binary.LittleEndian.PutUint64(buff[8:], uint64(h.Created.UnixNano()))
+	if h.Flags&FlagEncrypted != 0 {
+		buff = appendUint32(buff, h.KeyID)
+		buff = append(buff, byte(len(h.WrappedKey)), byte(len(h.WrappedKey)>>8))
+		buff = append(buff, h.WrappedKey...)
+	}
+
+	_, err := w.Write(buff)
+	return err
+}
+
+// ReadHeader reads the header at the start of r. Files starting with anything
+// else than the magic number are legacy ones, io.EOF is returned for empty
+// files and io.ErrUnexpectedEOF for a header cut short.
+func ReadHeader(r io.ReadSeeker) (Header, error) {
+	_, err := r.Seek(0, io.SeekStart)
+	if err != nil {
+		return Header{}, err
+	}
+
+	buff := make([]byte, HeaderSize)
+	n, err := io.ReadFull(r, buff)
+	if err == io.EOF {
+		return Header{}, err
+	}
+	if err == io.ErrUnexpectedEOF && n < len(headerMagic) && string(buff[:n]) == string(headerMagic[:n]) {
+		// Torn header write
+		return Header{}, err
+	}
+	if n < len(headerMagic) || string(buff[:len(headerMagic)]) != string(headerMagic[:]) {
+		// A legacy file starts with a key length, which can't be mistaken for
+		// the magic number: it would be over a gigabyte long.
+		return Header{Version: LegacyVersion}, nil
+	}
+	if err != nil {
+		return Header{}, err
+	}
+
+	h := Header{
+		Version: binary.LittleEndian.Uint16(buff[4:]),
+		Flags:   binary.LittleEndian.Uint16(buff[6:]),
+		Created: time.Unix(0, int64(binary.LittleEndian.Uint64(buff[8:]))),
+	}
+	if h.Version == LegacyVersion || h.Version > CurrentVersion {
+		return h, UnsupportedVersionError{Version: h.Version}
+	}
+
+	if h.Flags&FlagEncrypted != 0 {
+		var key [6]byte
+		err = readFull(r, key[:])
+		if err != nil {
+			return Header{}, err
+		}
+		h.KeyID = binary.LittleEndian.Uint32(key[:])
+
+		size := int(binary.LittleEndian.Uint16(key[4:]))
+		if size > maxWrappedKeySize {
+			return Header{}, LengthError{Field: "wrapped key", Length: int64(size), Max: maxWrappedKeySize}
+		}
+		h.WrappedKey = make([]byte, size)
+		err = readFull(r, h.WrappedKey)
+		if err != nil {
+			return Header{}, err
+		}
+	}
+
+	return h, nil
+}
+
+type UnsupportedVersionError struct {
+	Version uint16
+}
+
+func (e UnsupportedVersionError) Error() string {
+	return fmt.Sprintf("Data file version %d is not supported, expected at most %d.", e.Version, CurrentVersion)
+}
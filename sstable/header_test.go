@@ -0,0 +1,86 @@
+package sstable
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestHeader(t *testing.T) {
+	buff := bytes.NewBufferString("")
+
+	header := Header{Version: 1, Flags: 0x8, Created: time.Unix(1500000000, 0)}
+	err := header.Write(buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []byte{'J', 'R', 'N', 'L', 0x1, 0x0, 0x8, 0x0, 0x0, 0x0, 0x16, 0x7b, 0xd, 0x12, 0xd1, 0x14}
+	if bytes.Compare(expected, buff.Bytes()) != 0 {
+		t.Errorf("\nExpected: %#v\nGot:      %#v", expected, buff.Bytes())
+	}
+
+	read, err := ReadHeader(bytes.NewReader(buff.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.Version != header.Version || read.Flags != header.Flags || !read.Created.Equal(header.Created) {
+		t.Errorf("Read a different header from what was previously written.\nExpected: %v\nGot:      %v", header, read)
+	}
+}
+
+func TestEncryptedHeader(t *testing.T) {
+	buff := bytes.NewBufferString("")
+
+	header := Header{Version: CurrentVersion, Flags: FlagEncrypted, Created: time.Unix(1500000000, 0), KeyID: 7, WrappedKey: []byte("wrapped")}
+	err := header.Write(buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(buff.Len()) != header.Size() {
+		t.Errorf("Unexpected header size.\nExpected: %d\nGot:      %d", header.Size(), buff.Len())
+	}
+
+	read, err := ReadHeader(bytes.NewReader(buff.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.KeyID != header.KeyID || !bytes.Equal(read.WrappedKey, header.WrappedKey) {
+		t.Errorf("Read a different key from what was previously written.\nExpected: %d %q\nGot:      %d %q", header.KeyID, header.WrappedKey, read.KeyID, read.WrappedKey)
+	}
+
+	_, err = ReadHeader(bytes.NewReader(buff.Bytes()[:buff.Len()-1]))
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("Unexpected error reading a torn key.\nExpected: %v\nGot:      %v", io.ErrUnexpectedEOF, err)
+	}
+}
+
+func TestReadHeader(t *testing.T) {
+	legacy := bytes.NewBufferString("")
+	NewDataEntry([]byte("foo"), []byte("bar")).WriteVersion(legacy, LegacyVersion)
+
+	future := bytes.NewBufferString("")
+	Header{Version: CurrentVersion + 1}.Write(future)
+
+	tt := []struct {
+		Data    []byte
+		Version uint16
+		Err     error
+	}{
+		{legacy.Bytes(), LegacyVersion, nil},
+		{[]byte("JR"), LegacyVersion, io.ErrUnexpectedEOF},
+		{future.Bytes(), CurrentVersion + 1, UnsupportedVersionError{Version: CurrentVersion + 1}},
+		{[]byte{'J', 'R', 'N', 'L', 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}, LegacyVersion, UnsupportedVersionError{Version: LegacyVersion}},
+	}
+
+	for _, example := range tt {
+		header, err := ReadHeader(bytes.NewReader(example.Data))
+		if err != example.Err {
+			t.Errorf("Unexpected error reading %v.\nExpected: %v\nGot:      %v", example.Data, example.Err, err)
+		}
+		if header.Version != example.Version {
+			t.Errorf("Unexpected version reading %v.\nExpected: %v\nGot:      %v", example.Data, example.Version, header.Version)
+		}
+	}
+}
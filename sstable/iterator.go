@@ -0,0 +1,147 @@
+package sstable
+
+import "io"
+
+// Iterator reads the entries of a table in insert order, tombstones included,
+// from a position of its own: iterators don't disturb each other, nor the
+// appends to the table.
+//
+//	it := table.Iterator()
+//	defer it.Close()
+//	for it.Next() {
+//		fmt.Printf("%s | %s\n", it.Key(), it.Value())
+//	}
+//	if it.Err() != nil {
+//		...
+//	}
+type Iterator struct {
+	table  SSTable
+	header Header
+	reader io.ReadSeeker
+	// offset is the offset of the next record, negative before the first one
+	offset int64
+	size   int64
+	entry  DataEntry
+	err    error
+	closed bool
+}
+
+// Iterator returns an iterator positioned before the first entry of the table.
+func (t SSTable) Iterator() *Iterator {
+	return &Iterator{table: t, offset: -1}
+}
+
+// Seek positions the iterator before the last version of key, like Scan. It
+// returns a NotFoundError when key is not in the table, leaving the iterator
+// where it was.
+func (it *Iterator) Seek(key []byte) error {
+	offset, err := it.table.lookup(key)
+	if err != nil {
+		return err
+	}
+
+	it.SeekOffset(offset)
+	return nil
+}
+
+// SeekOffset positions the iterator before the record at offset, like one
+// returned by Offset.
+func (it *Iterator) SeekOffset(offset int64) {
+	it.offset = offset
+	it.reader = nil
+	it.entry = DataEntry{}
+	it.err = nil
+}
+
+// Next moves to the next entry, and reports whether there is one. At the end
+// of the table, Next can be called again to read the entries appended since.
+func (it *Iterator) Next() bool {
+	it.entry = DataEntry{}
+	if it.closed || it.err != nil {
+		return false
+	}
+
+	for {
+		if it.reader == nil {
+			it.err = it.open()
+			if it.err != nil {
+				return false
+			}
+		}
+
+		entry, err := readDataEntry(it.reader, it.header.Version, it.table.Options.Limits, it.header.cipher)
+		if err == io.EOF {
+			// Look for records appended since the iterator reached the end
+			size := it.size
+			it.err = it.open()
+			if it.err != nil || it.size == size {
+				return false
+			}
+			continue
+		}
+		if err != nil {
+			it.err = err
+			return false
+		}
+
+		it.offset, it.err = it.reader.Seek(0, io.SeekCurrent)
+		if it.err != nil {
+			return false
+		}
+		it.entry = entry
+		return true
+	}
+}
+
+// open reads the records from the iterator offset up to the current end of
+// the data file.
+func (it *Iterator) open() error {
+	header, size, err := it.table.snapshot()
+	if err != nil {
+		return err
+	}
+
+	offset := it.offset
+	if offset < 0 {
+		offset = header.Size()
+	}
+
+	it.reader, err = it.table.records(offset, size)
+	if err != nil {
+		return err
+	}
+	it.header, it.size = header, size
+	return nil
+}
+
+func (it *Iterator) Key() []byte {
+	return it.entry.Key
+}
+
+// Value returns the data of the current entry, nil for tombstones.
+func (it *Iterator) Value() []byte {
+	return it.entry.Data
+}
+
+// Deleted reports whether the current entry is a tombstone.
+func (it *Iterator) Deleted() bool {
+	return it.entry.IsTombstone()
+}
+
+// Offset returns the offset of the current entry in the data file.
+func (it *Iterator) Offset() int64 {
+	return it.entry.Offset
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close stops the iteration: Next returns false from then on.
+func (it *Iterator) Close() error {
+	it.closed = true
+	it.entry = DataEntry{}
+	it.reader = nil
+	return nil
+}
@@ -0,0 +1,142 @@
+package sstable
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func CaptureIterator(it *Iterator) ([]string, error) {
+	entries := []string{}
+	for it.Next() {
+		if it.Deleted() {
+			entries = append(entries, fmt.Sprintf("%s deleted", it.Key()))
+		} else {
+			entries = append(entries, fmt.Sprintf("%s | %s", it.Key(), it.Value()))
+		}
+	}
+
+	return entries, it.Err()
+}
+
+func TestIterator(t *testing.T) {
+	table, teardown, err := GenerateTable(`keyA | valueA
+	                                       keyB | valueB
+	                                       keyC | valueC`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+	table.Delete([]byte("keyB"))
+
+	it := table.Iterator()
+	defer it.Close()
+
+	entries, err := CaptureIterator(it)
+	expected := []string{"keyA | valueA", "keyB | valueB", "keyC | valueC", "keyB deleted"}
+	if err != nil || !reflect.DeepEqual(expected, entries) {
+		t.Errorf("Unexpected entries.\nExpected: %v\nGot:      %v (%v)", expected, entries, err)
+	}
+
+	// Entries appended once the end is reached
+	table.Put([]byte("keyD"), []byte("valueD"))
+	entries, err = CaptureIterator(it)
+	expected = []string{"keyD | valueD"}
+	if err != nil || !reflect.DeepEqual(expected, entries) {
+		t.Errorf("Unexpected appended entries.\nExpected: %v\nGot:      %v (%v)", expected, entries, err)
+	}
+
+	err = it.Seek([]byte("keyC"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	it.Next()
+	offset := it.Offset()
+	if string(it.Key()) != "keyC" || offset != table.Offsets([]byte("keyC"))[0] {
+		t.Errorf("Unexpected entry after seeking keyC.\nExpected: %v at %v\nGot:      %s at %v", "keyC", table.Offsets([]byte("keyC"))[0], it.Key(), offset)
+	}
+
+	err = it.Seek([]byte("keyZ"))
+	if _, ok := err.(NotFoundError); !ok {
+		t.Errorf("Expected seeking an absent key to fail but got %v", err)
+	}
+	it.Next()
+	if string(it.Key()) != "keyB" || !it.Deleted() {
+		t.Errorf("Expected a failed seek to leave the iterator in place but got %s", it.Key())
+	}
+
+	it.SeekOffset(offset)
+	entries, err = CaptureIterator(it)
+	expected = []string{"keyC | valueC", "keyB deleted", "keyD | valueD"}
+	if err != nil || !reflect.DeepEqual(expected, entries) {
+		t.Errorf("Unexpected entries from offset %d.\nExpected: %v\nGot:      %v (%v)", offset, expected, entries, err)
+	}
+
+	it.Close()
+	it.SeekOffset(offset)
+	if it.Next() {
+		t.Errorf("Expected a closed iterator not to move")
+	}
+}
+
+func TestIteratorsPositions(t *testing.T) {
+	table, teardown, err := GenerateTable(`keyA | valueA
+	                                       keyB | valueB`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+
+	first, second := table.Iterator(), table.Iterator()
+	first.Next()
+	second.Next()
+	second.Next()
+	table.Get([]byte("keyB"))
+	first.Next()
+
+	if string(first.Key()) != "keyB" || string(second.Key()) != "keyB" {
+		t.Errorf("Expected iterators to keep their own position.\nExpected: %v %v\nGot:      %s %s", "keyB", "keyB", first.Key(), second.Key())
+	}
+}
+
+func TestIteratorEmptyTable(t *testing.T) {
+	table, teardown, err := GenerateTable("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+	table.Options.Keyring = testKeyring()
+
+	it := table.Iterator()
+	if it.Next() || it.Err() != nil {
+		t.Errorf("Expected an empty table to have no entry but got %s (%v)", it.Key(), it.Err())
+	}
+
+	// The header is written with the first record
+	table.Put([]byte("keyA"), []byte("valueA"))
+	if !it.Next() || string(it.Value()) != "valueA" {
+		t.Errorf("Expected to read the first record appended but got '%s' (%v)", it.Value(), it.Err())
+	}
+}
+
+func TestIteratorCorrupted(t *testing.T) {
+	table, teardown, err := GenerateTable(`keyA | valueA
+	                                       keyB | valueB`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+
+	offset := table.Offsets([]byte("keyB"))[0]
+	table.Data.(*os.File).WriteAt([]byte("X"), offset+17+4)
+
+	it := table.Iterator()
+	entries, err := CaptureIterator(it)
+	if decodeErr, ok := err.(DecodeError); !ok || decodeErr.Offset != offset || len(entries) != 1 {
+		t.Errorf("Expected to stop at the corrupted record at offset %d but got %v (%v)", offset, entries, err)
+	}
+	if it.Next() {
+		t.Errorf("Expected an iterator to stop after an error")
+	}
+}
@@ -0,0 +1,265 @@
+package sstable
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	ErrMmapUnsupported = errors.New("sstable: memory mapping is not supported on this platform")
+	ErrMmapClosed      = errors.New("sstable: memory mapping is closed")
+)
+
+// Mmap reads a data file through a read only memory mapping, so that reading
+// a record takes no system call. The mapping reserves twice the size of the
+// file, so that records appended to it are read without mapping it again
+// until it doubled.
+//
+// Records read through a mapping return their key and data as slices of it:
+// they must not be modified, and are only valid until the mapping is closed.
+// Previous mappings of the file are kept until then for this reason, there
+// are as many as the times the file doubled. Close waits for the records being
+// decoded.
+type Mmap struct {
+	lock sync.RWMutex
+	// idle is signaled when the last reader unpins the mapping once closed
+	idle    *sync.Cond
+	readers int64
+	file    *os.File
+	// data is the part of mapped the file covers: mapped pages past the end
+	// of the file can't be read.
+	data    []byte
+	mapped  []byte
+	retired [][]byte
+	closed  bool
+}
+
+// minMmapSize is the size reserved by the first mapping of a file.
+const minMmapSize = 1 << 20
+
+// OpenMmap maps file, which must not be truncated while it is mapped.
+func OpenMmap(file *os.File) (*Mmap, error) {
+	m := &Mmap{file: file}
+	m.idle = sync.NewCond(&m.lock)
+	_, err := m.remap()
+	if err != nil {
+		m.Close()
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// Reset maps another file, like one rewriting the mapped file. The previous
+// mappings are kept until Close.
+func (m *Mmap) Reset(file *os.File) error {
+	m.lock.Lock()
+	m.file = file
+	if m.mapped != nil {
+		m.retired = append(m.retired, m.mapped)
+		m.data, m.mapped = nil, nil
+	}
+	m.lock.Unlock()
+
+	_, err := m.remap()
+	return err
+}
+
+// slice returns the mapping, mapped again first if it is shorter than end
+// bytes and the file grew since. The mapping must be pinned while the slice
+// is read.
+func (m *Mmap) slice(end int64) ([]byte, error) {
+	m.lock.RLock()
+	data, closed := m.data, m.closed
+	m.lock.RUnlock()
+
+	if closed {
+		return nil, ErrMmapClosed
+	}
+	if int64(len(data)) >= end {
+		return data, nil
+	}
+
+	return m.remap()
+}
+
+func (m *Mmap) remap() ([]byte, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.closed {
+		return nil, ErrMmapClosed
+	}
+
+	info, err := m.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if size <= int64(len(m.data)) {
+		return m.data, nil
+	}
+	if size <= int64(len(m.mapped)) {
+		m.data = m.mapped[:size]
+		return m.data, nil
+	}
+
+	reserved := int64(minMmapSize)
+	for reserved < 2*size {
+		reserved *= 2
+	}
+	mapped, err := mmap(m.file, reserved)
+	if err != nil {
+		return nil, err
+	}
+	if m.mapped != nil {
+		m.retired = append(m.retired, m.mapped)
+	}
+	m.data, m.mapped = mapped[:size], mapped
+
+	return m.data, nil
+}
+
+// pin keeps the mapping from being unmapped until unpin is called. It returns
+// ErrMmapClosed once the mapping is closed.
+func (m *Mmap) pin() error {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	if m.closed {
+		return ErrMmapClosed
+	}
+	atomic.AddInt64(&m.readers, 1)
+	return nil
+}
+
+func (m *Mmap) unpin() {
+	if atomic.AddInt64(&m.readers, -1) > 0 {
+		return
+	}
+
+	m.lock.Lock()
+	if m.closed {
+		m.idle.Broadcast()
+	}
+	m.lock.Unlock()
+}
+
+func (m *Mmap) ReadAt(buff []byte, offset int64) (int, error) {
+	err := m.pin()
+	if err != nil {
+		return 0, err
+	}
+	defer m.unpin()
+
+	r := &mmapReader{m: m, offset: offset, limit: maxOffset}
+	data, err := r.bytes(len(buff))
+	return copy(buff, data), err
+}
+
+// Close waits for the records being decoded, then unmaps the file. It doesn't
+// close it.
+func (m *Mmap) Close() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.closed = true
+	for atomic.LoadInt64(&m.readers) > 0 {
+		m.idle.Wait()
+	}
+
+	var err error
+	for _, data := range append(m.retired, m.mapped) {
+		if data == nil {
+			continue
+		}
+		unmapErr := munmap(data)
+		if err == nil {
+			err = unmapErr
+		}
+	}
+
+	m.data, m.mapped, m.retired = nil, nil, nil
+	return err
+}
+
+// mmapReader reads a mapped file from offset up to limit. Its fields are read
+// as slices of the mapping, which is pinned while a record is decoded.
+type mmapReader struct {
+	m      *Mmap
+	offset int64
+	limit  int64
+}
+
+func (r *mmapReader) pin() error {
+	return r.m.pin()
+}
+
+func (r *mmapReader) unpin() {
+	r.m.unpin()
+}
+
+func (r *mmapReader) Read(buff []byte) (int, error) {
+	data, err := r.bytes(len(buff))
+	return copy(buff, data), err
+}
+
+func (r *mmapReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	default:
+		return r.offset, errors.New("sstable: mmapReader.Seek: invalid whence")
+	}
+	if offset < 0 {
+		return r.offset, errors.New("sstable: mmapReader.Seek: negative position")
+	}
+
+	r.offset = offset
+	return r.offset, nil
+}
+
+// next returns the next n bytes, io.ErrUnexpectedEOF if there are less left.
+func (r *mmapReader) next(n int) ([]byte, error) {
+	data, err := r.bytes(n)
+	if len(data) < n {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	return data, err
+}
+
+// bytes returns the next n bytes, or the ones left before the limit or the
+// end of the file along with io.EOF.
+func (r *mmapReader) bytes(n int) ([]byte, error) {
+	if n == 0 {
+		return nil, nil
+	}
+
+	end := r.offset + int64(n)
+	if end > r.limit || end < r.offset {
+		end = r.limit
+	}
+	data, err := r.m.slice(end)
+	if err != nil {
+		return nil, err
+	}
+	if end > int64(len(data)) {
+		end = int64(len(data))
+	}
+	if r.offset >= end {
+		return nil, io.EOF
+	}
+
+	data = data[r.offset:end:end]
+	r.offset = end
+	if len(data) < n {
+		return data, io.EOF
+	}
+
+	return data, nil
+}
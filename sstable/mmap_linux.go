@@ -0,0 +1,17 @@
+//go:build linux
+// +build linux
+
+package sstable
+
+import (
+	"os"
+	"syscall"
+)
+
+func mmap(file *os.File, size int64) ([]byte, error) {
+	return syscall.Mmap(int(file.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmap(data []byte) error {
+	return syscall.Munmap(data)
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package sstable
+
+import "os"
+
+func mmap(file *os.File, size int64) ([]byte, error) {
+	return nil, ErrMmapUnsupported
+}
+
+func munmap(data []byte) error {
+	return nil
+}
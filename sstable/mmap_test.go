@@ -0,0 +1,200 @@
+package sstable
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMmap(t *testing.T) {
+	table, teardown, err := GenerateTable(`keyA | valueA
+	                                       keyB | valueB`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+
+	mapping, err := OpenMmap(table.Data.(*os.File))
+	if err == ErrMmapUnsupported {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	table.Reader = mapping
+
+	value, err := table.Get([]byte("keyA"))
+	if err != nil || bytes.Compare(value, []byte("valueA")) != 0 {
+		t.Errorf("Expected to read a mapped record but got '%s' (%v)", value, err)
+	}
+
+	// Values are slices of the mapping
+	start := reflect.ValueOf(mapping.data).Pointer()
+	pointer := reflect.ValueOf(value).Pointer()
+	if pointer < start || pointer >= start+uintptr(len(mapping.data)) {
+		t.Errorf("Expected the value to be read from the mapping")
+	}
+
+	// Records appended after the file was mapped
+	err = table.Put([]byte("keyC"), []byte("valueC"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err = table.Get([]byte("keyC"))
+	if err != nil || bytes.Compare(value, []byte("valueC")) != 0 {
+		t.Errorf("Expected to read a record appended to the mapped file but got '%s' (%v)", value, err)
+	}
+	values, err := CaptureScanAll(table)
+	if err != nil || len(values) != 3 {
+		t.Errorf("Expected to scan every mapped record but got %v (%v)", values, err)
+	}
+
+	keys, err := CaptureScanRange(table, Range{Reverse: true, Limit: 1})
+	if err != nil || !reflect.DeepEqual([]string{"keyC"}, keys) {
+		t.Errorf("Expected to scan the last mapped record but got %v (%v)", keys, err)
+	}
+
+	size, _ := table.Data.Seek(0, io.SeekEnd)
+	buff := make([]byte, 10)
+	n, err := mapping.ReadAt(buff, size-4)
+	if n != 4 || err != io.EOF {
+		t.Errorf("Unexpected read past the end of the file.\nExpected: %v %v\nGot:      %v %v", 4, io.EOF, n, err)
+	}
+
+	err = mapping.Close()
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = table.Get([]byte("keyA"))
+	if decodeErr, ok := err.(DecodeError); !ok || decodeErr.Err != ErrMmapClosed {
+		t.Errorf("Unexpected error reading a closed mapping.\nExpected: %v\nGot:      %v", ErrMmapClosed, err)
+	}
+}
+
+func TestMmapReset(t *testing.T) {
+	table, teardown, err := GenerateTable(`keyA | valueA`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+	rewritten, rewrittenTeardown, err := GenerateTable(`keyA | valueB`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rewrittenTeardown()
+
+	mapping, err := OpenMmap(table.Data.(*os.File))
+	if err == ErrMmapUnsupported {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mapping.Close()
+	table.Reader = mapping
+
+	before, err := table.Get([]byte("keyA"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = mapping.Reset(rewritten.Data.(*os.File))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rewritten.Reader = mapping
+
+	after, err := rewritten.Get([]byte("keyA"))
+	if err != nil || bytes.Compare(after, []byte("valueB")) != 0 {
+		t.Errorf("Expected to read the remapped file but got '%s' (%v)", after, err)
+	}
+	if bytes.Compare(before, []byte("valueA")) != 0 {
+		t.Errorf("Expected values read before a reset to stay valid but got '%s'", before)
+	}
+}
+
+func TestMmapGrowth(t *testing.T) {
+	table, teardown, err := GenerateTable(`keyA | valueA`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+
+	mapping, err := OpenMmap(table.Data.(*os.File))
+	if err == ErrMmapUnsupported {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mapping.Close()
+	table.Reader = mapping
+
+	// Read after every append, up to 4MiB
+	value := bytes.Repeat([]byte("v"), 32<<10)
+	for i := 0; i < 128; i++ {
+		key := []byte(fmt.Sprintf("key%03d", i))
+		err = table.Put(key, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = table.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The file doubled twice past the first reservation
+	if len(mapping.retired) > 2 {
+		t.Errorf("Expected the file to be mapped again only when it doubled.\nExpected: <= %v\nGot:      %v", 2, len(mapping.retired))
+	}
+}
+
+func TestMmapCloseWaitsForReaders(t *testing.T) {
+	table, teardown, err := GenerateTable(`keyA | valueA`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+
+	mapping, err := OpenMmap(table.Data.(*os.File))
+	if err == ErrMmapUnsupported {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A record being decoded
+	err = mapping.pin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	closed := make(chan error)
+	go func() {
+		closed <- mapping.Close()
+	}()
+
+	select {
+	case <-closed:
+		t.Fatal("Expected Close to wait for the mapping to be unpinned")
+	case <-time.After(20 * time.Millisecond):
+	}
+	if mapping.data == nil {
+		t.Errorf("Expected the mapping to stay mapped while pinned")
+	}
+
+	mapping.unpin()
+	err = <-closed
+	if err != nil {
+		t.Error(err)
+	}
+	if mapping.pin() != ErrMmapClosed {
+		t.Errorf("Expected a closed mapping not to be pinned")
+	}
+}
@@ -0,0 +1,331 @@
+package sstable
+
+import (
+	"bytes"
+	"container/heap"
+	"fmt"
+	"io"
+)
+
+// Range bounds the entries read by ScanRange, in insert order. Its zero value
+// covers the whole table.
+//
+// Start and End are keys, but the range is in insert order rather than key
+// order: it starts at the last version of the smallest key from Start on, and
+// ends before the last version of End. When End isn't in the table, the range
+// ends after the last version of the greatest key before it instead. Offsets
+// which are not the start of an entry are refused with a BoundaryError.
+type Range struct {
+	// Start starts the range. Without it, the range starts at StartOffset,
+	// the offset of an entry like the ones Iterator.Offset returns, or at the
+	// first entry.
+	Start       []byte
+	StartOffset int64
+	// End ends the range, excluded. Without it, the range ends before the
+	// entry at EndOffset, or at the end of the table.
+	End       []byte
+	EndOffset int64
+	// Limit is the maximum number of entries scanned, 0 for no limit.
+	Limit int
+	// Reverse scans the range newest entry first: with Limit, the last entries
+	// of the range are scanned.
+	Reverse bool
+}
+
+// ScanRange calls fn for every entry of the range. Like Scan, only the last
+// version of a key is yielded, and none for deleted keys: the others are not
+// counted in the limit.
+func (t SSTable) ScanRange(r Range, fn func(key, data []byte)) error {
+	return t.scanRange(r, true, func(entry DataEntry) {
+		fn(entry.Key, entry.Data)
+	})
+}
+
+// ScanRangeEntries is ScanRange yielding every entry, tombstones included.
+func (t SSTable) ScanRangeEntries(r Range, fn func(entry DataEntry)) error {
+	return t.scanRange(r, false, fn)
+}
+
+func (t SSTable) scanRange(r Range, skipTombstones bool, fn func(entry DataEntry)) error {
+	header, size, err := t.snapshot()
+	if err != nil {
+		return err
+	}
+
+	start, end, err := t.bounds(r, header, size)
+	if err != nil || start >= end {
+		return err
+	}
+
+	if r.Reverse && skipTombstones {
+		return t.scanReverseLive(header, start, end, r.Limit, fn)
+	}
+	if r.Reverse {
+		return t.scanReverse(header, start, end, r.Limit, fn)
+	}
+
+	reader, err := t.records(start, end)
+	if err != nil {
+		return err
+	}
+
+	for count := 0; r.Limit <= 0 || count < r.Limit; {
+		entry, err := readDataEntry(reader, header.Version, t.Options.Limits, header.cipher)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if skipTombstones && !t.live(entry) {
+			continue
+		}
+
+		fn(entry)
+		count++
+	}
+
+	return nil
+}
+
+// bounds returns the offsets the range starts and ends at.
+func (t SSTable) bounds(r Range, header Header, size int64) (int64, int64, error) {
+	var err error
+
+	start := header.Size()
+	if r.Start != nil {
+		start, err = t.startOf(r.Start, size)
+		if err != nil {
+			return 0, 0, err
+		}
+	} else if r.StartOffset != 0 {
+		if !t.boundary(header, r.StartOffset, size) {
+			return 0, 0, BoundaryError{Offset: r.StartOffset}
+		}
+		start = r.StartOffset
+	}
+
+	end := size
+	if r.End != nil {
+		end, err = t.endOf(r.End, header, size)
+		if err != nil {
+			return 0, 0, err
+		}
+	} else if r.EndOffset != 0 && r.EndOffset < end {
+		if !t.boundary(header, r.EndOffset, size) {
+			return 0, 0, BoundaryError{Offset: r.EndOffset}
+		}
+		end = r.EndOffset
+	}
+
+	return start, end, nil
+}
+
+// startOf returns the offset of the last version of the smallest key greater
+// than or equal to key, size when there is none.
+func (t SSTable) startOf(key []byte, size int64) (int64, error) {
+	ok, found, err := t.nearest(key, false)
+	if err != nil || !ok {
+		return size, err
+	}
+	return t.lookup(found)
+}
+
+// endOf returns the offset of the last version of key, or the offset following
+// the last version of the greatest key less than key when key isn't indexed.
+func (t SSTable) endOf(key []byte, header Header, size int64) (int64, error) {
+	ok, found, err := t.nearest(key, true)
+	if err != nil || !ok {
+		return header.Size(), err
+	}
+	offset, err := t.lookup(found)
+	if err != nil || bytes.Equal(found, key) {
+		return offset, err
+	}
+
+	r, err := t.records(offset, size)
+	if err != nil {
+		return 0, err
+	}
+	_, err = skipDataEntry(r, header.Version)
+	if err != nil {
+		return 0, DecodeError{Offset: offset, Err: err}
+	}
+	return r.Seek(0, io.SeekCurrent)
+}
+
+// nearest returns the smallest indexed key greater than or equal to key, or
+// the greatest one less than or equal to it with floor.
+func (t SSTable) nearest(key []byte, floor bool) (bool, []byte, error) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	var ok bool
+	var found []byte
+	if floor {
+		ok, found, _ = t.offsets().Floor(key)
+	} else {
+		ok, found, _ = t.offsets().Ceiling(key)
+	}
+	return ok, found, t.indexErr()
+}
+
+// boundary reports whether a record starts at offset, or whether it is past
+// the records of the first size bytes of the data file.
+func (t SSTable) boundary(header Header, offset, size int64) bool {
+	if offset == header.Size() || offset >= size {
+		return true
+	}
+	if offset < header.Size() {
+		return false
+	}
+
+	r, err := t.records(offset, size)
+	if err != nil {
+		return false
+	}
+	_, err = readDataEntry(r, header.Version, t.Options.Limits, header.cipher)
+	return err == nil
+}
+
+// scanReverse reads every entry between start and end newest first. Records
+// can only be read forward: the offsets of the last limit ones are collected
+// first, skipping over their content.
+func (t SSTable) scanReverse(header Header, start, end int64, limit int, fn func(entry DataEntry)) error {
+	reader, err := t.records(start, end)
+	if err != nil {
+		return err
+	}
+
+	offsets := []int64{}
+	for offset := start; ; {
+		_, err := skipDataEntry(reader, header.Version)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return DecodeError{Offset: offset, Err: err}
+		}
+
+		if limit > 0 && len(offsets) == limit {
+			offsets = offsets[1:]
+		}
+		offsets = append(offsets, offset)
+
+		offset, err = reader.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := len(offsets) - 1; i >= 0; i-- {
+		entry, err := t.readRange(header, offsets[i], end)
+		if err != nil {
+			return err
+		}
+		fn(entry)
+	}
+
+	return nil
+}
+
+// scanReverseLive reads the live entries between start and end newest first.
+// Those are the last versions of their keys, which the index points at: it is
+// walked for the newest offsets of the range, limit at a time, and only the
+// entries at them are read, until limit of them are live.
+func (t SSTable) scanReverseLive(header Header, start, end int64, limit int, fn func(entry DataEntry)) error {
+	for count := 0; limit <= 0 || count < limit; {
+		offsets := t.newestOffsets(start, end, limit-count)
+		if len(offsets) == 0 {
+			return nil
+		}
+
+		for _, offset := range offsets {
+			entry, err := t.readRange(header, offset, end)
+			if err != nil {
+				return err
+			}
+			if !t.live(entry) {
+				continue
+			}
+
+			fn(entry)
+			count++
+		}
+		if limit <= 0 {
+			return nil
+		}
+		end = offsets[len(offsets)-1]
+	}
+
+	return nil
+}
+
+// newestOffsets returns, newest first, the n greatest offsets between start
+// and end the index holds for the last version of a key, all of them when n
+// isn't positive.
+func (t SSTable) newestOffsets(start, end int64, n int) []int64 {
+	newest := &offsetHeap{}
+	add := func(offset int64) {
+		if offset < start || offset >= end {
+			return
+		}
+		heap.Push(newest, offset)
+		if n > 0 && newest.Len() > n {
+			heap.Pop(newest)
+		}
+	}
+
+	// With MultiValue every version is indexed, the last one walked last
+	var last []byte
+	var lastOffset int64
+	t.Walk(func(key []byte, offset int64) {
+		if last != nil && !bytes.Equal(key, last) {
+			add(lastOffset)
+		}
+		last, lastOffset = append(last[:0], key...), offset
+	})
+	if last != nil {
+		add(lastOffset)
+	}
+
+	offsets := make([]int64, newest.Len())
+	for i := len(offsets) - 1; i >= 0; i-- {
+		offsets[i] = heap.Pop(newest).(int64)
+	}
+	return offsets
+}
+
+// offsetHeap is a min-heap of offsets.
+type offsetHeap []int64
+
+func (h offsetHeap) Len() int            { return len(h) }
+func (h offsetHeap) Less(i, j int) bool  { return h[i] < h[j] }
+func (h offsetHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *offsetHeap) Push(x interface{}) { *h = append(*h, x.(int64)) }
+
+func (h *offsetHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// readRange reads the entry at offset, within a range ending at end.
+func (t SSTable) readRange(header Header, offset, end int64) (DataEntry, error) {
+	reader, err := t.records(offset, end)
+	if err != nil {
+		return DataEntry{}, err
+	}
+
+	return readDataEntry(reader, header.Version, t.Options.Limits, header.cipher)
+}
+
+// BoundaryError reports a range offset which is not the start of an entry.
+type BoundaryError struct {
+	Offset int64
+}
+
+func (e BoundaryError) Error() string {
+	return fmt.Sprintf("Offset %d is not the start of an entry.", e.Offset)
+}
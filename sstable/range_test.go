@@ -0,0 +1,158 @@
+package sstable
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func CaptureScanRange(table SSTable, r Range) ([]string, error) {
+	keys := []string{}
+
+	err := table.ScanRange(r, func(key, value []byte) {
+		keys = append(keys, string(key))
+	})
+
+	return keys, err
+}
+
+func TestScanRange(t *testing.T) {
+	table, teardown, err := GenerateTable(`keyA | valueA
+	                                       keyB | valueB
+	                                       keyC | valueC
+	                                       keyD | valueD
+	                                       keyE | valueE`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+	table.Delete([]byte("keyX"))
+	table.Put([]byte("keyF"), []byte("valueF"))
+
+	offsetB := table.Offsets([]byte("keyB"))[0]
+	offsetE := table.Offsets([]byte("keyE"))[0]
+
+	tt := []struct {
+		Range Range
+		Keys  []string
+	}{
+		{Range{}, []string{"keyA", "keyB", "keyC", "keyD", "keyE", "keyF"}},
+		{Range{Start: []byte("keyB"), End: []byte("keyE")}, []string{"keyB", "keyC", "keyD"}},
+		{Range{StartOffset: offsetB, EndOffset: offsetE}, []string{"keyB", "keyC", "keyD"}},
+		{Range{Start: []byte("keyC"), Limit: 2}, []string{"keyC", "keyD"}},
+		{Range{Start: []byte("keyE"), End: []byte("keyB")}, []string{}},
+		{Range{Start: []byte("keyB"), End: []byte("keyB")}, []string{}},
+		{Range{Reverse: true}, []string{"keyF", "keyE", "keyD", "keyC", "keyB", "keyA"}},
+		{Range{Reverse: true, Limit: 3}, []string{"keyF", "keyE", "keyD"}},
+		{Range{Start: []byte("keyB"), EndOffset: offsetE, Reverse: true, Limit: 2}, []string{"keyD", "keyC"}},
+		{Range{Start: []byte("keyB"), Reverse: true, Limit: 10}, []string{"keyF", "keyE", "keyD", "keyC", "keyB"}},
+		// Absent keys are resolved to the nearest ones
+		{Range{Start: []byte("keyBB")}, []string{"keyC", "keyD", "keyE", "keyF"}},
+		{Range{Start: []byte("a"), End: []byte("keyCC")}, []string{"keyA", "keyB", "keyC"}},
+		{Range{End: []byte("keyCC"), Reverse: true, Limit: 2}, []string{"keyC", "keyB"}},
+		{Range{End: []byte("keyZ")}, []string{"keyA", "keyB", "keyC", "keyD", "keyE"}},
+		{Range{Start: []byte("keyZ")}, []string{}},
+		{Range{End: []byte("a")}, []string{}},
+	}
+
+	for _, example := range tt {
+		keys, err := CaptureScanRange(table, example.Range)
+		if err != nil {
+			t.Error(err)
+		}
+		if !reflect.DeepEqual(example.Keys, keys) {
+			t.Errorf("Unexpected keys scanning %+v.\nExpected: %v\nGot:      %v", example.Range, example.Keys, keys)
+		}
+	}
+
+	for _, r := range []Range{{StartOffset: offsetB + 1}, {StartOffset: 1}, {StartOffset: -1}, {EndOffset: offsetE - 1}, {EndOffset: -1}} {
+		_, err = CaptureScanRange(table, r)
+		if _, ok := err.(BoundaryError); !ok {
+			t.Errorf("Expected scanning %+v to fail with a BoundaryError but got %v", r, err)
+		}
+	}
+}
+
+func TestScanRangeLastVersions(t *testing.T) {
+	table, teardown, err := GenerateTable(`keyA | valueA
+	                                       keyB | valueB
+	                                       keyC | valueC`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+	table.Put([]byte("keyA"), []byte("valueA2"))
+	table.Delete([]byte("keyB"))
+
+	tt := []struct {
+		Range Range
+		Keys  []string
+	}{
+		{Range{}, []string{"keyC", "keyA"}},
+		{Range{Limit: 1}, []string{"keyC"}},
+		{Range{Reverse: true}, []string{"keyA", "keyC"}},
+		{Range{Reverse: true, Limit: 2}, []string{"keyA", "keyC"}},
+		// The newest entry is a deletion, older ones are looked up past it
+		{Range{Reverse: true, Limit: 1}, []string{"keyA"}},
+	}
+
+	for _, example := range tt {
+		keys, err := CaptureScanRange(table, example.Range)
+		if err != nil {
+			t.Error(err)
+		}
+		if !reflect.DeepEqual(example.Keys, keys) {
+			t.Errorf("Unexpected keys scanning %+v.\nExpected: %v\nGot:      %v", example.Range, example.Keys, keys)
+		}
+	}
+}
+
+func TestScanRangeEntries(t *testing.T) {
+	table, teardown, err := GenerateTable(`keyA | valueA
+	                                       keyB | valueB`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+	table.Delete([]byte("keyA"))
+
+	for _, reverse := range []bool{false, true} {
+		entries := []string{}
+		err = table.ScanRangeEntries(Range{Limit: 2, Reverse: reverse}, func(entry DataEntry) {
+			entries = append(entries, fmt.Sprintf("%s %v", entry.Key, entry.IsTombstone()))
+		})
+
+		expected := []string{"keyA false", "keyB false"}
+		if reverse {
+			expected = []string{"keyA true", "keyB false"}
+		}
+		if err != nil || !reflect.DeepEqual(expected, entries) {
+			t.Errorf("Unexpected entries scanning reverse %v.\nExpected: %v\nGot:      %v (%v)", reverse, expected, entries, err)
+		}
+	}
+}
+
+func TestScanRangeLegacy(t *testing.T) {
+	file, err := ioutil.TempFile("", "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+
+	NewDataEntry([]byte("FOO"), []byte("foo")).WriteVersion(file, LegacyVersion)
+	NewTombstone([]byte("FOO")).WriteVersion(file, LegacyVersion)
+	NewDataEntry([]byte("BAR"), []byte("bar")).WriteVersion(file, LegacyVersion)
+
+	table, err := Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := CaptureScanRange(table, Range{Reverse: true})
+	expected := []string{"BAR"}
+	if err != nil || !reflect.DeepEqual(expected, keys) {
+		t.Errorf("Unexpected keys scanning a legacy table in reverse.\nExpected: %v\nGot:      %v (%v)", expected, keys, err)
+	}
+}
@@ -1,158 +1,1115 @@
 package sstable
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"math"
+	"sync"
 
 	"github.com/journald/btree"
 )
 
 type SSTable struct {
+	// Index maps keys to the offset of their records, unless the DiskIndex
+	// option is set.
 	Index *btree.Tree
-	Data  io.ReadWriteSeeker
+	// Filter holds every indexed key, so that lookups of absent keys stop
+	// before searching the index.
+	Filter *BloomFilter
+	// Header describes the data file. It is written along with the first
+	// record of an empty file.
+	Header *Header
+	Data   io.ReadWriteSeeker
+	// Reader reads the records instead of Data when set, like a memory
+	// mapping of the data file. It must see the records appended to Data.
+	Reader  io.ReaderAt
+	Options Options
+	// Dropped is the size of the torn tail cut off the data file when the
+	// table was loaded.
+	Dropped int64
+
+	// lock guards the index, the filter and the header: readers share it,
+	// appends hold it alone. Records are read at their offset rather than
+	// through the cursor of Data, which only appends move.
+	lock *sync.RWMutex
+}
+
+type Options struct {
+	// MultiValue keeps the offset of every version of a key in the index
+	// instead of the last one only. Size and Keys then count every version.
+	MultiValue bool
+	// Limits bounds the key and value sizes accepted by Put and when reading
+	// records.
+	Limits Limits
+	// Codec compresses the values written, nil stores them as is. Records
+	// compressed with any registered codec are read whatever this option.
+	Codec Codec
+	// Strict refuses to load a data file ending with a torn record, left by an
+	// interrupted write, instead of cutting it off.
+	Strict bool
+	// Keyring encrypts the values of new data files with AES-GCM, and holds
+	// the keys to read encrypted ones. Nil writes them in plaintext.
+	Keyring *Keyring
+	// EncryptKeys encrypts keys along with values. Their index can't be saved
+	// then, as it would hold them in plaintext.
+	EncryptKeys bool
+	// DiskIndex indexes keys in a paged tree instead of the in memory Index,
+	// for tables with more keys than memory holds. FlushIndex saves it along
+	// with the size of the data it covers, and LoadWithOptions then only
+	// indexes the records appended since. It doesn't hold every version of a
+	// key, nor encrypted keys.
+	DiskIndex *btree.DiskTree
+}
+
+var (
+	ErrEncryptedKeys       = errors.New("sstable: index of encrypted keys can't be saved")
+	ErrDiskIndexMultiValue = errors.New("sstable: disk index can't hold every version of a key")
+	ErrDiskIndex           = errors.New("sstable: disk index is saved with FlushIndex")
+)
+
+// offsetIndex is the index of the table, the in memory Index or the DiskIndex
+// option.
+type offsetIndex interface {
+	Search(key []byte) (bool, int64)
+	Ceiling(key []byte) (bool, []byte, int64)
+	Floor(key []byte) (bool, []byte, int64)
+	Replace(key []byte, value int64) (bool, int64)
+	Walk(fn btree.WalkerFunc)
+	Len() int
 }
 
 func New(data io.ReadWriteSeeker) SSTable {
+	return NewWithOptions(data, Options{})
+}
+
+func NewWithOptions(data io.ReadWriteSeeker, options Options) SSTable {
+	var index *btree.Tree
+	if options.DiskIndex == nil {
+		index = btree.New()
+	}
+
 	return SSTable{
-		Index: btree.New(),
-		Data:  data,
+		Index:   index,
+		Filter:  NewBloomFilter(DefaultFilterCapacity, DefaultFalsePositive),
+		Header:  &Header{Version: CurrentVersion},
+		Data:    data,
+		Options: options,
+		lock:    &sync.RWMutex{},
 	}
 }
 
+// Load indexes the data file. Use LoadWithOptions to know the size of a torn
+// tail cut off the file.
 func (t SSTable) Load() error {
-	_, err := t.Data.Seek(0, io.SeekStart)
+	_, err := t.load()
+	return err
+}
+
+func (t SSTable) load() (int64, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	err := t.loadHeader()
+	if err == io.ErrUnexpectedEOF {
+		dropped, err := t.truncateTail(0, 0, err)
+		if err == nil && t.Options.DiskIndex != nil {
+			t.Options.DiskIndex.Clear()
+		}
+		return dropped, err
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	offset := t.Header.Size()
+	if t.Options.DiskIndex != nil {
+		offset, err = t.resumeDiskIndex()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return t.replay(offset)
+}
+
+// resumeDiskIndex returns the offset the entries the DiskIndex option doesn't
+// cover yet start at, as recorded by FlushIndex. A disk index which was not
+// flushed, saved from another data file or covering more than it holds, is
+// cleared to be rebuilt.
+func (t SSTable) resumeDiskIndex() (int64, error) {
+	disk := t.Options.DiskIndex
+	size, err := t.Data.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+
+	saved, err := readIndexHeader(bytes.NewReader(disk.Meta()))
+	if err == nil && disk.Err() == nil && saved.covered > 0 && saved.covered <= size &&
+		saved == t.indexHeader(saved.covered) {
+		*t.Filter = *t.buildFilter(DefaultFilterCapacity)
+		return saved.covered, t.indexErr()
+	}
+
+	disk.Clear()
+	return t.Header.Size(), nil
+}
+
+// loadHeader reads the header of the data file, unless it is empty.
+func (t SSTable) loadHeader() error {
+	header, err := ReadHeader(t.section(maxOffset))
+	if err == io.EOF {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
+	if header.Flags&FlagBlocks != 0 {
+		return ErrBlockTable
+	}
+	if header.Flags&FlagEncrypted != 0 {
+		header.cipher, err = t.Options.Keyring.unwrap(header.KeyID, header.WrappedKey)
+		if err != nil {
+			return err
+		}
+		header.cipher.keys = header.Flags&FlagEncryptedKeys != 0
+	}
+
+	*t.Header = header
+	return nil
+}
+
+// replay indexes every entry stored from offset to the end of the data file.
+// It returns the size of the torn tail cut off the file, if any.
+func (t SSTable) replay(offset int64) (int64, error) {
+	r, err := t.records(offset, maxOffset)
+	if err != nil {
+		return 0, err
+	}
 
 	for {
-		entry, err := ReadDataEntry(t.Data)
+		entry, err := readDataEntry(r, t.Header.Version, t.Options.Limits, t.Header.cipher)
+		if err == io.EOF {
+			return 0, nil
+		}
 		if err != nil {
-			if err == io.EOF {
-				break
-			}
+			end, _ := r.Seek(0, io.SeekCurrent)
+			return t.truncateTail(entry.Offset, end, err)
+		}
+
+		err = t.index(entry.Key, entry.Offset)
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// truncater is implemented by data files able to cut off a torn tail, like
+// *os.File.
+type truncater interface {
+	Truncate(size int64) error
+}
+
+// truncateTail cuts the data file back to offset, where reading a record
+// failed at end, if the record is the torn tail of an interrupted write. It
+// returns the number of bytes cut off.
+func (t SSTable) truncateTail(offset, end int64, cause error) (int64, error) {
+	follows := func(offset, size int64) bool {
+		return recordFollows(t.readerAt(), offset, size, func(r io.ReadSeeker) error {
+			_, err := readDataEntry(r, t.Header.Version, t.Options.Limits, t.Header.cipher)
 			return err
+		})
+	}
+
+	dropped, err := truncateTail(t.Data, t.Options.Strict, offset, end, cause, follows)
+	if err == nil && offset == 0 {
+		// Empty again, a header will be written with the next record
+		*t.Header = Header{Version: CurrentVersion}
+	}
+
+	return dropped, err
+}
+
+// truncateTail cuts data back to offset if the record failing to read there
+// at end is a torn tail: it is cut short, or ends with the file but doesn't
+// match its checksum. A record with an invalid length or checksum before the
+// end of the file is a torn tail too when follows, if not nil, finds no valid
+// record after it: the file system may leave zeros or garbage past a write
+// interrupted by a crash. Other failures are returned as is, and torn tails as
+// a TornWriteError when strict or when data can't be truncated.
+func truncateTail(data io.Seeker, strict bool, offset, end int64, cause error, follows func(offset, size int64) bool) (int64, error) {
+	size, err := data.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+
+	reason := cause
+	if decodeErr, ok := cause.(DecodeError); ok {
+		reason = decodeErr.Err
+	}
+	_, corrupted := reason.(CorruptedDataError)
+	_, invalidLength := reason.(LengthError)
+	corrupted = corrupted || reason == ErrBlockChecksum
+	torn := reason == io.ErrUnexpectedEOF || (corrupted && end == size)
+	if !torn && (corrupted || invalidLength) && follows != nil {
+		torn = !follows(offset, size)
+	}
+	if !torn {
+		return 0, cause
+	}
+
+	file, ok := data.(truncater)
+	if strict || !ok {
+		return 0, TornWriteError{Offset: offset, Size: size - offset, Err: cause}
+	}
+
+	err = file.Truncate(offset)
+	if err != nil {
+		return 0, err
+	}
+
+	return size - offset, nil
+}
+
+// recordFollows reports whether a record starts after offset in the first
+// size bytes of r, read passing its checksum. Every byte is tried in turn, so
+// that garbage of any length is skipped.
+func recordFollows(r io.ReaderAt, offset, size int64, read func(r io.ReadSeeker) error) bool {
+	for start := offset + 1; start < size; start++ {
+		if read(io.NewSectionReader(r, start, size-start)) == nil {
+			return true
 		}
+	}
+	return false
+}
+
+// index records offset as the last version of key. Only a DiskIndex fails
+// to, when it can't hold the key or failed reading or writing its file.
+func (t SSTable) index(key []byte, offset int64) error {
+	err := t.checkDiskIndex()
+	if err != nil {
+		return err
+	}
 
-		t.Index.Insert(entry.Key, entry.Offset)
+	if t.Options.MultiValue {
+		t.Index.Insert(key, offset)
+	} else if replaced, _ := t.offsets().Replace(key, offset); replaced {
+		return t.indexErr()
 	}
 
+	t.Filter.Add(key)
+	if t.Filter.Full() {
+		*t.Filter = *t.buildFilter(2 * t.Filter.Capacity())
+	}
+	return t.indexErr()
+}
+
+// checkDiskIndex refuses the modes a DiskIndex option can't index.
+func (t SSTable) checkDiskIndex() error {
+	if t.Options.DiskIndex == nil {
+		return nil
+	}
+	if t.Options.MultiValue {
+		return ErrDiskIndexMultiValue
+	}
+	if t.Header.Flags&FlagEncryptedKeys != 0 {
+		return ErrEncryptedKeys
+	}
 	return nil
 }
 
+// offsets returns the index in use, the DiskIndex option when set.
+func (t SSTable) offsets() offsetIndex {
+	if t.Options.DiskIndex != nil {
+		return t.Options.DiskIndex
+	}
+	return t.Index
+}
+
+// indexErr returns the error which failed the DiskIndex option, if any.
+func (t SSTable) indexErr() error {
+	if t.Options.DiskIndex != nil {
+		return t.Options.DiskIndex.Err()
+	}
+	return nil
+}
+
+// buildFilter creates a filter holding every indexed key.
+func (t SSTable) buildFilter(capacity int64) *BloomFilter {
+	index := t.offsets()
+	if capacity < int64(index.Len()) {
+		capacity = int64(index.Len())
+	}
+
+	filter := NewBloomFilter(capacity, DefaultFalsePositive)
+	index.Walk(func(key []byte, offset int64) {
+		filter.Add(key)
+	})
+
+	return filter
+}
+
+// MayContain returns false when key is not in the table. Otherwise it most
+// likely is, but only a lookup tells.
+func (t SSTable) MayContain(key []byte) bool {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	return t.Filter.MayContain(key)
+}
+
 func Load(data io.ReadWriteSeeker) (SSTable, error) {
-	t := New(data)
-	return t, t.Load()
+	return LoadWithOptions(data, Options{})
+}
+
+func LoadWithOptions(data io.ReadWriteSeeker, options Options) (SSTable, error) {
+	t := NewWithOptions(data, options)
+	dropped, err := t.load()
+	t.Dropped = dropped
+	return t, err
+}
+
+// Index file format:
+//
+//	magic - version - flags - created - covered - crc32c | tree | filter
+//
+// flags records the options the tree was built with, covered is the size of
+// the data file the index was saved from and created the creation time in its
+// header, which tells it apart from another data file. The CRC32C covers the
+// fields before it; the tree and the filter carry their own.
+
+var indexMagic = [4]byte{'J', 'S', 'T', 'I'}
+
+const (
+	indexVersion    = uint32(1)
+	indexHeaderSize = 4 + 4 + 4 + 8 + 8 + 4
+
+	// indexMultiValue marks trees holding every version of a key
+	indexMultiValue = uint32(1 << 0)
+	// indexBlocks marks the block lists of block tables
+	indexBlocks = uint32(1 << 1)
+)
+
+var (
+	ErrInvalidIndex  = errors.New("sstable: not an index file")
+	ErrIndexChecksum = errors.New("sstable: index file checksum mismatch")
+	ErrForeignIndex  = errors.New("sstable: index was saved from another data file")
+	ErrIndexMode     = errors.New("sstable: index was saved with another MultiValue mode")
+)
+
+// indexHeader describes the data file an index was saved from.
+type indexHeader struct {
+	flags   uint32
+	created int64
+	covered int64
+}
+
+func (h indexHeader) write(w io.Writer) error {
+	buff := make([]byte, 0, indexHeaderSize)
+	buff = append(buff, indexMagic[:]...)
+	buff = appendUint32(buff, indexVersion)
+	buff = appendUint32(buff, h.flags)
+	buff = appendUint64(buff, uint64(h.created))
+	buff = appendUint64(buff, uint64(h.covered))
+	buff = appendUint32(buff, crc32.Checksum(buff, castagnoli))
+
+	_, err := w.Write(buff)
+	return err
+}
+
+func readIndexHeader(r io.Reader) (indexHeader, error) {
+	buff := make([]byte, indexHeaderSize)
+	_, err := io.ReadFull(r, buff)
+	if err != nil {
+		return indexHeader{}, err
+	}
+
+	if string(buff[:4]) != string(indexMagic[:]) || binary.LittleEndian.Uint32(buff[4:]) != indexVersion {
+		return indexHeader{}, ErrInvalidIndex
+	}
+	if crc32.Checksum(buff[:indexHeaderSize-4], castagnoli) != binary.LittleEndian.Uint32(buff[indexHeaderSize-4:]) {
+		return indexHeader{}, ErrIndexChecksum
+	}
+
+	return indexHeader{
+		flags:   binary.LittleEndian.Uint32(buff[8:]),
+		created: int64(binary.LittleEndian.Uint64(buff[12:])),
+		covered: int64(binary.LittleEndian.Uint64(buff[20:])),
+	}, nil
+}
+
+// SaveIndex writes the in memory index and filter to w, along with the size of
+// the data they cover, so LoadIndexed can open the table without a full scan.
+func (t SSTable) SaveIndex(w io.Writer) error {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	if t.Options.DiskIndex != nil {
+		return ErrDiskIndex
+	}
+	if t.Header.Flags&FlagEncryptedKeys != 0 {
+		return ErrEncryptedKeys
+	}
+
+	size, err := t.Data.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	err = t.indexHeader(size).write(w)
+	if err != nil {
+		return err
+	}
+
+	_, err = t.Index.WriteTo(w)
+	if err != nil {
+		return err
+	}
+
+	_, err = t.Filter.WriteTo(w)
+	return err
+}
+
+// FlushIndex writes the changes of the DiskIndex option to its file, along
+// with the size of the data it covers. Tables indexed in memory are saved with
+// SaveIndex instead.
+func (t SSTable) FlushIndex() error {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	if t.Options.DiskIndex == nil {
+		return nil
+	}
+
+	size, err := t.Data.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	var meta bytes.Buffer
+	err = t.indexHeader(size).write(&meta)
+	if err != nil {
+		return err
+	}
+	err = t.Options.DiskIndex.SetMeta(meta.Bytes())
+	if err != nil {
+		return err
+	}
+
+	return t.Options.DiskIndex.Flush()
+}
+
+// indexHeader describes the index of the table when covering size bytes of
+// the data file.
+func (t SSTable) indexHeader(size int64) indexHeader {
+	h := indexHeader{created: t.Header.Created.UnixNano(), covered: size}
+	if t.Options.MultiValue {
+		h.flags |= indexMultiValue
+	}
+	return h
+}
+
+// LoadIndexed opens a table from an index written by SaveIndex, then indexes
+// the entries appended to the data file since. Indexes saved from another data
+// file are rejected with ErrForeignIndex, and those saved with another
+// MultiValue mode than options with ErrIndexMode.
+func LoadIndexed(data io.ReadWriteSeeker, index io.Reader) (SSTable, error) {
+	return LoadIndexedWithOptions(data, index, Options{})
+}
+
+func LoadIndexedWithOptions(data io.ReadWriteSeeker, index io.Reader, options Options) (SSTable, error) {
+	if options.DiskIndex != nil {
+		return SSTable{}, ErrDiskIndex
+	}
+
+	saved, err := readIndexHeader(index)
+	if err != nil {
+		return SSTable{}, err
+	}
+	if saved.flags&indexBlocks != 0 {
+		return SSTable{}, ErrInvalidIndex
+	}
+	if (saved.flags&indexMultiValue != 0) != options.MultiValue {
+		return SSTable{}, ErrIndexMode
+	}
+
+	tree, err := btree.Load(index)
+	if err != nil {
+		return SSTable{}, err
+	}
+
+	size, err := data.Seek(0, io.SeekEnd)
+	if err != nil {
+		return SSTable{}, err
+	}
+	if saved.covered > size {
+		return SSTable{}, StaleIndexError{Covered: saved.covered, Size: size}
+	}
+
+	t := SSTable{
+		Index:   tree,
+		Header:  &Header{Version: CurrentVersion},
+		Data:    data,
+		Options: options,
+		lock:    &sync.RWMutex{},
+	}
+	err = t.loadHeader()
+	if err != nil {
+		return SSTable{}, err
+	}
+	// An index covering nothing holds nothing, whatever file it was saved from
+	if saved.covered > 0 && saved.created != t.Header.Created.UnixNano() {
+		return SSTable{}, ErrForeignIndex
+	}
+
+	// A filter missing from the index is rebuilt from the tree
+	t.Filter, err = ReadBloomFilter(index)
+	if err == io.EOF {
+		t.Filter = t.buildFilter(DefaultFilterCapacity)
+	} else if err != nil {
+		return SSTable{}, err
+	}
+
+	t.Dropped, err = t.replay(saved.covered)
+	return t, err
 }
 
 func (t SSTable) Put(key, value []byte) error {
-	offset, err := t.Data.Seek(0, io.SeekEnd)
+	return t.write(NewDataEntry(key, value))
+}
+
+// Delete appends a tombstone for key: Get reports it as not found from then on.
+func (t SSTable) Delete(key []byte) error {
+	return t.write(NewTombstone(key))
+}
+
+func (t SSTable) write(entry DataEntry) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.append(entry)
+}
+
+// append writes entry at the end of the data file and indexes it. The caller
+// holds the lock.
+func (t SSTable) append(entry DataEntry) error {
+	limits := t.Options.Limits.orDefault()
+	err := limits.checkKey(int64(len(entry.Key)))
+	if err != nil {
+		return err
+	}
+	err = limits.checkData(entry.DataLen)
 	if err != nil {
 		return err
 	}
-	t.Index.Insert(key, offset)
+	if t.Options.DiskIndex != nil && len(entry.Key) > t.Options.DiskIndex.MaxKeySize() {
+		return LengthError{Field: "key", Length: int64(len(entry.Key)), Max: int64(t.Options.DiskIndex.MaxKeySize())}
+	}
+
+	if t.Options.Codec != nil {
+		_, ok := LookupCodec(t.Options.Codec.ID())
+		if !ok {
+			return UnknownCodecError(t.Options.Codec.ID())
+		}
+		entry.Codec = t.Options.Codec.ID()
+	}
 
-	entry := NewDataEntry(key, value)
+	offset, err := t.end()
+	if err != nil {
+		return err
+	}
+	err = t.checkDiskIndex()
+	if err != nil {
+		return err
+	}
 
-	return entry.Write(t.Data)
+	// The key is only indexed once its record is written: indexed first, a
+	// failed write would leave it pointing at whatever is appended next
+	err = entry.write(t.Data, t.Header.Version, t.Header.cipher)
+	if err != nil {
+		// Part of the record may have made it to the file
+		if file, ok := t.Data.(truncater); ok {
+			file.Truncate(offset)
+		}
+		return err
+	}
+
+	return t.index(entry.Key, offset)
 }
 
-func (t SSTable) Get(key []byte) ([]byte, error) {
-	ok, offset := t.Index.Search(key)
-	if !ok {
-		return nil, fmt.Errorf("key '%s' not found", key)
+// end seeks to the end of the data file, where records are appended, and
+// returns its offset. The header is written first if the file is empty.
+func (t SSTable) end() (int64, error) {
+	offset, err := t.Data.Seek(0, io.SeekEnd)
+	if err != nil || offset > 0 {
+		return offset, err
+	}
+
+	header, err := t.newHeader()
+	if err != nil {
+		return 0, err
+	}
+	err = header.Write(t.Data)
+	if err != nil {
+		return 0, err
+	}
+
+	*t.Header = header
+	return t.Header.Size(), nil
+}
+
+// newHeader creates the header of an empty data file, along with a data key
+// wrapped by the current key of the keyring, if any.
+func (t SSTable) newHeader() (Header, error) {
+	header := NewHeader()
+	if t.Options.Keyring == nil {
+		return header, nil
+	}
+
+	c, wrapped, err := t.Options.Keyring.newDataKey()
+	if err != nil {
+		return Header{}, err
+	}
+	c.keys = t.Options.EncryptKeys
+
+	header.Flags |= FlagEncrypted
+	if c.keys {
+		header.Flags |= FlagEncryptedKeys
+	}
+	header.KeyID = t.Options.Keyring.Current
+	header.WrappedKey = wrapped
+	header.cipher = c
+	return header, nil
+}
+
+// Stale reports whether the data file holds records that would be written
+// differently now: it is of an older version, or isn't encrypted as the
+// options ask, with the current key of the keyring. Rewrite brings it up to
+// date.
+func (t SSTable) Stale() bool {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	if t.offsets().Len() == 0 {
+		return false
 	}
+	if t.Header.Version < CurrentVersion {
+		return true
+	}
+	if t.Options.Keyring == nil {
+		return t.Header.Flags&FlagEncrypted != 0
+	}
+
+	return t.Header.Flags&FlagEncrypted == 0 ||
+		t.Header.KeyID != t.Options.Keyring.Current ||
+		(t.Header.Flags&FlagEncryptedKeys != 0) != t.Options.EncryptKeys
+}
 
-	_, err := t.Data.Seek(offset, io.SeekStart)
+func (t SSTable) Get(key []byte) ([]byte, error) {
+	offset, err := t.lookup(key)
 	if err != nil {
 		return nil, err
 	}
 
-	entry, err := ReadDataEntry(t.Data)
+	entry, err := t.readAt(offset)
 	if err != nil {
 		return nil, err
 	}
+	if entry.IsTombstone() {
+		return nil, NotFoundError{Key: key, Deleted: true}
+	}
 
 	return entry.Data, nil
 }
 
-func (t SSTable) Scan(from []byte, fn func(key, data []byte)) error {
-	value, err := t.Get(from)
+// Has reports whether key is in the table and was not deleted.
+func (t SSTable) Has(key []byte) (bool, error) {
+	_, err := t.Get(key)
+	if _, ok := err.(NotFoundError); ok {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// lookup returns the offset of the last version of key.
+func (t SSTable) lookup(key []byte) (int64, error) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	if !t.Filter.MayContain(key) {
+		return 0, NotFoundError{Key: key}
+	}
+
+	var ok bool
+	var offset int64
+	if t.Options.MultiValue {
+		ok, offset = t.Index.SearchLast(key)
+	} else {
+		ok, offset = t.offsets().Search(key)
+	}
+	if err := t.indexErr(); err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, NotFoundError{Key: key}
+	}
+
+	return offset, nil
+}
+
+func (t SSTable) readAt(offset int64) (DataEntry, error) {
+	header := t.header()
+
+	r, err := t.records(offset, maxOffset)
 	if err != nil {
-		return err
+		return DataEntry{}, err
 	}
 
-	fn(from, value)
+	return readDataEntry(r, header.Version, t.Options.Limits, header.cipher)
+}
+
+func (t SSTable) header() Header {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	return *t.Header
+}
+
+// snapshot returns the header and the size of the data file, which records
+// are fully written up to. Only appends write at the end of the data file, so
+// seeking there doesn't disturb them.
+func (t SSTable) snapshot() (Header, int64, error) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	size, err := t.Data.Seek(0, io.SeekEnd)
+	return *t.Header, size, err
+}
+
+// maxOffset bounds sections reading up to the end of the data file.
+const maxOffset = math.MaxInt64
 
-	for entry, err := ReadDataEntry(t.Data); err == nil; entry, err = ReadDataEntry(t.Data) {
-		fn(entry.Key, entry.Data)
+// section returns a reader of the first size bytes of the data file, with a
+// cursor of its own.
+func (t SSTable) section(size int64) *io.SectionReader {
+	return io.NewSectionReader(t.readerAt(), 0, size)
+}
+
+// records returns a reader of the records written from offset, up to size
+// bytes of the data file. Records read through a memory mapping are slices of
+// it.
+func (t SSTable) records(offset, size int64) (io.ReadSeeker, error) {
+	if m, ok := t.Reader.(*Mmap); ok {
+		return &mmapReader{m: m, offset: offset, limit: size}, nil
 	}
 
-	if err == io.EOF {
+	r := t.section(size)
+	_, err := r.Seek(offset, io.SeekStart)
+	return r, err
+}
+
+// readerAt returns the data file as an io.ReaderAt, like *os.File. Other data
+// files are read through their cursor, and can't be read concurrently then.
+func (t SSTable) readerAt() io.ReaderAt {
+	if t.Reader != nil {
+		return t.Reader
+	}
+	if r, ok := t.Data.(io.ReaderAt); ok {
+		return r
+	}
+	return seekReaderAt{t.Data}
+}
+
+type seekReaderAt struct {
+	io.ReadSeeker
+}
+
+func (r seekReaderAt) ReadAt(buff []byte, offset int64) (int, error) {
+	_, err := r.Seek(offset, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := io.ReadFull(r.ReadSeeker, buff)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Offsets returns the offset of every indexed version of key, oldest first.
+// Without MultiValue, only the last version is indexed.
+func (t SSTable) Offsets(key []byte) []int64 {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	if t.Options.DiskIndex != nil {
+		if ok, offset := t.Options.DiskIndex.Search(key); ok {
+			return []int64{offset}
+		}
 		return nil
-	} else {
-		return err
 	}
+	return t.Index.SearchAll(key)
+}
+
+// Versions returns every indexed value of key, oldest first. Deletions are
+// listed as nil values.
+func (t SSTable) Versions(key []byte) ([][]byte, error) {
+	offsets := t.Offsets(key)
+	if len(offsets) == 0 {
+		return nil, NotFoundError{Key: key}
+	}
+
+	values := make([][]byte, 0, len(offsets))
+	for _, offset := range offsets {
+		entry, err := t.readAt(offset)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, entry.Data)
+	}
+
+	return values, nil
+}
+
+// GetAsOf returns the value key had when the data file was offset bytes
+// long: the last version written before offset.
+func (t SSTable) GetAsOf(key []byte, offset int64) ([]byte, error) {
+	offsets := t.Offsets(key)
+	for i := len(offsets) - 1; i >= 0; i-- {
+		if offsets[i] < offset {
+			entry, err := t.readAt(offsets[i])
+			if err != nil {
+				return nil, err
+			}
+			if entry.IsTombstone() {
+				return nil, NotFoundError{Key: key, Deleted: true}
+			}
+			return entry.Data, nil
+		}
+	}
+
+	return nil, NotFoundError{Key: key}
+}
+
+// Scan calls fn for every entry written since the last version of from, in
+// insert order. Only the last version of a key is yielded, and none for
+// deleted keys.
+func (t SSTable) Scan(from []byte, fn func(key, data []byte)) error {
+	return t.ScanEntries(from, t.liveOnly(fn))
 }
 
 func (t SSTable) ScanAll(fn func(key, data []byte)) error {
-	_, err := t.Data.Seek(0, io.SeekStart)
+	return t.ScanAllEntries(t.liveOnly(fn))
+}
+
+// ScanEntries is Scan yielding every entry, tombstones included.
+func (t SSTable) ScanEntries(from []byte, fn func(entry DataEntry)) error {
+	offset, err := t.lookup(from)
 	if err != nil {
 		return err
 	}
 
-	for entry, err := ReadDataEntry(t.Data); err == nil; entry, err = ReadDataEntry(t.Data) {
-		fn(entry.Key, entry.Data)
+	return t.scanFrom(offset, fn)
+}
+
+// ScanAllEntries is ScanAll yielding every entry, tombstones included.
+func (t SSTable) ScanAllEntries(fn func(entry DataEntry)) error {
+	return t.scanFrom(-1, fn)
+}
+
+// scanFrom reads the entries written from offset, or from the first one if
+// offset is negative, until the end the data file had when the scan started.
+func (t SSTable) scanFrom(offset int64, fn func(entry DataEntry)) error {
+	header, size, err := t.snapshot()
+	if err != nil {
+		return err
+	}
+	if offset < 0 {
+		offset = header.Size()
 	}
 
-	if err == io.EOF {
-		return nil
-	} else {
+	r, err := t.records(offset, size)
+	if err != nil {
 		return err
 	}
+
+	for {
+		entry, err := readDataEntry(r, header.Version, t.Options.Limits, header.cipher)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		fn(entry)
+	}
+}
+
+func (t SSTable) liveOnly(fn func(key, data []byte)) func(entry DataEntry) {
+	return func(entry DataEntry) {
+		if t.live(entry) {
+			fn(entry.Key, entry.Data)
+		}
+	}
+}
+
+// live reports whether entry is the last version of its key, and not a
+// deletion. Older versions, of deleted keys too, are hidden from scans.
+func (t SSTable) live(entry DataEntry) bool {
+	return !entry.IsTombstone() && t.last(entry)
+}
+
+// last reports whether entry is the last version of its key.
+func (t SSTable) last(entry DataEntry) bool {
+	offset, err := t.lookup(entry.Key)
+	return err == nil && offset == entry.Offset
 }
 
+// Walk calls fn for every indexed key, holding a read lock: fn must not write
+// to the table.
 func (t SSTable) Walk(fn btree.WalkerFunc) {
-	t.Index.Walk(fn)
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	t.offsets().Walk(fn)
 }
 
 func (older SSTable) Merge(newer SSTable) error {
-	// Ensure we are copying from start
-	nbytes, err := older.Data.Seek(0, io.SeekEnd)
+	older.lock.Lock()
+	defer older.lock.Unlock()
+
+	nbytes, err := older.end()
 	if err != nil {
 		return err
 	}
-	_, err = newer.Data.Seek(0, io.SeekStart)
+
+	header, size, err := newer.snapshot()
 	if err != nil {
 		return err
 	}
 
-	// Merge data
-	_, err = io.Copy(older.Data, newer.Data)
+	// Records are copied as is when both files share a layout and a data
+	// key, otherwise they are written again in the layout of the older one.
+	if older.Header.Version != header.Version || !older.Header.sameCipher(header) {
+		return older.appendAll(newer, nil)
+	}
+
+	// Merge data, from the first record
+	start := header.Size()
+	_, err = io.Copy(older.Data, io.NewSectionReader(newer.readerAt(), start, size-start))
 	if err != nil {
 		return err
 	}
 
 	newer.Walk(func(key []byte, offset int64) {
-		older.Index.Insert(key, offset+nbytes)
+		if err == nil {
+			err = older.index(key, offset-start+nbytes)
+		}
 	})
 
-	return nil
+	return err
+}
+
+// appendAll appends the records of other keep returns true for, every one
+// when nil, tombstones included. The caller holds the lock.
+func (t SSTable) appendAll(other SSTable, keep func(entry DataEntry) bool) error {
+	var appendErr error
+	err := other.ScanAllEntries(func(entry DataEntry) {
+		if appendErr == nil && (keep == nil || keep(entry)) {
+			appendErr = t.append(entry)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	return appendErr
+}
+
+// Rewrite copies every record to the empty data file in the current version,
+// and returns the table it makes. It migrates tables of older versions. The
+// new table is indexed in memory, whatever the DiskIndex option.
+func (t SSTable) Rewrite(data io.ReadWriteSeeker) (SSTable, error) {
+	rewritten := NewWithOptions(data, t.memoryOptions())
+	rewritten.lock.Lock()
+	defer rewritten.lock.Unlock()
+
+	return rewritten, rewritten.appendAll(t, nil)
+}
+
+// Compact is Rewrite copying only the last version of every key: values
+// overwritten or deleted since are left behind. Tombstones are kept, as they
+// still hide the versions stored in older tables.
+func (t SSTable) Compact(data io.ReadWriteSeeker) (SSTable, error) {
+	compacted := NewWithOptions(data, t.memoryOptions())
+	compacted.lock.Lock()
+	defer compacted.lock.Unlock()
+
+	return compacted, compacted.appendAll(t, t.last)
+}
+
+// memoryOptions returns the options of the table, indexing in memory.
+func (t SSTable) memoryOptions() Options {
+	options := t.Options
+	options.DiskIndex = nil
+	return options
 }
 
 func (t SSTable) Size() int64 {
-	if t.Index == nil {
+	if t.lock == nil {
 		return int64(0)
 	}
 
-	var count int64
-	t.Walk(func(_ []byte, _ int64) {
-		count += 1
-	})
+	t.lock.RLock()
+	defer t.lock.RUnlock()
 
-	return count
+	return int64(t.offsets().Len())
 }
 
 func (t SSTable) Keys() [][]byte {
-	return t.Index.Keys()
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	var keys [][]byte
+	t.offsets().Walk(func(key []byte, _ int64) {
+		keys = append(keys, key)
+	})
+	return keys
+}
+
+type StaleIndexError struct {
+	Covered int64
+	Size    int64
+}
+
+func (e StaleIndexError) Error() string {
+	return fmt.Sprintf("Index covers %d bytes but data file has only %d.", e.Covered, e.Size)
+}
+
+// TornWriteError reports a data file ending with a record that could not be
+// read, most likely because a write was interrupted.
+type TornWriteError struct {
+	Offset int64
+	Size   int64
+	Err    error
+}
+
+func (e TornWriteError) Error() string {
+	return fmt.Sprintf("Data file ends with a torn record of %d bytes at offset %d: %v.", e.Size, e.Offset, e.Err)
+}
+
+type NotFoundError struct {
+	Key []byte
+	// Deleted is set when the key was found but its last version is a tombstone
+	Deleted bool
+}
+
+func (e NotFoundError) Error() string {
+	return fmt.Sprintf("key '%s' not found", e.Key)
 }
@@ -2,11 +2,19 @@ package sstable
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/journald/btree"
 )
 
 func TestSSTable(t *testing.T) {
@@ -62,6 +70,14 @@ func TestMergeSSTable(t *testing.T) {
 		t.Error(err)
 	}
 
+	reloaded, err := Load(left.Data)
+	if err != nil {
+		t.Error(err)
+	}
+	if reloaded.Size() != 4 {
+		t.Errorf("Expected merged headers to be skipped.\nExpected: %v\nGot:      %v", 4, reloaded.Size())
+	}
+
 	tt := []struct {
 		Key   []byte
 		Value []byte
@@ -197,6 +213,1091 @@ func TestSize(t *testing.T) {
 	}
 }
 
+func TestRewriteKey(t *testing.T) {
+	data := `FOO | foo
+	         BAR | bar
+	         FOO | foo2`
+	table, teardown, err := GenerateTable(data)
+	if err != nil {
+		t.Error(err)
+	}
+	defer teardown()
+
+	if table.Size() != 2 {
+		t.Errorf("Expected rewritten keys to be counted once.\nExpected: %v\nGot:      %v", 2, table.Size())
+	}
+
+	value, err := table.Get([]byte("FOO"))
+	if err != nil || bytes.Compare([]byte("foo2"), value) != 0 {
+		t.Errorf("Expected to read the last written value '%s' but got '%s'\n", "foo2", value)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	data := `FOO | foo
+	         BAR | bar`
+	table, teardown, err := GenerateTable(data)
+	if err != nil {
+		t.Error(err)
+	}
+	defer teardown()
+
+	err = table.Delete([]byte("FOO"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = table.Get([]byte("FOO"))
+	if notFound, ok := err.(NotFoundError); !ok || !notFound.Deleted {
+		t.Errorf("Expected deleted key to be reported as not found but got %v", err)
+	}
+	_, err = table.Get([]byte("DAFUQ"))
+	if notFound, ok := err.(NotFoundError); !ok || notFound.Deleted {
+		t.Errorf("Expected missing key to be reported as not found but got %v", err)
+	}
+
+	values, err := CaptureScanAll(table)
+	if err != nil {
+		t.Error(err)
+	}
+	expected := map[string]string{
+		"BAR": "bar",
+	}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("Expected scan to skip deleted keys.\nExpected: %v\nGot:      %v", expected, values)
+	}
+
+	var tombstones []string
+	err = table.ScanAllEntries(func(entry DataEntry) {
+		if entry.IsTombstone() {
+			tombstones = append(tombstones, string(entry.Key))
+		}
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if !reflect.DeepEqual(tombstones, []string{"FOO"}) {
+		t.Errorf("Expected entries scan to show tombstones but got %v", tombstones)
+	}
+
+	// Deletions survive merge and reload
+	older, teardown, err := GenerateTable(`FOO | older-foo`)
+	if err != nil {
+		t.Error(err)
+	}
+	defer teardown()
+
+	err = older.Merge(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = older.Get([]byte("FOO"))
+	if err == nil {
+		t.Errorf("Expected merged tombstone to hide older versions")
+	}
+
+	loaded, err := Load(older.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = loaded.Get([]byte("FOO"))
+	if err == nil {
+		t.Errorf("Expected tombstone to be loaded from the data file")
+	}
+	value, err := loaded.Get([]byte("BAR"))
+	if err != nil || string(value) != "bar" {
+		t.Errorf("Expected to find '%s' at key '%s' but found '%s'", "bar", "BAR", value)
+	}
+}
+
+func TestMultiValue(t *testing.T) {
+	table, teardown, err := GenerateTable("")
+	if err != nil {
+		t.Error(err)
+	}
+	defer teardown()
+	table = NewWithOptions(table.Data, Options{MultiValue: true})
+
+	for _, value := range []string{"v1", "v2", "v3"} {
+		err = table.Put([]byte("FOO"), []byte(value))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = table.Put([]byte("BAR"), []byte(value))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	value, err := table.Get([]byte("FOO"))
+	if err != nil || string(value) != "v3" {
+		t.Errorf("Expected to read the last written value '%s' but got '%s'\n", "v3", value)
+	}
+
+	if table.Size() != 6 {
+		t.Errorf("Expected every version to be indexed.\nExpected: %v\nGot:      %v", 6, table.Size())
+	}
+
+	versions, err := table.Versions([]byte("FOO"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]byte{[]byte("v1"), []byte("v2"), []byte("v3")}
+	if !reflect.DeepEqual(versions, expected) {
+		t.Errorf("Expected versions to be listed oldest first.\nExpected: %s\nGot:      %s", expected, versions)
+	}
+
+	offsets := table.Offsets([]byte("FOO"))
+	if len(offsets) != 3 {
+		t.Fatalf("Expected %d offsets for key FOO but got %v", 3, offsets)
+	}
+
+	value, err = table.GetAsOf([]byte("FOO"), offsets[1]+1)
+	if err != nil || string(value) != "v2" {
+		t.Errorf("Expected to read '%s' as of offset %d but got '%s'", "v2", offsets[1]+1, value)
+	}
+	_, err = table.GetAsOf([]byte("FOO"), offsets[0])
+	if err == nil {
+		t.Errorf("Expected to NOT find key FOO before its first version")
+	}
+
+	loaded, err := LoadWithOptions(table.Data, Options{MultiValue: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded.Offsets([]byte("BAR")), table.Offsets([]byte("BAR"))) {
+		t.Errorf("Expected loading the table to index every version")
+	}
+
+	loaded, err = Load(table.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Offsets([]byte("BAR"))) != 1 {
+		t.Errorf("Expected a table without MultiValue to index the last version only")
+	}
+}
+
+func TestLoadLegacy(t *testing.T) {
+	file, err := ioutil.TempFile("", "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+
+	// Written before data files had a header
+	NewDataEntry([]byte("FOO"), []byte("foo")).WriteVersion(file, LegacyVersion)
+	NewDataEntry([]byte("BAR"), []byte("bar")).WriteVersion(file, LegacyVersion)
+
+	table, err := Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.Header.Version != LegacyVersion {
+		t.Errorf("Expected a headerless file to be a legacy one.\nExpected: %v\nGot:      %v", LegacyVersion, table.Header.Version)
+	}
+
+	err = table.Put([]byte("BAZ"), []byte("baz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values, err := CaptureScanAll(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"FOO": "foo", "BAR": "bar", "BAZ": "baz"}
+	if !reflect.DeepEqual(expected, values) {
+		t.Errorf("Expected to read every record of a legacy file.\nExpected: %v\nGot:      %v", expected, values)
+	}
+
+	current, teardown, err := GenerateTable(`QUX | qux`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+
+	err = table.Merge(current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := table.Get([]byte("QUX"))
+	if err != nil || string(value) != "qux" {
+		t.Errorf("Expected to merge a current table into a legacy one but got '%s' (%v)", value, err)
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	file, err := ioutil.TempFile("", "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+
+	NewDataEntry([]byte("FOO"), []byte("foo")).WriteVersion(file, LegacyVersion)
+	NewTombstone([]byte("BAR")).WriteVersion(file, LegacyVersion)
+
+	table, err := Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rewritten, teardown, err := GenerateTable("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+
+	rewritten, err = table.Rewrite(rewritten.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := Load(rewritten.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Header.Version != CurrentVersion {
+		t.Errorf("Expected a rewritten table to use the current version.\nExpected: %v\nGot:      %v", CurrentVersion, loaded.Header.Version)
+	}
+
+	value, err := loaded.Get([]byte("FOO"))
+	if err != nil || string(value) != "foo" {
+		t.Errorf("Expected to find '%s' at key '%s' but found '%s'", "foo", "FOO", value)
+	}
+	_, err = loaded.Get([]byte("BAR"))
+	if notFound, ok := err.(NotFoundError); !ok || !notFound.Deleted {
+		t.Errorf("Expected a rewritten tombstone to still hide its key but got %v", err)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	table, teardown, err := GenerateTable(`FOO | secret1
+	                                       BAR | bar
+	                                       FOO | secret2
+	                                       BAZ | baz`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+	table.Delete([]byte("FOO"))
+	table.Put([]byte("BAZ"), []byte("baz2"))
+
+	compacted, teardown, err := GenerateTable("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+
+	compacted, err = table.Compact(compacted.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	err = compacted.ScanAllEntries(func(entry DataEntry) {
+		keys = append(keys, string(entry.Key))
+		if bytes.HasPrefix(entry.Data, []byte("secret")) {
+			t.Errorf("Expected compaction to drop the deleted value '%s'", entry.Data)
+		}
+	})
+	expected := []string{"BAR", "FOO", "BAZ"}
+	if err != nil || !reflect.DeepEqual(expected, keys) {
+		t.Errorf("Expected compaction to keep the last version of every key.\nExpected: %v\nGot:      %v (%v)", expected, keys, err)
+	}
+
+	_, err = compacted.Get([]byte("FOO"))
+	if notFound, ok := err.(NotFoundError); !ok || !notFound.Deleted {
+		t.Errorf("Expected the tombstone to still hide its key but got %v", err)
+	}
+	value, err := compacted.Get([]byte("BAZ"))
+	if err != nil || string(value) != "baz2" {
+		t.Errorf("Expected to find '%s' at key '%s' but found '%s'", "baz2", "BAZ", value)
+	}
+}
+
+func TestLoadUnsupportedVersion(t *testing.T) {
+	file, err := ioutil.TempFile("", "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+
+	Header{Version: CurrentVersion + 1}.Write(file)
+	NewDataEntry([]byte("FOO"), []byte("foo")).Write(file)
+
+	_, err = Load(file)
+	if _, ok := err.(UnsupportedVersionError); !ok {
+		t.Errorf("Expected an unknown version to be rejected but got %v", err)
+	}
+}
+
+func TestPutLimits(t *testing.T) {
+	table, teardown, err := GenerateTable("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+	table.Options.Limits = Limits{MaxKeySize: 3, MaxValueSize: 3}
+
+	err = table.Put([]byte("FOOO"), []byte("foo"))
+	if err != (LengthError{Field: "key", Length: 4, Max: 3}) {
+		t.Errorf("Expected a key over the limit to be refused but got %v", err)
+	}
+	err = table.Put([]byte("FOO"), []byte("fooo"))
+	if err != (LengthError{Field: "data", Length: 4, Max: 3}) {
+		t.Errorf("Expected a value over the limit to be refused but got %v", err)
+	}
+	if table.Size() != 0 {
+		t.Errorf("Expected refused records not to be indexed.\nExpected: %v\nGot:      %v", 0, table.Size())
+	}
+}
+
+func TestCodec(t *testing.T) {
+	table, teardown, err := GenerateTable("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+	table.Options.Codec = ZlibCodec
+
+	value := strings.Repeat("verbose log line, ", 100)
+	err = table.Put([]byte("FOO"), []byte(value))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size, _ := table.Data.Seek(0, io.SeekEnd)
+	if size >= int64(len(value)) {
+		t.Errorf("Expected the value to be compressed.\nExpected: < %d\nGot:      %d", len(value), size)
+	}
+
+	// Reading doesn't depend on the codec option
+	loaded, err := Load(table.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []SSTable{table, loaded} {
+		actual, err := tt.Get([]byte("FOO"))
+		if err != nil || string(actual) != value {
+			t.Errorf("Expected to read the value uncompressed but got %d bytes (%v)", len(actual), err)
+		}
+
+		values, err := CaptureScanAll(tt)
+		if err != nil || values["FOO"] != value {
+			t.Errorf("Expected to scan the value uncompressed but got %d bytes (%v)", len(values["FOO"]), err)
+		}
+	}
+}
+
+func TestFailedWrite(t *testing.T) {
+	table, teardown, err := GenerateTable("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+
+	table.Options.Codec = unregisteredCodec{}
+	err = table.Put([]byte("a"), []byte("value-a"))
+	if err != UnknownCodecError(200) {
+		t.Errorf("Expected an unregistered codec to fail the write.\nExpected: %v\nGot:      %v", UnknownCodecError(200), err)
+	}
+
+	table.Options.Codec = nil
+	table.Data = failingWrites{table.Data.(*os.File)}
+	err = table.Put([]byte("c"), []byte("value-c"))
+	if err != errWriteFailed {
+		t.Errorf("Expected the data file to fail the write.\nExpected: %v\nGot:      %v", errWriteFailed, err)
+	}
+
+	// Failed writes must leave nothing indexed to point at the next record
+	table.Data = table.Data.(failingWrites).File
+	err = table.Put([]byte("b"), []byte("value-b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "c"} {
+		value, err := table.Get([]byte(key))
+		if !reflect.DeepEqual(err, NotFoundError{Key: []byte(key)}) {
+			t.Errorf("Expected key '%s' of a failed write not to be found but got '%s' (%v)", key, value, err)
+		}
+	}
+	if table.Size() != 1 {
+		t.Errorf("Unexpected table size.\nExpected: %v\nGot:      %v", 1, table.Size())
+	}
+}
+
+// unregisteredCodec is flate under an id nobody registered.
+type unregisteredCodec struct {
+	flateCodec
+}
+
+func (unregisteredCodec) ID() uint8 {
+	return 200
+}
+
+var errWriteFailed = errors.New("write failed")
+
+// failingWrites is a data file whose writes fail halfway through.
+type failingWrites struct {
+	*os.File
+}
+
+func (f failingWrites) Write(p []byte) (int, error) {
+	n, _ := f.File.Write(p[:len(p)/2])
+	return n, errWriteFailed
+}
+
+func TestEncryption(t *testing.T) {
+	table, teardown, err := GenerateTable("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+	table.Options.Keyring = testKeyring()
+	table.Options.Codec = ZlibCodec
+
+	value := strings.Repeat("customer data, ", 100)
+	err = table.Put([]byte("FOO"), []byte(value))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = table.Put([]byte("BAR"), []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.Header.Flags&FlagEncrypted == 0 || table.Header.KeyID != 1 {
+		t.Errorf("Expected the header to record the key id.\nExpected: %v\nGot:      %v", 1, table.Header.KeyID)
+	}
+
+	raw, _ := ioutil.ReadAll(io.NewSectionReader(table.Data.(*os.File), 0, 1<<20))
+	if bytes.Contains(raw, []byte("customer")) || bytes.Contains(raw, []byte("secret")) {
+		t.Errorf("Expected values not to be stored in plaintext")
+	}
+
+	loaded, err := LoadWithOptions(table.Data, Options{Keyring: testKeyring()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []SSTable{table, loaded} {
+		values, err := CaptureScanAll(tt)
+		if err != nil || values["FOO"] != value || values["BAR"] != "secret" {
+			t.Errorf("Expected to read the values decrypted but got %v (%v)", values, err)
+		}
+	}
+
+	_, err = Load(table.Data)
+	if err != KeyNotFoundError(1) {
+		t.Errorf("Unexpected error loading without the key.\nExpected: %v\nGot:      %v", KeyNotFoundError(1), err)
+	}
+
+	// Keys are left in plaintext unless asked otherwise
+	if !bytes.Contains(raw, []byte("FOO")) {
+		t.Errorf("Expected keys to be stored in plaintext")
+	}
+	err = table.SaveIndex(ioutil.Discard)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEncryptKeys(t *testing.T) {
+	table, teardown, err := GenerateTable("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+	table.Options.Keyring = testKeyring()
+	table.Options.EncryptKeys = true
+
+	table.Put([]byte("FOO"), []byte("1"))
+	table.Delete([]byte("FOO"))
+	table.Put([]byte("BAR"), []byte("2"))
+
+	raw, _ := ioutil.ReadAll(io.NewSectionReader(table.Data.(*os.File), 0, 1<<20))
+	if bytes.Contains(raw, []byte("FOO")) || bytes.Contains(raw, []byte("BAR")) {
+		t.Errorf("Expected keys not to be stored in plaintext")
+	}
+
+	loaded, err := LoadWithOptions(table.Data, Options{Keyring: testKeyring()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = loaded.Get([]byte("FOO"))
+	if notFound, ok := err.(NotFoundError); !ok || !notFound.Deleted {
+		t.Errorf("Expected a decrypted tombstone to hide its key but got %v", err)
+	}
+	value, err := loaded.Get([]byte("BAR"))
+	if err != nil || string(value) != "2" {
+		t.Errorf("Expected to read the value of a decrypted key but got '%s' (%v)", value, err)
+	}
+
+	err = loaded.SaveIndex(ioutil.Discard)
+	if err != ErrEncryptedKeys {
+		t.Errorf("Unexpected error saving the index.\nExpected: %v\nGot:      %v", ErrEncryptedKeys, err)
+	}
+}
+
+func TestMergeEncrypted(t *testing.T) {
+	older, teardown, err := GenerateTable("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+	newer, teardown, err := GenerateTable("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+
+	// The newer table is written with a previous key
+	keyring := testKeyring()
+	older.Options.Keyring = keyring
+	newer.Options.Keyring = &Keyring{Current: 2, Keys: keyring.Keys}
+
+	older.Put([]byte("FOO"), []byte("1"))
+	newer.Put([]byte("BAR"), []byte("2"))
+
+	rotated := newer
+	rotated.Options.Keyring = keyring
+	if !rotated.Stale() {
+		t.Errorf("Expected a table written with another key than the current one to be stale")
+	}
+
+	err = older.Merge(newer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadWithOptions(older.Data, Options{Keyring: keyring})
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := CaptureScanAll(loaded)
+	if err != nil || values["FOO"] != "1" || values["BAR"] != "2" {
+		t.Errorf("Expected merged records to be encrypted with the data key of the older table but got %v (%v)", values, err)
+	}
+	if loaded.Stale() {
+		t.Errorf("Expected a table written with the current key not to be stale")
+	}
+}
+
+func TestTornWrite(t *testing.T) {
+	record := bytes.NewBufferString("")
+	NewDataEntry([]byte("BAZ"), []byte("baz")).Write(record)
+
+	// Every way a write of the last record can be cut short, and a last record
+	// written in full but with garbage
+	tails := [][]byte{}
+	for i := 1; i < record.Len(); i++ {
+		tails = append(tails, record.Bytes()[:i])
+	}
+	garbage := append([]byte{}, record.Bytes()...)
+	garbage[len(garbage)-5] = 0x0
+	tails = append(tails, garbage)
+
+	// Zeros or garbage left by the file system past an interrupted write
+	zeros := make([]byte, 100)
+	tails = append(tails, zeros, append(record.Bytes()[:10:10], zeros...))
+	length := make([]byte, 40)
+	binary.LittleEndian.PutUint64(length, 1<<60-1)
+	tails = append(tails, length)
+
+	for _, tail := range tails {
+		table, teardown, err := GenerateTable(`FOO | foo
+		                                       BAR | bar`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer teardown()
+
+		size, _ := table.Data.Seek(0, io.SeekEnd)
+		table.Data.Write(tail)
+
+		_, err = LoadWithOptions(table.Data, Options{Strict: true})
+		if _, ok := err.(TornWriteError); !ok {
+			t.Errorf("Expected strict mode to refuse a torn tail of %d bytes but got %v", len(tail), err)
+		}
+
+		loaded, err := Load(table.Data)
+		if err != nil {
+			t.Fatalf("Expected a torn tail of %d bytes to be recovered but got %v", len(tail), err)
+		}
+		if loaded.Dropped != int64(len(tail)) {
+			t.Errorf("Unexpected dropped bytes.\nExpected: %v\nGot:      %v", len(tail), loaded.Dropped)
+		}
+		end, _ := table.Data.Seek(0, io.SeekEnd)
+		if end != size {
+			t.Errorf("Expected the data file to be cut back to the last record.\nExpected: %v\nGot:      %v", size, end)
+		}
+
+		err = loaded.Put([]byte("BAZ"), []byte("baz"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		reloaded, err := Load(table.Data)
+		if err != nil || reloaded.Dropped != 0 || reloaded.Size() != 3 {
+			t.Errorf("Expected to append after a recovered tail but got %d keys (%v)", reloaded.Size(), err)
+		}
+	}
+}
+
+func TestCorruptedRecord(t *testing.T) {
+	table, teardown, err := GenerateTable(`FOO | foo
+	                                       BAR | bar`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+
+	// A corrupted record followed by a valid one is not a torn tail
+	offset := table.Offsets([]byte("FOO"))[0]
+	_, err = table.Data.(*os.File).WriteAt([]byte("X"), offset+17)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Load(table.Data)
+	if _, ok := err.(DecodeError); !ok {
+		t.Errorf("Expected a corrupted record before a valid one to fail the load but got %v", err)
+	}
+	size, _ := table.Data.Seek(0, io.SeekEnd)
+	if size <= offset {
+		t.Errorf("Expected the data file to be left alone but it was cut to %d bytes", size)
+	}
+}
+
+func TestTornHeader(t *testing.T) {
+	table, teardown, err := GenerateTable("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+
+	table.Data.Write([]byte("JRNL\x02"))
+
+	loaded, err := Load(table.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Dropped != 5 {
+		t.Errorf("Unexpected dropped bytes.\nExpected: %v\nGot:      %v", 5, loaded.Dropped)
+	}
+
+	err = loaded.Put([]byte("FOO"), []byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := Load(table.Data)
+	if err != nil || reloaded.Header.Version != CurrentVersion {
+		t.Errorf("Expected a header to be written again but got version %d (%v)", reloaded.Header.Version, err)
+	}
+}
+
+func TestCorruptedMiddle(t *testing.T) {
+	table, teardown, err := GenerateTable(`FOO | foo
+	                                       BAR | bar`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+
+	// Flip a bit in the data of the first record
+	table.Data.Seek(HeaderSize+16+3, io.SeekStart)
+	table.Data.Write([]byte("g"))
+
+	_, err = Load(table.Data)
+	decodeErr, ok := err.(DecodeError)
+	if !ok || decodeErr.Offset != HeaderSize {
+		t.Errorf("Expected corruption before the last record to be reported but got %v", err)
+	}
+	if _, ok := decodeErr.Err.(CorruptedDataError); !ok {
+		t.Errorf("Expected a checksum missmatch but got %v", decodeErr.Err)
+	}
+}
+
+func TestLoadIndexed(t *testing.T) {
+	data := `FOO | foo
+	         BAR | bar`
+	table, teardown, err := GenerateTable(data)
+	if err != nil {
+		t.Error(err)
+	}
+	defer teardown()
+
+	index := bytes.NewBufferString("")
+	err = table.SaveIndex(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Written after the index was saved, must be replayed
+	err = table.Put([]byte("BAZ"), []byte("baz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadIndexed(table.Data, index)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"FOO": "foo",
+		"BAR": "bar",
+		"BAZ": "baz",
+	}
+	for key, value := range expected {
+		actual, err := loaded.Get([]byte(key))
+		if err != nil || string(actual) != value {
+			t.Errorf("Expected to find '%s' at key '%s' but found '%s'", value, key, actual)
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	table, teardown, err := GenerateTable("")
+	if err != nil {
+		t.Error(err)
+	}
+	defer teardown()
+
+	// Enough keys to outgrow the default filter
+	for i := 0; i < 3*DefaultFilterCapacity; i++ {
+		err = table.Put([]byte(fmt.Sprintf("key%d", i)), []byte("value"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if table.Filter.Full() {
+		t.Errorf("Expected the filter to grow with the table")
+	}
+	for i := 0; i < 3*DefaultFilterCapacity; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		if !table.MayContain(key) {
+			t.Errorf("Expected the filter to contain '%s'", key)
+		}
+	}
+
+	found, err := table.Has([]byte("key42"))
+	if err != nil || !found {
+		t.Errorf("Expected to have key42 (%v)", err)
+	}
+	found, err = table.Has([]byte("absent"))
+	if err != nil || found {
+		t.Errorf("Expected not to have an absent key (%v)", err)
+	}
+
+	err = table.Delete([]byte("key42"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err = table.Has([]byte("key42"))
+	if err != nil || found {
+		t.Errorf("Expected not to have a deleted key (%v)", err)
+	}
+}
+
+func TestLoadIndexedLargeIndex(t *testing.T) {
+	table, teardown, err := GenerateTable("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+
+	for i := 0; i < 5000; i++ {
+		table.Put([]byte(fmt.Sprintf("key%04d", i)), []byte("value"))
+	}
+
+	index := bytes.NewBufferString("")
+	err = table.SaveIndex(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The filter follows a tree larger than a read buffer
+	loaded, err := LoadIndexed(table.Data, bytes.NewReader(index.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Filter.Capacity() != table.Filter.Capacity() {
+		t.Errorf("Expected the saved filter to be loaded rather than rebuilt.\nExpected: %v\nGot:      %v", table.Filter.Capacity(), loaded.Filter.Capacity())
+	}
+	if loaded.Size() != 5000 {
+		t.Errorf("Unexpected loaded table size.\nExpected: %v\nGot:      %v", 5000, loaded.Size())
+	}
+}
+
+func TestLoadIndexedWithoutFilter(t *testing.T) {
+	table, teardown, err := GenerateTable(`FOO | foo`)
+	if err != nil {
+		t.Error(err)
+	}
+	defer teardown()
+
+	size, err := table.Data.Seek(0, io.SeekEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := bytes.NewBufferString("")
+	table.indexHeader(size).write(index)
+	table.Index.WriteTo(index)
+
+	loaded, err := LoadIndexed(table.Data, index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.MayContain([]byte("FOO")) {
+		t.Errorf("Expected the filter to be rebuilt from the index")
+	}
+}
+
+func TestLoadIndexedStale(t *testing.T) {
+	table, teardown, err := GenerateTable(`FOO | foo`)
+	if err != nil {
+		t.Error(err)
+	}
+	defer teardown()
+
+	index := bytes.NewBufferString("")
+	err = table.SaveIndex(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	empty, teardown, err := GenerateTable("")
+	if err != nil {
+		t.Error(err)
+	}
+	defer teardown()
+
+	_, err = LoadIndexed(empty.Data, index)
+	if _, ok := err.(StaleIndexError); !ok {
+		t.Errorf("Expected an index covering more than the data file to be rejected but got %v", err)
+	}
+}
+
+func TestLoadIndexedForeign(t *testing.T) {
+	table, teardown, err := GenerateTable(`FOO | foo`)
+	if err != nil {
+		t.Error(err)
+	}
+	defer teardown()
+
+	index := bytes.NewBufferString("")
+	err = table.SaveIndex(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Same size, but another file
+	other, teardown, err := GenerateTable(`BAR | bar`)
+	if err != nil {
+		t.Error(err)
+	}
+	defer teardown()
+	other.Header.Created = table.Header.Created.Add(time.Second)
+	other.Data.Seek(0, io.SeekStart)
+	other.Header.Write(other.Data)
+
+	_, err = LoadIndexed(other.Data, bytes.NewReader(index.Bytes()))
+	if err != ErrForeignIndex {
+		t.Errorf("Unexpected error loading the index of another data file.\nExpected: %v\nGot:      %v", ErrForeignIndex, err)
+	}
+
+	// The covered size is checksummed
+	flipped := append([]byte(nil), index.Bytes()...)
+	flipped[20] ^= 0x01
+	_, err = LoadIndexed(table.Data, bytes.NewReader(flipped))
+	if err != ErrIndexChecksum {
+		t.Errorf("Unexpected error loading a corrupted index.\nExpected: %v\nGot:      %v", ErrIndexChecksum, err)
+	}
+}
+
+func TestLoadIndexedMode(t *testing.T) {
+	table, teardown, err := GenerateTable("")
+	if err != nil {
+		t.Error(err)
+	}
+	defer teardown()
+	table.Options.MultiValue = true
+	table.Put([]byte("FOO"), []byte("foo"))
+	table.Put([]byte("FOO"), []byte("bar"))
+
+	index := bytes.NewBufferString("")
+	err = table.SaveIndex(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = LoadIndexed(table.Data, bytes.NewReader(index.Bytes()))
+	if err != ErrIndexMode {
+		t.Errorf("Unexpected error loading a multi value index as single value.\nExpected: %v\nGot:      %v", ErrIndexMode, err)
+	}
+
+	loaded, err := LoadIndexedWithOptions(table.Data, bytes.NewReader(index.Bytes()), Options{MultiValue: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Size() != 2 {
+		t.Errorf("Expected every version to be loaded.\nExpected: %v\nGot:      %v", 2, loaded.Size())
+	}
+}
+
+func TestDiskIndex(t *testing.T) {
+	table, teardown, err := GenerateTable("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+
+	file, err := ioutil.TempFile("", "index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	open := func(data io.ReadWriteSeeker) SSTable {
+		index, err := btree.OpenDiskTree(file, btree.DiskOptions{PageSize: btree.MinPageSize})
+		if err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := LoadWithOptions(data, Options{DiskIndex: index})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return loaded
+	}
+
+	table = open(table.Data)
+	for i := 0; i < 1000; i++ {
+		err = table.Put([]byte(fmt.Sprintf("key%04d", i)), []byte(fmt.Sprintf("value%04d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	table.Delete([]byte("key0001"))
+	err = table.FlushIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Written after the index was flushed, must be replayed
+	table.Put([]byte("key1000"), []byte("value1000"))
+
+	err = table.SaveIndex(bytes.NewBufferString(""))
+	if err != ErrDiskIndex {
+		t.Errorf("Unexpected error saving a disk index.\nExpected: %v\nGot:      %v", ErrDiskIndex, err)
+	}
+
+	// The flushed index is trusted up to the data it covers, a key it holds
+	// and the data file doesn't tells it was not rebuilt
+	index, err := btree.OpenDiskTree(file, btree.DiskOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, offset := index.Search([]byte("key0000"))
+	index.Replace([]byte("GHOST"), offset)
+	index.Flush()
+
+	loaded := open(table.Data)
+	tt := []struct {
+		Key   string
+		Value string
+	}{
+		{"key0000", "value0000"},
+		{"key0500", "value0500"},
+		{"key1000", "value1000"},
+		{"GHOST", "value0000"},
+	}
+	for _, example := range tt {
+		actual, err := loaded.Get([]byte(example.Key))
+		if err != nil || string(actual) != example.Value {
+			t.Errorf("Expected to find '%s' at key '%s' but found '%s' (%v)", example.Value, example.Key, actual, err)
+		}
+	}
+	if _, err := loaded.Get([]byte("key0001")); !reflect.DeepEqual(err, NotFoundError{Key: []byte("key0001"), Deleted: true}) {
+		t.Errorf("Expected deleted key to not be found but got %v", err)
+	}
+	if loaded.Size() != 1002 {
+		t.Errorf("Unexpected loaded table size.\nExpected: %v\nGot:      %v", 1002, loaded.Size())
+	}
+
+	// An index flushed from another data file is rebuilt
+	other, teardownOther, err := GenerateTable(`FOO | foo`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardownOther()
+	other = open(other.Data)
+	if other.Size() != 1 || !reflect.DeepEqual(other.Keys(), [][]byte{[]byte("FOO")}) {
+		t.Errorf("Expected disk index of another data file to be rebuilt, got keys %q", other.Keys())
+	}
+
+	other.Options.MultiValue = true
+	err = other.Put([]byte("FOO"), []byte("bar"))
+	if err != ErrDiskIndexMultiValue {
+		t.Errorf("Unexpected error indexing every version on disk.\nExpected: %v\nGot:      %v", ErrDiskIndexMultiValue, err)
+	}
+}
+
+func TestConcurrentReads(t *testing.T) {
+	table, teardown, err := GenerateTable("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+
+	for i := 0; i < 100; i++ {
+		table.Put([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%03d", i)))
+	}
+
+	// Reads don't move the cursor of the data file
+	table.Data.Seek(0, io.SeekStart)
+	table.Get([]byte("key042"))
+	offset, _ := table.Data.Seek(0, io.SeekCurrent)
+	if offset != 0 {
+		t.Errorf("Expected reads to leave the data file cursor alone.\nExpected: %v\nGot:      %v", 0, offset)
+	}
+
+	errs := make(chan error, 8)
+	var wg sync.WaitGroup
+	for r := 0; r < 8; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				key := fmt.Sprintf("key%03d", i)
+				value, err := table.Get([]byte(key))
+				if err != nil || string(value) != fmt.Sprintf("value%03d", i) {
+					errs <- fmt.Errorf("read '%s' for %s (%v)", value, key, err)
+					return
+				}
+			}
+			errs <- table.ScanAll(func(key, data []byte) {})
+		}()
+	}
+	for i := 100; i < 200; i++ {
+		err := table.Put([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%03d", i)))
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Expected concurrent reads to succeed but %v", err)
+		}
+	}
+	if table.Size() != 200 {
+		t.Errorf("Unexpected table size.\nExpected: %v\nGot:      %v", 200, table.Size())
+	}
+}
+
 func TestKeys(t *testing.T) {
 	tt := []struct {
 		Data string